@@ -3,8 +3,11 @@ module github.com/ggdotdev/gg
 go 1.23.4
 
 require (
-	filippo.io/age v1.2.0 // indirect
-	github.com/BurntSushi/toml v1.4.0 // indirect
+	filippo.io/age v1.2.0
+	github.com/BurntSushi/toml v1.4.0
+)
+
+require (
 	github.com/anthropics/anthropic-sdk-go v1.19.0 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
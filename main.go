@@ -5,18 +5,35 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"filippo.io/age"
+	"filippo.io/age/armor"
 	"github.com/BurntSushi/toml"
 )
 
@@ -32,14 +49,6 @@ func getBackendURL() string {
 	return defaultBackendURL
 }
 
-// Token costs (approximate)
-const (
-	TokenCostNPM  = 18
-	TokenCostBrew = 22
-	TokenCostGit  = 12
-	TokenCostBase = 20
-)
-
 // Supported providers
 const (
 	ProviderAnthropic = "anthropic"
@@ -49,8 +58,9 @@ const (
 
 // SecretsData holds encrypted API keys
 type SecretsData struct {
-	APIKey        string `toml:"api_key"`         // Primary API key (any provider)
-	ClaudeAPIKey  string `toml:"claude_api_key"`  // Legacy: kept for backwards compat
+	APIKey        string `toml:"api_key"`        // Primary API key (any provider)
+	ClaudeAPIKey  string `toml:"claude_api_key"` // Legacy: kept for backwards compat
+	OpenAIAPIKey  string `toml:"openai_api_key"` // For provider = "openai"; falls back to api_key
 	MaazaAPIKey   string `toml:"maaza_api_key"`
 	ProLicenseKey string `toml:"pro_license_key"`
 }
@@ -62,22 +72,73 @@ type Config struct {
 		Tier    string `toml:"tier"`
 	} `toml:"gg"`
 	API struct {
-		Provider    string  `toml:"provider"`    // anthropic, openai, ollama
-		Model       string  `toml:"model"`       // Model name
+		Provider    string  `toml:"provider"` // anthropic, openai, ollama
+		Model       string  `toml:"model"`    // Model name
 		Temperature float64 `toml:"temperature"`
-		Endpoint    string  `toml:"endpoint"`    // Custom endpoint (for Ollama)
+		Endpoint    string  `toml:"endpoint"` // Custom endpoint (for Ollama)
+		// OpenAI-compatible API root for provider = "openai" (vLLM, LiteLLM,
+		// gateways using Bearer auth); defaults to https://api.openai.com/v1
+		BaseURL string `toml:"base_url"`
+		// Local Maaza engine for gg ask --local; default_engine = "maaza"
+		// routes every ask there, falling back to the provider on failure
+		MaazaEndpoint string `toml:"maaza_endpoint"`
+		DefaultEngine string `toml:"default_engine"`
+		// Sent with every model request, e.g. for API gateways
+		ExtraHeaders map[string]string `toml:"extra_headers"`
+		// Retries for 429/5xx/timeouts before any output (default 3, -1 = off)
+		MaxRetries int `toml:"max_retries"`
 		// Legacy fields for backwards compat
 		ClaudeModel       string  `toml:"claude_model"`
 		ClaudeTemperature float64 `toml:"claude_temperature"`
 		MaazaModel        string  `toml:"maaza_model"`
 	} `toml:"api"`
 	GitHub struct {
+		Host          string `toml:"host"` // GitHub Enterprise host, e.g. github.acme.com
 		DefaultBranch string `toml:"default_branch"`
+		MergeMethod   string `toml:"merge_method"`  // merge, squash or rebase (default squash)
+		DeleteBranch  bool   `toml:"delete_branch"` // delete the head branch after merging
 	} `toml:"github"`
-	Secrets SecretsData `toml:"keys"`
+	Git struct {
+		SignCommits bool `toml:"sign_commits"` // git commit -S for gg ask
+	} `toml:"git"`
+	Cache struct {
+		MaxSizeMB int `toml:"max_size_mb"` // evict oldest entries above this
+		TTLDays   int `toml:"ttl_days"`    // gg cache clean removes entries older than this (default 7)
+	} `toml:"cache"`
+	Ask struct {
+		CommitTrailers  []string          `toml:"commit_trailers"`  // Generated-By, Model, Tokens or Key=Value
+		BuildCommand    map[string]string `toml:"build_command"`    // marker file -> build command
+		SecretScan      bool              `toml:"secret_scan"`      // abort when generated files contain secrets
+		MaxModelCalls   int               `toml:"max_model_calls"`  // cap on model calls per gg ask (0 = no cap)
+		ReviewChecklist []string          `toml:"review_checklist"` // appended to PR bodies as checkboxes
+		OpenPR          bool              `toml:"open_pr"`          // open the new PR in the browser
+	} `toml:"ask"`
+	Stats struct {
+		RecordDetails bool `toml:"record_details"` // keep prompts/commands for gg stats top
+		HashDetails   bool `toml:"hash_details"`   // store a hash instead of the text
+	} `toml:"stats"`
+	Run struct {
+		TimeoutSignal string `toml:"timeout_signal"` // signal for gg run --timeout: TERM (default), INT, KILL, HUP
+	} `toml:"run"`
+	Limits struct {
+		MonthlyUSD float64 `toml:"monthly_usd"` // refuse gg ask once this month's estimated cost reaches it (0 = no cap)
+		WarnPct    int     `toml:"warn_pct"`    // warn past this share of monthly_usd (default 80)
+	} `toml:"limits"`
+	Network struct {
+		Proxy    string `toml:"proxy"`     // proxy URL for all outbound requests; overrides HTTP(S)_PROXY
+		CABundle string `toml:"ca_bundle"` // PEM file trusted in addition to the system roots
+	} `toml:"network"`
+	ModelAliases map[string]string `toml:"model_aliases"` // short name -> model ID
+	Secrets      SecretsData       `toml:"keys"`
 }
 
 func main() {
+	extractGlobalFlags()
+	resolveProfile()
+	configureNetwork()
+	configureGitHubHost()
+	migrateCache(false)
+
 	if len(os.Args) < 2 {
 		printUsage()
 		return
@@ -132,6 +193,12 @@ func main() {
 		handleUpgrade()
 	case "pro":
 		handlePro()
+	case "doctor":
+		handleDoctor()
+	case "whoami":
+		handleWhoami()
+	case "completion":
+		handleCompletion()
 	default:
 		if strings.Contains(cmd, "/") {
 			handleRepo(cmd)
@@ -147,8 +214,8 @@ func printUsage() {
 	fmt.Println("Compresses git/npm/pip/brew calls to <100 tokens (vs 1,000-2,000 raw)")
 	fmt.Println()
 	fmt.Println("quick start:")
-	fmt.Println("  gg pip requests      # 18 tokens (vs ~1,200 raw)")
-	fmt.Println("  gg npm lodash        # 18 tokens (vs ~1,800 raw)")
+	fmt.Println("  gg pip requests      # a few dozen tokens (vs ~1,200 raw)")
+	fmt.Println("  gg npm lodash        # a few dozen tokens (vs ~1,800 raw)")
 	fmt.Println("  gg chat \"question\"   # AI chat with gg awareness")
 	fmt.Println()
 	fmt.Println("setup:")
@@ -166,21 +233,34 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("git:")
 	fmt.Println("  gg .                 Current repo → minimal context")
+	fmt.Println("  gg . --serve         MCP server on stdio (list_files, read_file, run_command)")
 	fmt.Println("  gg user/repo         Any GitHub repo → minimal context")
-	fmt.Println("  gg pr <number>       View/manage specific PR")
-	fmt.Println("  gg approve           Merge PR created by gg ask")
+	fmt.Println("  gg pr <number>       View/manage specific PR (--web opens browser)")
+	fmt.Println("  gg pr checks <n>     CI status for a PR (--watch polls until done)")
+	fmt.Println("  gg pr list           Open PRs (--state all|closed|merged, --limit N)")
+	fmt.Println("  gg pr diff <n>       Show a PR's diff (--save <file> [--also-print])")
+	fmt.Println("  gg pr checkout <n>   Fetch a PR's branch and switch to it (--branch, --force)")
+	fmt.Println("  gg pr edit <n>       Fix a PR's --title/--body (--body-file F|-)")
+	fmt.Println("  gg approve [n]       Merge PR #n, or the latest (--merge/--rebase, --delete-branch)")
+	fmt.Println("                       --require-checks blocks on failing CI; --wait [--timeout 30m] polls")
 	fmt.Println("  gg run <cmd>         Run command in sandbox")
 	fmt.Println()
 	fmt.Println("packages:")
-	fmt.Println("  gg npm <pkg>         npm → ~18 tokens (vs ~1,800 raw)")
-	fmt.Println("  gg pip <pkg>         PyPI → ~18 tokens (vs ~1,200 raw)")
-	fmt.Println("  gg brew [-i] <f>     Homebrew → ~22 tokens (vs ~800 raw)")
+	fmt.Println("  gg npm <pkg>         npm summary + token estimate (vs ~1,800 raw, --readme for docs)")
+	fmt.Println("  gg npm search <q>    Find npm packages by keyword (--limit n)")
+	fmt.Println("  gg pip <pkg>         PyPI summary + token estimate (vs ~1,200 raw)")
+	fmt.Println("  gg brew [-i] <f>     Homebrew summary + token estimate (vs ~800 raw, --cask for apps)")
 	fmt.Println("  gg chain <tools>     Chain multiple lookups")
 	fmt.Println("  gg cool <toolbelt>   Curated toolbelts (webdev, media, sec, data)")
 	fmt.Println("  gg cache status      Show cache size")
 	fmt.Println()
 	fmt.Println("other:")
-	fmt.Println("  gg stats             Usage statistics")
+	fmt.Println("  gg stats             Usage statistics (top, --by-label, --estimate)")
+	fmt.Println("  gg whoami            Active profile and provider")
+	fmt.Println("  gg doctor            Check tools, auth and connectivity (--json for CI)")
+	fmt.Println("  gg --profile <name>  Use a named config profile (or GG_PROFILE)")
+	fmt.Println("  gg --debug <cmd>     Log commands, model requests and cache lookups to stderr (or GG_DEBUG=1)")
+	fmt.Println("  gg completion <sh>   Print a bash, zsh or fish completion script")
 	fmt.Println("  gg version           Show version")
 	fmt.Println("  gg help              Show this help")
 	fmt.Println()
@@ -197,12 +277,37 @@ func handleMaaza() {
 	fmt.Println("Code-execution MCP — optimized for token efficiency")
 	fmt.Println("Compatible with: Claude Desktop, Cursor, any MCP client")
 	fmt.Println()
-	fmt.Println("Configure: ~/.gg/config.toml")
+	cfg := loadPlainConfig()
+	endpoint := cfg.API.MaazaEndpoint
+	if endpoint == "" {
+		endpoint = defaultMaazaEndpoint
+	}
+	engine := cfg.API.DefaultEngine
+	if engine == "" {
+		engine = "cloud"
+	}
+	fmt.Printf("Endpoint:       %s\n", endpoint)
+	fmt.Printf("Model:          %s\n", maazaModel(cfg))
+	fmt.Printf("Default engine: %s\n", engine)
+	fmt.Println()
+	fmt.Println("Use: gg ask --local \"...\"")
+	fmt.Println("Configure: ~/.gg/config.toml ([api] maaza_endpoint, maaza_model, default_engine)")
 }
 
 func handleCurrentRepo() {
+	if len(os.Args) > 2 && os.Args[2] == "--serve" {
+		root, err := commandOutput("git", "rev-parse", "--show-toplevel")
+		if err != nil {
+			fatalError("gg . --serve must run inside a git repository", nil)
+		}
+		repoRoot := strings.TrimSpace(string(root))
+		fmt.Fprintf(os.Stderr, "gg MCP server for %s (stdio)\n", repoRoot)
+		serveMCP(repoMCPServer(repoRoot))
+		return
+	}
+
 	// Get git remote URL
-	cmd := exec.Command("git", "remote", "get-url", "origin")
+	cmd := command("git", "remote", "get-url", "origin")
 	output, err := cmd.Output()
 	if err != nil {
 		fmt.Println("Not in a git repo or no remote configured")
@@ -220,35 +325,75 @@ func handleCurrentRepo() {
 	fmt.Printf("Current repo: %s\n", repo)
 	fmt.Println()
 	fmt.Println("MCP endpoint:")
-	fmt.Printf("  https://api.github.com/repos/%s\n", repo)
+	fmt.Printf("  %s/repos/%s\n", githubAPIBase(), repo)
 	fmt.Println()
 	fmt.Println("Code-execution MCP active — works with Claude Desktop, Cursor")
+	fmt.Println("Serve this repo over MCP (stdio): gg . --serve")
 }
 
 func handleRepo(repo string) {
 	fmt.Printf("Repo: %s\n", repo)
 	fmt.Println()
 	fmt.Println("MCP endpoint:")
-	fmt.Printf("  https://api.github.com/repos/%s\n", repo)
+	fmt.Printf("  %s/repos/%s\n", githubAPIBase(), repo)
 	fmt.Println()
 	fmt.Println("Code-execution MCP active")
 }
 
+// githubHost is the GitHub host gg talks to: GH_HOST, then [github] host,
+// then github.com
+var githubHost = "github.com"
+
+// configureGitHubHost points gg (and the gh invocations it makes, via
+// GH_HOST) at a GitHub Enterprise host when one is configured
+func configureGitHubHost() {
+	host := os.Getenv("GH_HOST")
+	if host == "" {
+		host = loadPlainConfig().GitHub.Host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+	if host == "" || host == "github.com" {
+		return
+	}
+	githubHost = host
+	if os.Getenv("GH_HOST") == "" {
+		os.Setenv("GH_HOST", host)
+	}
+}
+
+// githubAPIBase is the REST API root for githubHost (Enterprise serves it
+// under /api/v3)
+func githubAPIBase() string {
+	if githubHost == "github.com" {
+		return "https://api.github.com"
+	}
+	return "https://" + githubHost + "/api/v3"
+}
+
 func parseGitHubURL(url string) string {
 	// Remove .git suffix
 	url = strings.TrimSuffix(url, ".git")
 
-	// Handle HTTPS URLs
-	if strings.Contains(url, "github.com/") {
-		parts := strings.Split(url, "github.com/")
-		if len(parts) == 2 {
-			return strings.TrimPrefix(parts[1], ":")
-		}
+	hosts := []string{"github.com"}
+	if githubHost != "github.com" {
+		hosts = append([]string{githubHost}, hosts...)
 	}
+	for _, host := range hosts {
+		// Handle SSH URLs (git@host:user/repo, ssh://git@host/user/repo)
+		if strings.HasPrefix(url, "git@"+host+":") {
+			return strings.TrimPrefix(url, "git@"+host+":")
+		}
+		if strings.HasPrefix(url, "ssh://git@"+host+"/") {
+			return strings.TrimPrefix(url, "ssh://git@"+host+"/")
+		}
 
-	// Handle SSH URLs (git@github.com:user/repo)
-	if strings.HasPrefix(url, "git@github.com:") {
-		return strings.TrimPrefix(url, "git@github.com:")
+		// Handle HTTPS URLs
+		if strings.Contains(url, host+"/") {
+			parts := strings.Split(url, host+"/")
+			if len(parts) == 2 {
+				return strings.TrimPrefix(parts[1], ":")
+			}
+		}
 	}
 
 	// Handle custom SSH aliases (git@github-alias:user/repo)
@@ -262,49 +407,611 @@ func parseGitHubURL(url string) string {
 	return ""
 }
 
+// ============================================================================
+// MCP SERVER
+// ============================================================================
+
+// mcpProtocolVersion is the MCP revision gg . --serve implements
+const mcpProtocolVersion = "2024-11-05"
+
+const (
+	mcpMaxReadBytes      = 256 * 1024
+	mcpMaxListedFiles    = 2000
+	mcpDefaultRunTimeout = 60 * time.Second
+	mcpMaxRunTimeout     = 10 * time.Minute
+)
+
+// mcpRequest is one JSON-RPC 2.0 message from the client; notifications
+// have no ID
+type mcpRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type mcpTool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"inputSchema"`
+}
+
+// mcpServer is what serveMCP serves: a tool list and how to call a tool.
+// Call reports a failed tool run via failed and errMCPUnknownTool for a
+// name not in Tools; other errors become error results.
+type mcpServer struct {
+	Tools []mcpTool
+	Call  func(name string, args json.RawMessage) (text string, failed bool, err error)
+}
+
+var errMCPUnknownTool = errors.New("unknown tool")
+
+// mcpRepoTools are the tools gg . --serve exposes, all scoped to the repo root
+var mcpRepoTools = []mcpTool{
+	{
+		Name:        "list_files",
+		Description: "List files in the repository (tracked and untracked, honoring .gitignore)",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"path":    map[string]interface{}{"type": "string", "description": "Directory relative to the repo root (default: whole repo)"},
+				"pattern": map[string]interface{}{"type": "string", "description": "Glob matched against file names, e.g. *.go"},
+			},
+		},
+	},
+	{
+		Name:        "read_file",
+		Description: "Read a text file from the repository (first 256KB)",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"path": map[string]interface{}{"type": "string", "description": "File path relative to the repo root"},
+			},
+			"required": []string{"path"},
+		},
+	},
+	{
+		Name:        "run_command",
+		Description: "Run a shell command in the repository root, as gg run --json does; returns exit code, stdout and stderr",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"command":         map[string]interface{}{"type": "string", "description": "Command line, run with sh -c"},
+				"timeout_seconds": map[string]interface{}{"type": "integer", "description": "Kill the command after this long (default 60, max 600)"},
+			},
+			"required": []string{"command"},
+		},
+	},
+}
+
+// serveMCP speaks MCP over stdio (newline-delimited JSON-RPC) until stdin
+// closes. Stdout carries only protocol messages: anything else gg prints
+// meanwhile is sent to stderr.
+func serveMCP(srv mcpServer) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	os.Stdout = os.Stderr
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var req mcpRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				enc.Encode(map[string]interface{}{"jsonrpc": "2.0", "id": nil, "error": mcpError{Code: -32700, Message: "parse error"}})
+			} else if result, rpcErr := handleMCPRequest(srv, req); len(req.ID) > 0 {
+				resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+				if rpcErr != nil {
+					resp["error"] = rpcErr
+				} else {
+					resp["result"] = result
+				}
+				enc.Encode(resp)
+			}
+		}
+		if readErr != nil {
+			return
+		}
+	}
+}
+
+// handleMCPRequest answers one request; notifications return nil, nil
+func handleMCPRequest(srv mcpServer, req mcpRequest) (interface{}, *mcpError) {
+	debugf("mcp: %s", req.Method)
+	switch req.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "gg", "version": version},
+		}, nil
+	case "ping":
+		return map[string]interface{}{}, nil
+	case "tools/list":
+		return map[string]interface{}{"tools": srv.Tools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &mcpError{Code: -32602, Message: "invalid params"}
+		}
+		if len(params.Arguments) == 0 {
+			params.Arguments = json.RawMessage("{}")
+		}
+		text, failed, err := srv.Call(params.Name, params.Arguments)
+		if errors.Is(err, errMCPUnknownTool) {
+			return nil, &mcpError{Code: -32602, Message: "unknown tool: " + params.Name}
+		}
+		if err != nil {
+			return mcpToolResult(err.Error(), true), nil
+		}
+		return mcpToolResult(text, failed), nil
+	}
+	if strings.HasPrefix(req.Method, "notifications/") {
+		return nil, nil
+	}
+	return nil, &mcpError{Code: -32601, Message: "method not found: " + req.Method}
+}
+
+// repoMCPServer serves mcpRepoTools for the repository at root
+func repoMCPServer(root string) mcpServer {
+	return mcpServer{
+		Tools: mcpRepoTools,
+		Call: func(name string, args json.RawMessage) (string, bool, error) {
+			switch name {
+			case "list_files":
+				text, err := mcpListFiles(root, args)
+				return text, false, err
+			case "read_file":
+				text, err := mcpReadFile(root, args)
+				return text, false, err
+			case "run_command":
+				return mcpRunCommand(root, args)
+			}
+			return "", false, errMCPUnknownTool
+		},
+	}
+}
+
+func mcpToolResult(text string, isError bool) map[string]interface{} {
+	return map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// mcpRepoPath resolves a client-supplied path inside root, refusing any
+// that escape it (including through symlinks)
+func mcpRepoPath(root, path string) (string, error) {
+	full := filepath.Join(root, filepath.Clean("/"+path))
+	real, err := filepath.EvalSymlinks(full)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s not found", path)
+	} else if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realRoot, real); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repository", path)
+	}
+	return real, nil
+}
+
+func mcpListFiles(root string, args json.RawMessage) (string, error) {
+	var in struct {
+		Path    string `json:"path"`
+		Pattern string `json:"pattern"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", err
+	}
+	gitArgs := []string{"-C", root, "ls-files", "--cached", "--others", "--exclude-standard"}
+	if in.Path != "" {
+		dir, err := mcpRepoPath(root, in.Path)
+		if err != nil {
+			return "", err
+		}
+		gitArgs = append(gitArgs, "--", dir)
+	}
+	output, err := commandOutput("git", gitArgs...)
+	if err != nil {
+		return "", fmt.Errorf("git ls-files failed: %v", err)
+	}
+
+	var files []string
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if file == "" {
+			continue
+		}
+		if in.Pattern != "" {
+			if ok, _ := filepath.Match(in.Pattern, filepath.Base(file)); !ok {
+				continue
+			}
+		}
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	if len(files) > mcpMaxListedFiles {
+		return strings.Join(files[:mcpMaxListedFiles], "\n") + fmt.Sprintf("\n... %d more", len(files)-mcpMaxListedFiles), nil
+	}
+	return strings.Join(files, "\n"), nil
+}
+
+func mcpReadFile(root string, args json.RawMessage) (string, error) {
+	var in struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil || in.Path == "" {
+		return "", fmt.Errorf("path is required")
+	}
+	path, err := mcpRepoPath(root, in.Path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory; use list_files", in.Path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, mcpMaxReadBytes))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", fmt.Errorf("%s is a binary file (%s)", in.Path, formatSize(info.Size()))
+	}
+	text := string(data)
+	if info.Size() > mcpMaxReadBytes {
+		text += fmt.Sprintf("\n... truncated (%s of %s shown)", formatSize(mcpMaxReadBytes), formatSize(info.Size()))
+	}
+	return text, nil
+}
+
+// mcpRunCommand runs a command the way gg run --json does and returns
+// that JSON document, reporting failed for a non-zero or abnormal exit
+func mcpRunCommand(root string, args json.RawMessage) (string, bool, error) {
+	var in struct {
+		Command        string `json:"command"`
+		TimeoutSeconds int    `json:"timeout_seconds"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil || strings.TrimSpace(in.Command) == "" {
+		return "", false, fmt.Errorf("command is required")
+	}
+	text, failed := mcpRun([]string{in.Command}, false, in.TimeoutSeconds, func(cmd *exec.Cmd) {
+		cmd.Dir = root
+	})
+	return text, failed, nil
+}
+
+// mcpRun runs cmdArgs through gg run's sandbox (sh -c, or the argv as
+// given in execMode) with a timeout, returning the gg run --json document
+// and whether the command failed. setup adjusts the command before it
+// starts.
+func mcpRun(cmdArgs []string, execMode bool, timeoutSeconds int, setup func(*exec.Cmd)) (string, bool) {
+	timeout := mcpDefaultRunTimeout
+	if timeoutSeconds > 0 {
+		timeout = min(time.Duration(timeoutSeconds)*time.Second, mcpMaxRunTimeout)
+	}
+	sig, err := parseTimeoutSignal(loadPlainConfig().Run.TimeoutSignal)
+	if err != nil {
+		sig = "TERM"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := buildRunCommand(ctx, cmdArgs, execMode, sig)
+	setup(cmd)
+	result := captureRun(ctx, cmd, strings.Join(cmdArgs, " "), runOptions{Label: "mcp", Exec: execMode})
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	failed := result.TimedOut || result.Error != "" || result.Signal != "" || result.ExitCode == nil || *result.ExitCode != 0
+	return string(data), failed
+}
+
+// chainToolSchema is the input schema of every tool gg chain run --serve
+// exposes
+var chainToolSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"args":            map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "Command-line arguments"},
+		"stdin":           map[string]interface{}{"type": "string", "description": "Text fed to the tool's stdin"},
+		"timeout_seconds": map[string]interface{}{"type": "integer", "description": "Kill the tool after this long (default 60, max 600)"},
+	},
+}
+
+// mcpToolNameRe matches characters not allowed in MCP tool names
+var mcpToolNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// chainMCPServer serves each npm and brew tool of a saved chain as an MCP
+// tool (npm_prettier, brew_jq) that runs its binary with the arguments the
+// agent supplies. Descriptions come from the cached package metadata.
+func chainMCPServer(name string, env []string) (mcpServer, error) {
+	tools := loadChain(name)
+	if tools == nil {
+		return mcpServer{}, fmt.Errorf("chain not found: %s", name)
+	}
+
+	bins := map[string]string{}
+	var served []mcpTool
+	for _, tool := range tools {
+		kind, spec, _ := strings.Cut(tool, ":")
+		var pkg, bin, desc string
+		switch kind {
+		case "npm":
+			var pinned string
+			pkg, pinned = splitNPMSpec(spec)
+			info, _, err := fetchNPMPackage(pkg, pinned)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: no metadata for %s: %v\n", tool, err)
+			}
+			bin = npmBinName(pkg, info)
+			desc, _ = info["description"].(string)
+		case "brew":
+			pkg, bin = spec, brewBinName(spec)
+			info, err := fetchBrewInfo(spec, false)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: no metadata for %s: %v\n", tool, err)
+			}
+			desc, _ = info["desc"].(string)
+		default:
+			fmt.Fprintf(os.Stderr, "Skipping %s: only npm and brew tools can be served\n", tool)
+			continue
+		}
+
+		// Sanitizing can map two packages to one name; suffix the later ones
+		baseName := kind + "_" + strings.Trim(mcpToolNameRe.ReplaceAllString(pkg, "_"), "_")
+		toolName := baseName
+		for n := 2; bins[toolName] != ""; n++ {
+			toolName = fmt.Sprintf("%s_%d", baseName, n)
+		}
+		if desc == "" {
+			desc = pkg
+		}
+		served = append(served, mcpTool{
+			Name:        toolName,
+			Description: fmt.Sprintf("%s (%s:%s). Runs `%s <args>` in the current directory; returns exit code, stdout and stderr.", strings.TrimSuffix(desc, "."), kind, pkg, bin),
+			InputSchema: chainToolSchema,
+		})
+		bins[toolName] = bin
+	}
+	if len(served) == 0 {
+		return mcpServer{}, fmt.Errorf("chain %s has no npm or brew tools to serve", name)
+	}
+
+	return mcpServer{
+		Tools: served,
+		Call: func(tool string, args json.RawMessage) (string, bool, error) {
+			bin, ok := bins[tool]
+			if !ok {
+				return "", false, errMCPUnknownTool
+			}
+			var in struct {
+				Args           []string `json:"args"`
+				Stdin          string   `json:"stdin"`
+				TimeoutSeconds int      `json:"timeout_seconds"`
+			}
+			if err := json.Unmarshal(args, &in); err != nil {
+				return "", false, fmt.Errorf("invalid arguments: %v", err)
+			}
+			path, err := exec.LookPath(bin)
+			if err != nil {
+				return "", false, fmt.Errorf("%s is not installed; run: gg chain run %s --install", bin, name)
+			}
+			text, failed := mcpRun(append([]string{path}, in.Args...), true, in.TimeoutSeconds, func(cmd *exec.Cmd) {
+				cmd.Env = append(os.Environ(), env...)
+				cmd.Stdin = strings.NewReader(in.Stdin)
+			})
+			return text, failed, nil
+		},
+	}, nil
+}
+
+// brewBinName picks the executable a formula installs from brew list: the
+// one named after the formula, else the first in bin/, else the formula
+// name itself (e.g. ripgrep installs rg)
+func brewBinName(formula string) string {
+	output, err := commandOutput("brew", "list", "--formula", formula)
+	if err != nil {
+		return formula
+	}
+	var bins []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if filepath.Base(filepath.Dir(line)) == "bin" {
+			bins = append(bins, filepath.Base(line))
+		}
+	}
+	if len(bins) == 0 || slices.Contains(bins, formula) {
+		return formula
+	}
+	return bins[0]
+}
+
+// npmBinName picks the executable an npm package installs: the bin entry
+// named after the package, its only entry, or the package name itself
+func npmBinName(pkg string, info map[string]interface{}) string {
+	base := pkg[strings.LastIndex(pkg, "/")+1:]
+	switch bin := info["bin"].(type) {
+	case map[string]interface{}:
+		if _, ok := bin[base]; ok {
+			return base
+		}
+		names := make([]string, 0, len(bin))
+		for name := range bin {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			return names[0]
+		}
+	}
+	return base
+}
+
 // ============================================================================
 // CONFIG MANAGEMENT
 // ============================================================================
 
 func handleConfig() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg config init")
+		fmt.Println("Usage: gg config <command>")
+		fmt.Println()
+		fmt.Println("Commands:")
+		fmt.Println("  init [--passphrase]          Interactive setup (--passphrase encrypts the key itself)")
+		fmt.Println("  get <key>                    Print a value, e.g. api.model")
+		fmt.Println("  set <key> <value>            Change a value without re-running init")
+		fmt.Println("  set-default-profile <name>   Use <name> when no --profile/GG_PROFILE is given")
+		fmt.Println("  list-profiles                Show profiles with their tier and model")
+		fmt.Println("  schema                       Print JSON Schema for config.toml")
+		fmt.Println("  import-from-env              Write config + secrets from GG_* variables")
+		fmt.Println("  set-model-alias <alias> <id> Map a short model name to a model ID")
+		fmt.Println("  set-proxy <url|none>         Route gg's HTTP requests through a proxy")
+		fmt.Println("  tier status                  Show tier, gated features and remaining quota")
+		fmt.Println("  rotate-key                   Re-encrypt secrets under a new age key")
+		fmt.Println()
+		fmt.Println("GG_API_KEY, GG_CLAUDE_API_KEY, GG_OPENAI_API_KEY, GG_MAAZA_API_KEY and")
+		fmt.Println("GG_PRO_LICENSE_KEY override the encrypted secrets (env > secrets file).")
 		return
 	}
 
 	subCmd := os.Args[2]
-	if subCmd == "init" {
+	switch subCmd {
+	case "init":
 		initConfig()
-	} else {
+	case "get":
+		getConfigValue(os.Args[3:])
+	case "set":
+		setConfigValue(os.Args[3:])
+	case "set-default-profile":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: gg config set-default-profile <name|default>")
+			return
+		}
+		setDefaultProfile(os.Args[3])
+	case "list-profiles", "profiles":
+		listProfiles()
+	case "schema":
+		schema := configSchema(reflect.TypeOf(Config{}))
+		schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		schema["title"] = "gg config (~/.gg/config.toml)"
+		data, _ := json.MarshalIndent(schema, "", "  ")
+		fmt.Println(string(data))
+	case "import-from-env":
+		importConfigFromEnv()
+	case "set-model-alias":
+		setModelAlias(os.Args[3:])
+	case "tier":
+		if len(os.Args) > 3 && os.Args[3] != "status" {
+			fmt.Println("Usage: gg config tier status")
+			return
+		}
+		showTierStatus()
+	case "rotate-key":
+		rotateKey()
+	case "set-proxy":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: gg config set-proxy <url|none>")
+			return
+		}
+		setProxy(os.Args[3])
+	default:
 		fmt.Printf("Unknown config subcommand: %s\n", subCmd)
 	}
 }
 
+// configSchema describes a config struct type as JSON Schema, keyed by
+// its toml tags
+func configSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("toml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			props[name] = configSchema(field.Type)
+		}
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		if t == reflect.TypeOf(SecretsData{}) {
+			schema["description"] = "Secrets; stored encrypted in ~/.gg/secrets"
+		}
+		return schema
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": configSchema(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": configSchema(t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
 func initConfig() {
 	fmt.Printf("Welcome to gg v%s!\n", version)
 	fmt.Println()
 	fmt.Println("Setting up your configuration...")
 	fmt.Println()
 
-	// Create ~/.gg directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		fatalError("Failed to get home directory", err)
-	}
-
-	ggDir := filepath.Join(homeDir, ".gg")
+	// Create ~/.gg (or the active profile's) directory
+	ggDir := getConfigDir()
 	if err := os.MkdirAll(ggDir, 0700); err != nil {
 		fatalError("Failed to create .gg directory", err)
 	}
 
-	// Generate Age identity
+	// Generate Age identity, optionally wrapped with a passphrase
 	identity, err := age.GenerateX25519Identity()
 	if err != nil {
 		fatalError("Failed to generate encryption key", err)
 	}
 
+	passphrase := ""
+	if slices.Contains(os.Args[1:], "--passphrase") {
+		passphrase = readPassphrase("Passphrase for the encryption key: ")
+		if passphrase == "" {
+			fatalError("Empty passphrase", nil)
+		}
+		if readPassphrase("Repeat passphrase: ") != passphrase {
+			fatalError("Passphrases don't match", nil)
+		}
+		fmt.Println()
+		identityPassphrase = passphrase
+	}
+	keyData, err := marshalIdentity(identity, passphrase)
+	if err != nil {
+		fatalError("Failed to protect encryption key", err)
+	}
+
 	keyPath := filepath.Join(ggDir, ".key")
-	if err := os.WriteFile(keyPath, []byte(identity.String()), 0600); err != nil {
+	if err := os.WriteFile(keyPath, keyData, 0600); err != nil {
 		fatalError("Failed to save encryption key", err)
 	}
 
@@ -319,11 +1026,14 @@ func initConfig() {
 	providerChoice, _ := reader.ReadString('\n')
 	providerChoice = strings.TrimSpace(providerChoice)
 
-	var provider, model, endpoint string
+	var provider, model, endpoint, baseURL string
 	switch providerChoice {
 	case "2":
 		provider = ProviderOpenAI
 		model = "gpt-4o"
+		fmt.Printf("\nOpenAI-compatible base URL [%s]:\n> ", defaultOpenAIBaseURL)
+		baseURLInput, _ := reader.ReadString('\n')
+		baseURL = strings.TrimSpace(baseURLInput)
 		fmt.Print("\nEnter your OpenAI API key:\n> ")
 	case "3":
 		provider = ProviderOllama
@@ -375,6 +1085,7 @@ func initConfig() {
 	cfg.API.Model = model
 	cfg.API.Temperature = 0.7
 	cfg.API.Endpoint = endpoint
+	cfg.API.BaseURL = baseURL
 	cfg.GitHub.DefaultBranch = "main"
 
 	// Save plain config
@@ -403,1278 +1114,6558 @@ func initConfig() {
 	fmt.Println()
 	fmt.Printf("Provider: %s\n", provider)
 	fmt.Printf("Model: %s\n", model)
-	fmt.Println("Configuration saved to ~/.gg/config.toml")
-	fmt.Println("Secrets encrypted and saved to ~/.gg/secrets")
+	if activeProfile != "" {
+		fmt.Printf("Profile: %s\n", activeProfile)
+	}
+	fmt.Printf("Configuration saved to %s\n", configPath)
+	fmt.Printf("Secrets encrypted and saved to %s\n", secretsPath)
 	fmt.Println()
 	fmt.Println("Run 'gg ask \"your prompt\"' to get started!")
 }
 
-// detectProvider auto-detects the provider from API key format
-func detectProvider(apiKey string) string {
-	if strings.HasPrefix(apiKey, "sk-ant-") {
-		return ProviderAnthropic
-	}
-	if strings.HasPrefix(apiKey, "sk-") {
-		return ProviderOpenAI
+// configKeyPaths lists the dotted keys gg config get/set accept for t
+func configKeyPaths(t reflect.Type, prefix string) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("toml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Struct:
+			keys = append(keys, configKeyPaths(field.Type, prefix+name+".")...)
+		case reflect.Map:
+			keys = append(keys, prefix+name+".<name>")
+		default:
+			keys = append(keys, prefix+name)
+		}
 	}
-	return ""
+	return keys
 }
 
-// getEffectiveConfig returns provider/model/key handling legacy configs
-func getEffectiveConfig(cfg *Config) (provider, model, endpoint, apiKey string) {
-	// New config format takes precedence
-	if cfg.API.Provider != "" {
-		provider = cfg.API.Provider
-		model = cfg.API.Model
-		endpoint = cfg.API.Endpoint
-		apiKey = cfg.Secrets.APIKey
+// configField resolves a dotted key against cfg. For keys inside a map
+// section (model_aliases.fast) it returns the map and the entry name.
+func configField(cfg *Config, key string) (reflect.Value, string, error) {
+	v := reflect.ValueOf(cfg).Elem()
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if v.Kind() == reflect.Map {
+			if i != len(parts)-1 {
+				break
+			}
+			return v, part, nil
+		}
+		if v.Kind() != reflect.Struct {
+			break
+		}
+		found := false
+		for j := 0; j < v.NumField(); j++ {
+			if strings.Split(v.Type().Field(j).Tag.Get("toml"), ",")[0] == part {
+				v = v.Field(j)
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		if i == len(parts)-1 && v.Kind() != reflect.Struct {
+			return v, "", nil
+		}
 	}
+	return reflect.Value{}, "", fmt.Errorf("unknown config key %q. Valid keys:\n  %s",
+		key, strings.Join(configKeyPaths(reflect.TypeOf(Config{}), ""), "\n  "))
+}
 
-	// Fall back to legacy config
-	if provider == "" {
-		provider = ProviderAnthropic
-	}
-	if model == "" {
-		if cfg.API.ClaudeModel != "" {
-			model = cfg.API.ClaudeModel
-		} else {
-			model = "claude-sonnet-4-20250514"
+// formatConfigValue renders a config value the way gg config get prints it
+func formatConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
 		}
+		return strings.Join(items, ",")
+	case reflect.Map:
+		var lines []string
+		for _, k := range v.MapKeys() {
+			lines = append(lines, fmt.Sprintf("%s = %v", k.String(), v.MapIndex(k).Interface()))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	default:
+		return fmt.Sprint(v.Interface())
 	}
-	if apiKey == "" && cfg.Secrets.ClaudeAPIKey != "" {
-		apiKey = cfg.Secrets.ClaudeAPIKey
-	}
+}
 
-	// Auto-detect from key
-	if apiKey != "" && provider == ProviderAnthropic {
-		detected := detectProvider(apiKey)
-		if detected == ProviderOpenAI {
-			provider = ProviderOpenAI
-			if model == "" || strings.HasPrefix(model, "claude") {
-				model = "gpt-4o"
+// setConfigField parses raw into the field's type. Lists are
+// comma-separated; an empty value removes a map entry.
+func setConfigField(v reflect.Value, mapKey, raw string) error {
+	if mapKey != "" {
+		if raw == "" {
+			if !v.IsNil() {
+				v.SetMapIndex(reflect.ValueOf(mapKey), reflect.Value{})
 			}
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
 		}
+		v.SetMapIndex(reflect.ValueOf(mapKey), reflect.ValueOf(raw))
+		return nil
 	}
 
-	return
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", raw)
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", raw)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		return fmt.Errorf("set individual entries instead, e.g. <key>.<name>")
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
 }
 
-func loadConfig() (*Config, error) {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return nil, err
+// getConfigValue handles gg config get <key>. Secrets under keys.* are
+// decrypted but masked unless --reveal is given.
+func getConfigValue(args []string) {
+	reveal := false
+	var key string
+	for _, arg := range args {
+		if arg == "--reveal" {
+			reveal = true
+		} else if key == "" {
+			key = arg
+		}
 	}
-
-	ggDir := filepath.Join(homeDir, ".gg")
-	configPath := filepath.Join(ggDir, "config.toml")
-
-	// Load plain config
-	var cfg Config
-	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
-		return nil, fmt.Errorf("config not found. Run: gg config init")
+	if key == "" {
+		fmt.Println("Usage: gg config get <key> [--reveal]")
+		fmt.Println()
+		fmt.Println("Keys:")
+		for _, k := range configKeyPaths(reflect.TypeOf(Config{}), "") {
+			fmt.Printf("  %s\n", k)
+		}
+		return
 	}
 
-	// Load and decrypt secrets
-	keyPath := filepath.Join(ggDir, ".key")
-	keyData, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, fmt.Errorf("encryption key not found")
+	var cfg *Config
+	if strings.HasPrefix(key, "keys.") {
+		var err error
+		cfg, err = loadConfig()
+		if err != nil {
+			fatalError("Failed to load secrets", err)
+		}
+	} else {
+		cfg = loadPlainConfig()
 	}
 
-	identity, err := age.ParseX25519Identity(string(keyData))
+	v, mapKey, err := configField(cfg, key)
 	if err != nil {
-		return nil, err
+		fatalError(err.Error(), nil)
 	}
-
-	secretsPath := filepath.Join(ggDir, "secrets")
-	if err := decryptSecrets(&cfg.Secrets, identity, secretsPath); err != nil {
-		return nil, err
+	if mapKey != "" {
+		entry := v.MapIndex(reflect.ValueOf(mapKey))
+		if !entry.IsValid() {
+			os.Exit(1)
+		}
+		v = entry
 	}
 
-	return &cfg, nil
+	value := formatConfigValue(v)
+	if strings.HasPrefix(key, "keys.") && !reveal && value != "" {
+		value = maskSecret(value)
+	}
+	fmt.Println(value)
 }
 
-func encryptSecrets(secrets SecretsData, identity *age.X25519Identity, path string) error {
-	// Create wrapper struct for TOML encoding
-	data := struct {
-		Keys SecretsData `toml:"keys"`
-	}{Keys: secrets}
+// setConfigValue handles gg config set <key> <value>. Plain settings go to
+// config.toml; keys.* are re-encrypted into the secrets file.
+func setConfigValue(args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: gg config set <key> <value>")
+		fmt.Println("Run 'gg config get' to list keys")
+		return
+	}
+	key, raw := args[0], args[1]
 
-	// Encode to TOML
-	var buf strings.Builder
-	if err := toml.NewEncoder(&buf).Encode(data); err != nil {
-		return err
+	if strings.HasPrefix(key, "keys.") {
+		ggDir := getConfigDir()
+		if err := os.MkdirAll(ggDir, 0700); err != nil {
+			fatalError("Failed to create .gg directory", err)
+		}
+		identity, _, err := loadOrCreateIdentity(ggDir)
+		if err != nil {
+			fatalError("Failed to load encryption key", err)
+		}
+
+		var cfg Config
+		secretsPath := filepath.Join(ggDir, "secrets")
+		if _, err := os.Stat(secretsPath); err == nil {
+			if err := decryptSecrets(&cfg.Secrets, identity, secretsPath); err != nil {
+				fatalError("Failed to decrypt existing secrets", err)
+			}
+		}
+		v, mapKey, err := configField(&cfg, key)
+		if err != nil {
+			fatalError(err.Error(), nil)
+		}
+		if err := setConfigField(v, mapKey, raw); err != nil {
+			fatalError(fmt.Sprintf("Invalid value for %s: %v", key, err), nil)
+		}
+		if err := encryptSecrets(cfg.Secrets, identity, secretsPath); err != nil {
+			fatalError("Failed to encrypt secrets", err)
+		}
+		fmt.Printf("%s updated in %s\n", key, secretsPath)
+		return
 	}
 
-	// Encrypt with Age
-	out, err := os.Create(path)
+	cfg := loadPlainConfig()
+	cfg.Secrets = SecretsData{}
+	v, mapKey, err := configField(cfg, key)
 	if err != nil {
-		return err
+		fatalError(err.Error(), nil)
+	}
+	if err := setConfigField(v, mapKey, raw); err != nil {
+		fatalError(fmt.Sprintf("Invalid value for %s: %v", key, err), nil)
+	}
+	if key == "api.temperature" && (cfg.API.Temperature < 0 || cfg.API.Temperature > 1) {
+		fatalError("api.temperature must be between 0 and 1", nil)
 	}
-	defer out.Close()
 
-	w, err := age.Encrypt(out, identity.Recipient())
+	configPath, err := saveConfig(cfg)
 	if err != nil {
-		return err
+		fatalError("Failed to write config", err)
 	}
-
-	if _, err := io.WriteString(w, buf.String()); err != nil {
-		return err
+	shown := raw
+	if mapKey == "" {
+		shown = formatConfigValue(v)
 	}
-
-	return w.Close()
+	fmt.Printf("%s = %s (%s)\n", key, shown, configPath)
 }
 
-func decryptSecrets(secrets *SecretsData, identity *age.X25519Identity, path string) error {
-	in, err := os.Open(path)
-	if err != nil {
-		return err
+// importConfigFromEnv persists GG_* environment variables into config.toml
+// and the encrypted secrets file, for non-interactive (container) setup.
+// Existing settings and secrets are kept unless overridden.
+func importConfigFromEnv() {
+	ggDir := getConfigDir()
+	if err := os.MkdirAll(ggDir, 0700); err != nil {
+		fatalError("Failed to create .gg directory", err)
 	}
-	defer in.Close()
 
-	r, err := age.Decrypt(in, identity)
+	cfg := loadPlainConfig()
+	cfg.Secrets = SecretsData{}
+
+	identity, created, err := loadOrCreateIdentity(ggDir)
 	if err != nil {
-		return err
+		fatalError("Failed to load encryption key", err)
+	}
+	secretsPath := filepath.Join(ggDir, "secrets")
+	if !created {
+		if _, err := os.Stat(secretsPath); err == nil {
+			if err := decryptSecrets(&cfg.Secrets, identity, secretsPath); err != nil {
+				fatalError("Failed to decrypt existing secrets", err)
+			}
+		}
 	}
 
-	data, err := io.ReadAll(r)
-	if err != nil {
-		return err
+	var imported []string
+	setFromEnv := func(name string, dst *string) {
+		if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+			*dst = v
+			imported = append(imported, name)
+		}
+	}
+	setFromEnv("GG_PROVIDER", &cfg.API.Provider)
+	setFromEnv("GG_MODEL", &cfg.API.Model)
+	setFromEnv("GG_ENDPOINT", &cfg.API.Endpoint)
+	setFromEnv("GG_BASE_URL", &cfg.API.BaseURL)
+	setFromEnv("GG_DEFAULT_BRANCH", &cfg.GitHub.DefaultBranch)
+	for _, v := range secretEnvVars {
+		setFromEnv(v.Name, v.Field(&cfg.Secrets))
+	}
+	if v := os.Getenv("GG_TEMPERATURE"); v != "" {
+		temp, err := strconv.ParseFloat(v, 64)
+		if err != nil || temp < 0 || temp > 1 {
+			fatalError("GG_TEMPERATURE must be a number between 0 and 1", nil)
+		}
+		cfg.API.Temperature = temp
+		imported = append(imported, "GG_TEMPERATURE")
 	}
 
-	// Decode TOML
-	var temp struct {
-		Keys SecretsData `toml:"keys"`
+	if len(imported) == 0 && !created {
+		fmt.Println("No GG_* variables set; nothing to import")
+		fmt.Println("Supported: GG_PROVIDER GG_MODEL GG_TEMPERATURE GG_ENDPOINT GG_BASE_URL GG_DEFAULT_BRANCH")
+		fmt.Println("           GG_API_KEY GG_CLAUDE_API_KEY GG_OPENAI_API_KEY GG_MAAZA_API_KEY GG_PRO_LICENSE_KEY")
+		return
 	}
 
-	if err := toml.Unmarshal(data, &temp); err != nil {
-		return err
+	// Fill the same defaults gg config init would
+	cfg.GG.Version = version
+	if cfg.API.Provider == "" {
+		cfg.API.Provider = detectProvider(cfg.Secrets.APIKey)
+		if cfg.API.Provider == "" {
+			cfg.API.Provider = ProviderAnthropic
+		}
+	}
+	if cfg.API.Model == "" {
+		switch cfg.API.Provider {
+		case ProviderOpenAI:
+			cfg.API.Model = "gpt-4o"
+		case ProviderOllama:
+			cfg.API.Model = "llama3.2"
+		default:
+			cfg.API.Model = "claude-sonnet-4-20250514"
+		}
+	}
+	if cfg.API.Provider == ProviderOllama && cfg.API.Endpoint == "" {
+		cfg.API.Endpoint = "http://localhost:11434"
+	}
+	if cfg.API.Temperature == 0 && os.Getenv("GG_TEMPERATURE") == "" {
+		cfg.API.Temperature = 0.7
+	}
+	if cfg.GitHub.DefaultBranch == "" {
+		cfg.GitHub.DefaultBranch = "main"
+	}
+	if strings.HasPrefix(cfg.Secrets.ProLicenseKey, "gg_pro_") {
+		cfg.GG.Tier = "pro"
+	} else if cfg.GG.Tier == "" {
+		cfg.GG.Tier = "free"
 	}
 
-	*secrets = temp.Keys
-	return nil
-}
+	// Secrets only go to the encrypted file
+	secrets := cfg.Secrets
+	cfg.Secrets = SecretsData{}
 
-// ============================================================================
-// AUTHENTICATION
-// ============================================================================
+	configPath, err := saveConfig(cfg)
+	if err != nil {
+		fatalError("Failed to write config", err)
+	}
 
-func checkGitHubAuth() (bool, error) {
-	cmd := exec.Command("gh", "auth", "status")
-	output, err := cmd.CombinedOutput()
+	if err := encryptSecrets(secrets, identity, secretsPath); err != nil {
+		fatalError("Failed to encrypt secrets", err)
+	}
 
-	if err == nil && strings.Contains(string(output), "Logged in") {
-		return true, nil
+	if created {
+		fmt.Println("Generated new encryption key")
+	}
+	if len(imported) > 0 {
+		fmt.Printf("Imported: %s\n", strings.Join(imported, ", "))
 	}
+	fmt.Printf("Provider: %s\n", cfg.API.Provider)
+	fmt.Printf("Model: %s\n", cfg.API.Model)
+	fmt.Printf("Configuration saved to %s\n", configPath)
+	fmt.Printf("Secrets encrypted and saved to %s\n", secretsPath)
+}
 
-	return false, nil
+// builtinModelAliases ship with gg; [model_aliases] entries override them
+var builtinModelAliases = map[string]string{
+	"sonnet":     "claude-sonnet-4-5-20250929",
+	"sonnet-4":   "claude-sonnet-4-20250514",
+	"opus":       "claude-opus-4-1-20250805",
+	"haiku":      "claude-3-5-haiku-20241022",
+	"gpt4o":      "gpt-4o",
+	"gpt4o-mini": "gpt-4o-mini",
+	"llama":      "llama3.2",
 }
 
-func ensureGitHubAuth() error {
-	authed, _ := checkGitHubAuth()
-	if authed {
-		return nil
+// resolveModelAlias maps a short model name to its full ID, leaving
+// unknown names untouched
+func resolveModelAlias(cfg *Config, model string) string {
+	if id, ok := cfg.ModelAliases[model]; ok && id != "" {
+		return id
 	}
-
-	fmt.Println("GitHub authentication required")
-	fmt.Println()
-	fmt.Println("Run: gh auth login")
-	fmt.Println("Or install gh CLI: https://cli.github.com")
-
-	return fmt.Errorf("not authenticated")
+	if id, ok := builtinModelAliases[model]; ok {
+		return id
+	}
+	return model
 }
 
-// ============================================================================
-// ASK COMMAND
-// ============================================================================
-
-func handleAsk() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg ask \"your prompt here\"")
-		return
-	}
+// setModelAlias handles gg config set-model-alias; with no arguments it
+// lists the aliases in effect
+func setModelAlias(args []string) {
+	cfg := loadPlainConfig()
 
-	// Parse prompt and check for --pro flag
-	args := os.Args[2:]
-	proMode := false
-	var promptParts []string
+	if len(args) == 0 {
+		aliases := map[string]string{}
+		for k, v := range builtinModelAliases {
+			aliases[k] = v
+		}
+		for k, v := range cfg.ModelAliases {
+			aliases[k] = v
+		}
+		names := make([]string, 0, len(aliases))
+		for k := range aliases {
+			names = append(names, k)
+		}
+		sort.Strings(names)
 
-	for _, arg := range args {
-		if arg == "--pro" {
-			proMode = true
-		} else {
-			promptParts = append(promptParts, arg)
+		fmt.Println("Model aliases:")
+		for _, name := range names {
+			source := ""
+			if _, ok := cfg.ModelAliases[name]; ok {
+				source = " (custom)"
+			}
+			fmt.Printf("  %-12s %s%s\n", name, aliases[name], source)
 		}
+		fmt.Println()
+		fmt.Println("Usage: gg config set-model-alias <alias> <model-id>")
+		return
 	}
-
-	prompt := strings.Join(promptParts, " ")
-	if prompt == "" {
-		fmt.Println("No prompt provided")
+	if len(args) != 2 || strings.TrimSpace(args[0]) == "" || strings.TrimSpace(args[1]) == "" {
+		fmt.Println("Usage: gg config set-model-alias <alias> <model-id>")
 		return
 	}
 
-	// Load config
-	cfg, err := loadConfig()
-	if err != nil {
-		fatalError("Config error. Run: gg config init", err)
+	alias, id := strings.TrimSpace(args[0]), strings.TrimSpace(args[1])
+	if cfg.ModelAliases == nil {
+		cfg.ModelAliases = map[string]string{}
 	}
-
-	// Check Pro tier
-	if !proMode && !checkProTier(cfg) {
-		fmt.Println("Analyzing request...")
-		fmt.Println()
-		fmt.Println("Implementation plan:")
-		fmt.Println("  1. Analyze repository structure")
-		fmt.Println("  2. Generate code changes")
-		fmt.Println("  3. Create pull request")
-		fmt.Println()
-		fmt.Println("+--------------------------------------+")
-		fmt.Println("|   gg Pro required for this feature  |")
-		fmt.Println("+--------------------------------------+")
-		fmt.Println()
-		fmt.Println("Pro features:")
-		fmt.Println("  - Full AI-powered code generation")
-		fmt.Println("  - Unlimited gg ask commands")
-		fmt.Println("  - Priority API access")
-		fmt.Println()
-		fmt.Println("Upgrade: https://ggdotdev.com/pro ($15/month)")
-		fmt.Println("Or use: gg ask \"...\" --pro")
-		return
+	cfg.ModelAliases[alias] = id
+	if _, err := saveConfig(cfg); err != nil {
+		fatalError("Failed to write config", err)
 	}
+	fmt.Printf("Alias %s -> %s\n", alias, id)
+}
 
-	if proMode && !checkProTier(cfg) {
-		fatalError("Pro license not found in config", nil)
+// saveConfig writes cfg to the active config.toml and returns its path.
+// Callers must clear secrets first; they belong in the encrypted file.
+func saveConfig(cfg *Config) (string, error) {
+	dir := getConfigDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
 	}
-
-	// Check GitHub auth
-	if err := ensureGitHubAuth(); err != nil {
-		return
+	configPath := filepath.Join(dir, "config.toml")
+	f, err := os.Create(configPath)
+	if err != nil {
+		return "", err
 	}
+	defer f.Close()
+	return configPath, toml.NewEncoder(f).Encode(cfg)
+}
 
-	// Get current repo
-	repoName := getCurrentRepo()
-	if repoName == "" {
-		fatalError("Not in a git repository", nil)
+// loadOrCreateIdentity reads the Age key in dir, generating one if absent
+func loadOrCreateIdentity(dir string) (*age.X25519Identity, bool, error) {
+	keyPath := filepath.Join(dir, ".key")
+	keyData, err := os.ReadFile(keyPath)
+	if err == nil {
+		identity, err := parseIdentityFile(keyData)
+		return identity, false, err
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
 	}
 
-	fmt.Printf("Generating code for %s...\n", repoName)
-	fmt.Println()
-
-	// Call API with streaming
-	response, err := callAPIStreaming(cfg, prompt, repoName)
+	identity, err := age.GenerateX25519Identity()
 	if err != nil {
-		fatalError("API error", sanitizeError(err))
+		return nil, false, err
 	}
-
-	// Track ask usage
-	trackCommandUsage("ask", prompt, 0)
-
-	// Parse code blocks
-	files := parseCodeBlocks(response)
-	if len(files) == 0 {
-		fmt.Println("No code blocks found in response")
-		fmt.Println("Response:")
-		fmt.Println(response)
-		return
+	if err := os.WriteFile(keyPath, []byte(identity.String()), 0600); err != nil {
+		return nil, false, err
 	}
+	return identity, true, nil
+}
 
-	// Create branch
-	branchName := fmt.Sprintf("gg-ask-%d", time.Now().Unix())
-	exec.Command("git", "checkout", "-b", branchName).Run()
+// identityPassphrase is the passphrase that unlocked a protected .key in
+// this process, so it is asked for at most once; it is never stored
+var identityPassphrase string
 
-	// Apply changes
-	for path, content := range files {
-		dir := filepath.Dir(path)
-		if dir != "." {
-			os.MkdirAll(dir, 0755)
-		}
-		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
-			fmt.Printf("Failed to write %s: %v\n", path, err)
-			continue
-		}
-		fmt.Printf("+ %s\n", path)
+// parseIdentityFile reads a .key file: a plain X25519 identity, or one
+// wrapped with an age passphrase (gg config init --passphrase), which is
+// unlocked with GG_PASSPHRASE or a prompt
+func parseIdentityFile(keyData []byte) (*age.X25519Identity, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(keyData), []byte(armor.Header)) {
+		return age.ParseX25519Identity(strings.TrimSpace(string(keyData)))
+	}
+
+	passphrase := identityPassphrase
+	if passphrase == "" {
+		passphrase = os.Getenv("GG_PASSPHRASE")
+	}
+	if passphrase == "" {
+		passphrase = readPassphrase("Passphrase for gg encryption key: ")
+	}
+	scrypt, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	r, err := age.Decrypt(armor.NewReader(bytes.NewReader(keyData)), scrypt)
+	if err != nil {
+		return nil, fmt.Errorf("unlock key (wrong passphrase?): %w", err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	identityPassphrase = passphrase
+	return age.ParseX25519Identity(strings.TrimSpace(string(plain)))
+}
+
+// marshalIdentity returns the .key file contents for identity, wrapped
+// with passphrase when one is given
+func marshalIdentity(identity *age.X25519Identity, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return []byte(identity.String()), nil
+	}
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, identity.String()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readPassphrase prompts on stderr and reads a line from stdin, turning
+// terminal echo off where stty is available
+func readPassphrase(prompt string) string {
+	fmt.Fprint(os.Stderr, prompt)
+	stty := func(arg string) error {
+		cmd := command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	// Read unbuffered so later readers of stdin see the rest
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 0 || err != nil || b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	return strings.TrimRight(string(line), "\r")
+}
+
+// detectProvider auto-detects the provider from API key format
+func detectProvider(apiKey string) string {
+	if strings.HasPrefix(apiKey, "sk-ant-") {
+		return ProviderAnthropic
+	}
+	if strings.HasPrefix(apiKey, "sk-") {
+		return ProviderOpenAI
+	}
+	return ""
+}
+
+// getEffectiveConfig returns provider/model/key handling legacy configs
+func getEffectiveConfig(cfg *Config) (provider, model, endpoint, apiKey string) {
+	// New config format takes precedence
+	if cfg.API.Provider != "" {
+		provider = cfg.API.Provider
+		model = cfg.API.Model
+		endpoint = cfg.API.Endpoint
+		apiKey = cfg.Secrets.APIKey
+	}
+
+	// Fall back to legacy config
+	if provider == "" {
+		provider = ProviderAnthropic
+	}
+	if model == "" {
+		if cfg.API.ClaudeModel != "" {
+			model = cfg.API.ClaudeModel
+		} else {
+			model = "claude-sonnet-4-20250514"
+		}
+	}
+	if apiKey == "" && cfg.Secrets.ClaudeAPIKey != "" {
+		apiKey = cfg.Secrets.ClaudeAPIKey
+	}
+
+	model = resolveModelAlias(cfg, model)
+
+	// Auto-detect from key
+	if apiKey != "" && provider == ProviderAnthropic {
+		detected := detectProvider(apiKey)
+		if detected == ProviderOpenAI {
+			provider = ProviderOpenAI
+			if model == "" || strings.HasPrefix(model, "claude") {
+				model = "gpt-4o"
+			}
+		}
+	}
+
+	// OpenAI-compatible providers use base_url and may have their own key
+	if provider == ProviderOpenAI {
+		endpoint = cfg.API.BaseURL
+		if cfg.Secrets.OpenAIAPIKey != "" {
+			apiKey = cfg.Secrets.OpenAIAPIKey
+		}
+	}
+
+	return
+}
+
+// secretEnvVars are GG_* variables that override the encrypted secrets
+// (env > secrets file). gg config import-from-env persists them.
+var secretEnvVars = []struct {
+	Name  string
+	Field func(*SecretsData) *string
+}{
+	{"GG_API_KEY", func(s *SecretsData) *string { return &s.APIKey }},
+	{"GG_CLAUDE_API_KEY", func(s *SecretsData) *string { return &s.ClaudeAPIKey }},
+	{"GG_OPENAI_API_KEY", func(s *SecretsData) *string { return &s.OpenAIAPIKey }},
+	{"GG_MAAZA_API_KEY", func(s *SecretsData) *string { return &s.MaazaAPIKey }},
+	{"GG_PRO_LICENSE_KEY", func(s *SecretsData) *string { return &s.ProLicenseKey }},
+}
+
+// loadConfig reads config.toml and the encrypted secrets, then applies
+// secretEnvVars on top. With any of those set, a missing config, key or
+// secrets file is not an error (headless/CI use), and a passphrase-locked
+// key is not unlocked when the env already supplies the model key.
+func loadConfig() (*Config, error) {
+	ggDir := getConfigDir()
+	configPath := filepath.Join(ggDir, "config.toml")
+
+	var fromEnv SecretsData
+	hasEnv := false
+	for _, v := range secretEnvVars {
+		if val := strings.TrimSpace(os.Getenv(v.Name)); val != "" {
+			*v.Field(&fromEnv) = val
+			hasEnv = true
+		}
+	}
+
+	// Load plain config
+	var cfg Config
+	if _, err := toml.DecodeFile(configPath, &cfg); err != nil && !(hasEnv && os.IsNotExist(err)) {
+		return nil, fmt.Errorf("config not found. Run: gg config init")
+	}
+
+	// Load and decrypt secrets
+	keyPath := filepath.Join(ggDir, ".key")
+	secretsPath := filepath.Join(ggDir, "secrets")
+	keyData, err := os.ReadFile(keyPath)
+	switch {
+	case err == nil && hasEnv && envCoversModelKey(cfg, fromEnv) && keyNeedsPassphrase(keyData):
+		debugf("secrets: env supplies the model key; not unlocking %s", keyPath)
+	case err == nil:
+		identity, err := parseIdentityFile(keyData)
+		if err != nil {
+			return nil, err
+		}
+		if err := decryptSecrets(&cfg.Secrets, identity, secretsPath); err != nil && !(hasEnv && os.IsNotExist(err)) {
+			return nil, err
+		}
+	case !hasEnv:
+		return nil, fmt.Errorf("encryption key not found")
+	}
+
+	applyEnvSecrets(&cfg, fromEnv)
+	return &cfg, nil
+}
+
+// applyEnvSecrets overlays env-supplied secrets on cfg. getEffectiveConfig
+// prefers APIKey over ClaudeAPIKey and OpenAIAPIKey over APIKey, so a
+// provider-specific env key also replaces the key that provider reads, and
+// GG_API_KEY replaces a file OpenAI key, keeping env > secrets file.
+func applyEnvSecrets(cfg *Config, env SecretsData) {
+	for _, v := range secretEnvVars {
+		if val := *v.Field(&env); val != "" {
+			*v.Field(&cfg.Secrets) = val
+		}
+	}
+	switch {
+	case env.APIKey != "":
+		if env.OpenAIAPIKey == "" && cfg.API.Provider == ProviderOpenAI {
+			cfg.Secrets.OpenAIAPIKey = ""
+		}
+	case env.ClaudeAPIKey != "" && cfg.API.Provider == ProviderAnthropic:
+		cfg.Secrets.APIKey = env.ClaudeAPIKey
+	}
+}
+
+// envCoversModelKey reports whether the env alone yields the API key the
+// configured provider needs
+func envCoversModelKey(cfg Config, env SecretsData) bool {
+	cfg.Secrets = SecretsData{}
+	applyEnvSecrets(&cfg, env)
+	_, _, _, apiKey := getEffectiveConfig(&cfg)
+	return apiKey != ""
+}
+
+// keyNeedsPassphrase reports whether unlocking the .key file would prompt
+func keyNeedsPassphrase(keyData []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(keyData), []byte(armor.Header)) &&
+		identityPassphrase == "" && os.Getenv("GG_PASSPHRASE") == ""
+}
+
+// loadPlainConfig reads config.toml without touching secrets. Commands that
+// only need settings (cache, network) use it so they work unconfigured.
+func loadPlainConfig() *Config {
+	var cfg Config
+	toml.DecodeFile(filepath.Join(getConfigDir(), "config.toml"), &cfg)
+	return &cfg
+}
+
+func encryptSecrets(secrets SecretsData, identity *age.X25519Identity, path string) error {
+	// Create wrapper struct for TOML encoding
+	data := struct {
+		Keys SecretsData `toml:"keys"`
+	}{Keys: secrets}
+
+	// Encode to TOML
+	var buf strings.Builder
+	if err := toml.NewEncoder(&buf).Encode(data); err != nil {
+		return err
+	}
+
+	// Encrypt with Age
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w, err := age.Encrypt(out, identity.Recipient())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, buf.String()); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// rotateKey generates a new age identity and re-encrypts the secrets under
+// it. The old key is kept as .key.bak-<timestamp>; the new key and secrets
+// are written to temp files and renamed into place.
+func rotateKey() {
+	dir := getConfigDir()
+	keyPath := filepath.Join(dir, ".key")
+	secretsPath := filepath.Join(dir, "secrets")
+
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		fatalError("No key to rotate. Run: gg config init", err)
+	}
+	oldIdentity, err := parseIdentityFile(keyData)
+	if err != nil {
+		fatalError("Cannot parse "+keyPath, err)
+	}
+
+	var secrets SecretsData
+	hasSecrets := false
+	if _, err := os.Stat(secretsPath); err == nil {
+		if err := decryptSecrets(&secrets, oldIdentity, secretsPath); err != nil {
+			fatalError("Failed to decrypt secrets with the current key", err)
+		}
+		hasSecrets = true
+	}
+
+	newIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		fatalError("Failed to generate key", err)
+	}
+
+	backupPath := keyPath + ".bak-" + time.Now().Format("20060102-150405")
+	if err := os.WriteFile(backupPath, keyData, 0600); err != nil {
+		fatalError("Failed to back up the old key", err)
+	}
+
+	// Stage both files, and check the new secrets decrypt, before replacing anything
+	tmpKey := keyPath + ".tmp"
+	tmpSecrets := secretsPath + ".tmp"
+	cleanup := func() {
+		os.Remove(tmpKey)
+		os.Remove(tmpSecrets)
+	}
+	newKeyData, err := marshalIdentity(newIdentity, identityPassphrase)
+	if err == nil {
+		err = os.WriteFile(tmpKey, newKeyData, 0600)
+	}
+	if err != nil {
+		cleanup()
+		fatalError("Failed to write new key", err)
+	}
+	if hasSecrets {
+		var check SecretsData
+		if err := encryptSecrets(secrets, newIdentity, tmpSecrets); err != nil {
+			cleanup()
+			fatalError("Failed to encrypt secrets", err)
+		}
+		if err := decryptSecrets(&check, newIdentity, tmpSecrets); err != nil || check != secrets {
+			cleanup()
+			fatalError("Re-encrypted secrets did not verify; nothing was changed", err)
+		}
+		if err := os.Rename(tmpSecrets, secretsPath); err != nil {
+			cleanup()
+			fatalError("Failed to replace secrets", err)
+		}
+	}
+	if err := os.Rename(tmpKey, keyPath); err != nil {
+		fmt.Fprintf(os.Stderr, "The secrets are encrypted to the new key, which is in %s\n", tmpKey)
+		fatalError("Failed to replace key", err)
+	}
+
+	fmt.Println("Key rotated")
+	fmt.Printf("   New recipient: %s\n", newIdentity.Recipient())
+	fmt.Printf("   Old key:       %s\n", backupPath)
+	if !hasSecrets {
+		fmt.Println("   (no secrets file to re-encrypt)")
+	}
+}
+
+func decryptSecrets(secrets *SecretsData, identity *age.X25519Identity, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	r, err := age.Decrypt(in, identity)
+	if err != nil {
+		return err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// Decode TOML
+	var temp struct {
+		Keys SecretsData `toml:"keys"`
+	}
+
+	if err := toml.Unmarshal(data, &temp); err != nil {
+		return err
+	}
+
+	*secrets = temp.Keys
+	return nil
+}
+
+// ============================================================================
+// AUTHENTICATION
+// ============================================================================
+
+func checkGitHubAuth() (bool, error) {
+	cmd := command("gh", "auth", "status")
+	output, err := cmd.CombinedOutput()
+	debugExit("gh", err, output)
+
+	if err == nil && strings.Contains(string(output), "Logged in") {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func ensureGitHubAuth() error {
+	authed, _ := checkGitHubAuth()
+	if authed {
+		return nil
+	}
+
+	fmt.Println("GitHub authentication required")
+	fmt.Println()
+	fmt.Println("Run: gh auth login")
+	fmt.Println("Or install gh CLI: https://cli.github.com")
+
+	return fmt.Errorf("not authenticated")
+}
+
+// ============================================================================
+// ASK COMMAND
+// ============================================================================
+
+func handleAsk() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg ask \"your prompt here\" [options]")
+		fmt.Println("       gg ask -f prompt.txt [extra text] [options]")
+		fmt.Println("       cat prompt.txt | gg ask - [options]")
+		fmt.Println()
+		fmt.Println("Options:")
+		fmt.Println("  --pro                       Require Pro license")
+		fmt.Println("  --from-template-pr <n>      Use PR #n's diff as an exemplar")
+		fmt.Println("  --sign-commits              Sign the commit (git commit -S)")
+		fmt.Println("  --commit-each-file          Commit each generated file separately")
+		fmt.Println("  --branch <name>             Branch to commit to (default gg-ask-<time>); an existing one gets a new commit")
+		fmt.Println("  --message <msg>, -m <msg>   Commit message and PR title (default \"gg ask: <prompt>\")")
+		fmt.Println("  --context <a,b>             Include these files as context (100KB total)")
+		fmt.Println("  --context-from-search <q>   Include files matching <q> as context")
+		fmt.Println("  --include-gitignored        Let context include .gitignore'd files. Careful: these")
+		fmt.Println("                              often hold secrets (.env, keys), which are sent to the model")
+		fmt.Println("  --dedupe                    Reuse an open PR made from the same prompt")
+		fmt.Println("  --max-diff-lines <n>        Abort if the change exceeds n lines (see --force)")
+		fmt.Println("  --force                     Override safety limits")
+		fmt.Println("  --ignore-template           Don't use the repo's PR template for the body")
+		fmt.Println("  --no-system-context         Send only the output-format instruction as system prompt")
+		fmt.Println("  --raw                       Send the prompt with no system prompt (implies --explain-only)")
+		fmt.Println("  --explain-only              Print the response; don't write files or open a PR")
+		fmt.Println("  --diff-only-output          Print the change as a patch on stdout; no branch, commit or PR")
+		fmt.Println("  --json-schema <file>        Generate JSON files that validate against a schema")
+		fmt.Println("  --summarize-context         Summarize context files over the size cap instead of dropping them")
+		fmt.Println("  --commit-trailer KEY=VAL    Add a git trailer to the commit (repeatable)")
+		fmt.Println("  --max-parallel-files <n>    Write up to n files concurrently (default 4)")
+		fmt.Println("  --require-clean-build       Build the project after writing; abort if it fails")
+		fmt.Println("  --no-stream                 Wait for the full response instead of streaming (Anthropic)")
+		fmt.Println("  --max-retries-total <n>     Cap model calls for this ask, across all retries")
+		fmt.Println("  --no-checklist              Leave the [ask] review_checklist off the PR body")
+		fmt.Println("  --header KEY=VAL            Extra HTTP header for the model API (repeatable)")
+		fmt.Println("  --model <name>              Override the configured model (aliases allowed)")
+		fmt.Println("  --temp <0.0-1.0>            Override the configured temperature")
+		fmt.Println("  --cache-response            Reuse a cached response for an identical request")
+		fmt.Println("  --yes, -y                   Apply changes without asking for confirmation")
+		fmt.Println("  --open-pr                   Open the created PR in the browser ([ask] open_pr)")
+		fmt.Println("  --no-open-pr                Don't open the PR even if [ask] open_pr is set")
+		fmt.Println("  --local, --maaza            Generate with the local Maaza engine (falls back to the provider)")
+		fmt.Println("  --cloud                     Use the configured provider even if [api] default_engine = \"maaza\"")
+		fmt.Println("  --no-cache                  Ignore cached responses (still refreshes the cache)")
+		fmt.Println("  --abort-on-secret           Refuse to write files containing apparent secrets")
+		fmt.Println("  --allow-secrets             Override [ask] secret_scan for this run")
+		fmt.Println()
+		fmt.Println("       gg ask --revert [--restore-backups] [--yes]")
+		fmt.Println("                              Undo the last ask: delete its branch, offer to close its PR")
+		return
+	}
+
+	// Parse prompt and flags
+	args := os.Args[2:]
+	if args[0] == "--revert" {
+		revertLastAsk(args[1:])
+		return
+	}
+	proMode := false
+	signCommits := false
+	commitEachFile := false
+	dedupe := false
+	force := false
+	ignoreTemplate := false
+	noSystemContext := false
+	rawMode := false
+	explainOnly := false
+	maxDiffLines := 0
+	schemaPath := ""
+	summarizeContext := false
+	var trailerSpecs []string
+	maxParallel := defaultParallelWrites
+	requireBuild := false
+	maxCalls := -1
+	abortOnSecret := false
+	allowSecrets := false
+	noChecklist := false
+	headers := map[string]string{}
+	modelFlag := ""
+	tempFlag := ""
+	cacheResponse := false
+	noCache := false
+	assumeYes := false
+	diffOnly := false
+	openPR := ""
+	engineFlag := ""
+	templatePR := ""
+	searchQuery := ""
+	var contextPaths []string
+	includeIgnored := false
+	promptFile := ""
+	branchFlag := ""
+	messageFlag := ""
+	var promptParts []string
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f", "--prompt-file":
+			if i+1 >= len(args) {
+				fatalError(args[i]+" requires a file (or - for stdin)", nil)
+			}
+			promptFile = args[i+1]
+			i++
+		case "-":
+			promptFile = "-"
+		case "--pro":
+			proMode = true
+		case "--sign-commits":
+			signCommits = true
+		case "--commit-each-file":
+			commitEachFile = true
+		case "--dedupe":
+			dedupe = true
+		case "--branch":
+			if i+1 >= len(args) {
+				fatalError("--branch requires a name", nil)
+			}
+			branchFlag = args[i+1]
+			i++
+		case "--message", "-m":
+			if i+1 >= len(args) || strings.TrimSpace(args[i+1]) == "" {
+				fatalError(args[i]+" requires a commit message", nil)
+			}
+			messageFlag = args[i+1]
+			i++
+		case "--force":
+			force = true
+		case "--ignore-template":
+			ignoreTemplate = true
+		case "--no-system-context":
+			noSystemContext = true
+		case "--raw":
+			rawMode = true
+			explainOnly = true
+		case "--explain-only":
+			explainOnly = true
+		case "--diff-only-output":
+			diffOnly = true
+		case "--summarize-context":
+			summarizeContext = true
+		case "--max-parallel-files":
+			if i+1 >= len(args) {
+				fatalError("--max-parallel-files requires a number", nil)
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fatalError("--max-parallel-files must be a positive integer", nil)
+			}
+			maxParallel = n
+			i++
+		case "--max-retries-total":
+			if i+1 >= len(args) {
+				fatalError("--max-retries-total requires a number", nil)
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fatalError("--max-retries-total must be a positive integer", nil)
+			}
+			maxCalls = n
+			i++
+		case "--cache-response":
+			cacheResponse = true
+		case "--no-cache":
+			noCache = true
+		case "--yes", "-y":
+			assumeYes = true
+		case "--open-pr":
+			openPR = "yes"
+		case "--no-open-pr":
+			openPR = "no"
+		case "--local", "--maaza":
+			engineFlag = "maaza"
+		case "--cloud":
+			engineFlag = "cloud"
+		case "--model":
+			if i+1 >= len(args) {
+				fatalError("--model requires a model name", nil)
+			}
+			modelFlag = args[i+1]
+			i++
+		case "--temp", "--temperature":
+			if i+1 >= len(args) {
+				fatalError("--temp requires a value between 0.0 and 1.0", nil)
+			}
+			tempFlag = args[i+1]
+			i++
+		case "--header", "--provider-header":
+			if i+1 >= len(args) {
+				fatalError(args[i]+" requires KEY=VAL", nil)
+			}
+			key, val, ok := strings.Cut(args[i+1], "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				fatalError(args[i]+" requires KEY=VAL", nil)
+			}
+			headers[strings.TrimSpace(key)] = val
+			i++
+		case "--no-checklist":
+			noChecklist = true
+		case "--abort-on-secret":
+			abortOnSecret = true
+		case "--allow-secrets":
+			allowSecrets = true
+		case "--no-stream":
+			noStream = true
+		case "--require-clean-build":
+			requireBuild = true
+		case "--commit-trailer":
+			if i+1 >= len(args) {
+				fatalError("--commit-trailer requires KEY=VAL", nil)
+			}
+			trailerSpecs = append(trailerSpecs, args[i+1])
+			i++
+		case "--json-schema":
+			if i+1 >= len(args) {
+				fatalError("--json-schema requires a file", nil)
+			}
+			schemaPath = args[i+1]
+			i++
+		case "--max-diff-lines":
+			if i+1 >= len(args) {
+				fatalError("--max-diff-lines requires a number", nil)
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				fatalError(fmt.Sprintf("Invalid --max-diff-lines: %s", args[i+1]), nil)
+			}
+			maxDiffLines = n
+			i++
+		case "--from-template-pr":
+			if i+1 >= len(args) {
+				fatalError("--from-template-pr requires a PR number", nil)
+			}
+			templatePR = args[i+1]
+			i++
+		case "--context-from-search":
+			if i+1 >= len(args) {
+				fatalError("--context-from-search requires a query", nil)
+			}
+			searchQuery = args[i+1]
+			i++
+		case "--include-gitignored":
+			includeIgnored = true
+		case "--context":
+			if i+1 >= len(args) {
+				fatalError("--context requires a comma-separated list of files", nil)
+			}
+			for _, path := range strings.Split(args[i+1], ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					contextPaths = append(contextPaths, path)
+				}
+			}
+			i++
+		default:
+			promptParts = append(promptParts, args[i])
+		}
+	}
+
+	prompt := strings.Join(promptParts, " ")
+	if promptFile != "" {
+		// Positional text becomes a suffix to the file's prompt
+		var data []byte
+		var err error
+		if promptFile == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(promptFile)
+		}
+		if err != nil {
+			fatalError("Failed to read prompt", err)
+		}
+		prompt = strings.TrimSpace(strings.TrimSpace(string(data)) + "\n\n" + prompt)
+	}
+	if prompt == "" {
+		fmt.Println("No prompt provided")
+		return
+	}
+
+	// The patch is the only thing on stdout; progress and the streamed
+	// response go to stderr
+	patchOut := os.Stdout
+	if diffOnly {
+		os.Stdout = os.Stderr
+	}
+
+	// Load config
+	cfg, err := loadConfig()
+	if err != nil {
+		fatalError("Config error. Run: gg config init", err)
+	}
+	if _, buildCmd := detectBuildCommand(cfg); requireBuild && buildCmd == "" {
+		fatalError("--require-clean-build: no build detected here (set [ask] build_command)", nil)
+	}
+	useMaaza := engineFlag == "maaza" || (engineFlag == "" && cfg.API.DefaultEngine == "maaza")
+
+	// Per-invocation model overrides
+	_, model, _, _ := getEffectiveConfig(cfg)
+	if modelFlag != "" {
+		model = resolveModelAlias(cfg, modelFlag)
+	}
+	temperature := effectiveTemperature(cfg)
+	if tempFlag != "" {
+		t, err := strconv.ParseFloat(tempFlag, 64)
+		if err != nil || t < 0 || t > 1 {
+			fatalError(fmt.Sprintf("Invalid --temp %q: must be between 0.0 and 1.0", tempFlag), nil)
+		}
+		temperature = t
+	}
+
+	for k, v := range cfg.API.ExtraHeaders {
+		if _, set := headers[k]; !set {
+			headers[k] = v
+		}
+	}
+	extraHeaders = headers
+
+	modelCallLimit = cfg.Ask.MaxModelCalls
+	if maxCalls > 0 {
+		modelCallLimit = maxCalls
+	}
+	trailerSpecs = append(cfg.Ask.CommitTrailers, trailerSpecs...)
+	if _, err := buildCommitTrailers(trailerSpecs, model); err != nil {
+		fatalError("Invalid commit trailer", err)
+	}
+
+	// Check Pro tier; free tier gets a monthly quota
+	freeRemaining := askFreeMonthlyLimit - monthlyAskCount()
+	if !proMode && !checkProTier(cfg) && freeRemaining <= 0 {
+		fmt.Println("Analyzing request...")
+		fmt.Println()
+		fmt.Println("Implementation plan:")
+		fmt.Println("  1. Analyze repository structure")
+		fmt.Println("  2. Generate code changes")
+		fmt.Println("  3. Create pull request")
+		fmt.Println()
+		fmt.Println("+--------------------------------------+")
+		fmt.Println("|   gg Pro required for this feature  |")
+		fmt.Println("+--------------------------------------+")
+		fmt.Println()
+		fmt.Printf("You've used all %d free asks this month.\n", askFreeMonthlyLimit)
+		fmt.Println()
+		fmt.Println("Pro features:")
+		fmt.Println("  - Full AI-powered code generation")
+		fmt.Println("  - Unlimited gg ask commands")
+		fmt.Println("  - Priority API access")
+		fmt.Println()
+		fmt.Println("Upgrade: https://ggdotdev.com/pro ($15/month)")
+		fmt.Println("Or use: gg ask \"...\" --pro")
+		return
+	}
+
+	if proMode && !checkProTier(cfg) {
+		fatalError("Pro license not found in config", nil)
+	}
+	if !checkBudget(cfg, force) {
+		os.Exit(1)
+	}
+	if !checkProTier(cfg) {
+		fmt.Printf("Free tier: %d of %d asks left this month\n\n", freeRemaining-1, askFreeMonthlyLimit)
+	}
+
+	// Check GitHub auth
+	if !diffOnly {
+		if err := ensureGitHubAuth(); err != nil {
+			return
+		}
+	}
+
+	// Get current repo
+	repoName := getCurrentRepo()
+	if repoName == "" {
+		fatalError("Not in a git repository", nil)
+	}
+
+	// Verify signing is possible before spending tokens
+	signCommits = signCommits || cfg.Git.SignCommits
+	if signCommits {
+		if err := checkSigningKey(); err != nil {
+			fatalError("Commit signing requested but not configured", err)
+		}
+	}
+	if branchFlag != "" && runCommand("git", "check-ref-format", "--branch", branchFlag) != nil {
+		fatalError(fmt.Sprintf("Invalid branch name %q (see git check-ref-format)", branchFlag), nil)
+	}
+
+	// Look for an open PR already generated from this prompt
+	promptHash := hashPrompt(prompt)
+	reuseBranch, reuseURL := "", ""
+	if dedupe {
+		if branch, url := findDuplicateAskPR(repoName, promptHash); branch != "" {
+			fmt.Printf("An open PR was already created from this prompt: %s\n", url)
+			fmt.Print("Add this generation to it instead of opening a new PR? [Y/n]: ")
+			reader := bufio.NewReader(os.Stdin)
+			answer, _ := reader.ReadString('\n')
+			answer = strings.TrimSpace(strings.ToLower(answer))
+			if answer == "" || answer == "y" {
+				reuseBranch, reuseURL = branch, url
+			}
+			fmt.Println()
+		}
+	}
+
+	// Include a prior PR's diff as an exemplar
+	apiPrompt := prompt
+	if templatePR != "" {
+		diff, err := fetchPRDiff(templatePR)
+		if err != nil {
+			fatalError(fmt.Sprintf("Failed to fetch diff for PR #%s", templatePR), err)
+		}
+		fmt.Printf("Using PR #%s as template (%d bytes of diff)\n", templatePR, len(diff))
+		apiPrompt = fmt.Sprintf("Here is the diff of a previous change in this repository (PR #%s):\n\n"+
+			"```diff\n%s\n```\n\n"+
+			"Produce an analogous change, following the same structure and conventions, for this request:\n\n%s",
+			templatePR, diff, prompt)
+	}
+
+	// Include listed files and files matching a search query as context.
+	// Gitignored files are left out unless --include-gitignored.
+	if includeIgnored && (len(contextPaths) > 0 || searchQuery != "") {
+		fmt.Println("Warning: --include-gitignored may send ignored files (and any secrets in them) to the model")
+	}
+	var ignored map[string]bool
+	if !includeIgnored {
+		ignored = gitIgnoredPaths(contextPaths)
+	}
+	var contextFiles []string
+	for _, path := range contextPaths {
+		if ignored[path] {
+			fmt.Printf("Warning: %s is gitignored; skipping (use --include-gitignored)\n", path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("Warning: %s does not exist; skipping\n", path)
+			continue
+		}
+		if info.IsDir() {
+			fmt.Printf("Warning: %s is a directory; skipping\n", path)
+			continue
+		}
+		if !slices.Contains(contextFiles, path) {
+			contextFiles = append(contextFiles, path)
+		}
+	}
+	if searchQuery != "" {
+		matches, err := searchRepoFiles(searchQuery, includeIgnored)
+		if err != nil {
+			fatalError("Search failed", err)
+		}
+		if len(matches) == 0 {
+			fmt.Printf("No files matched %q\n", searchQuery)
+		}
+		for _, path := range matches {
+			if !slices.Contains(contextFiles, path) {
+				contextFiles = append(contextFiles, path)
+			}
+		}
+	}
+	if len(contextFiles) > 0 {
+		context, included := buildFileContext(contextFiles)
+		var summarized []string
+		if summarizeContext {
+			var summaries string
+			summaries, summarized = summarizeContextFiles(cfg, contextFiles, included)
+			context = summaries + context
+		}
+		fmt.Println("Context files:")
+		for _, path := range contextFiles {
+			marker := "+"
+			if slices.Contains(summarized, path) {
+				marker = "~" // summarized
+			} else if !slices.Contains(included, path) {
+				marker = "-" // skipped: over size cap
+			}
+			fmt.Printf("  %s %s\n", marker, path)
+		}
+		if context != "" && !strings.HasSuffix(context, "REQUEST:\n") {
+			context += "REQUEST:\n"
+		}
+		apiPrompt = context + apiPrompt
+		fmt.Println()
+	}
+
+	fmt.Printf("Generating code for %s...\n", repoName)
+	fmt.Println()
+
+	// Constrain output to a JSON Schema
+	var schema map[string]interface{}
+	if schemaPath != "" {
+		data, err := os.ReadFile(schemaPath)
+		if err != nil {
+			fatalError("Cannot read schema", err)
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			fatalError("Invalid JSON schema", err)
+		}
+		apiPrompt += fmt.Sprintf("\n\nOutput JSON only. Every generated file must be valid JSON conforming to this JSON Schema:\n```json\n%s\n```", string(data))
+	}
+
+	// Call API with streaming
+	systemPrompt := askSystemPrompt(repoName, noSystemContext)
+	if rawMode {
+		systemPrompt = ""
+	}
+
+	// generate makes one model call, trying Maaza first when selected.
+	// answeredBy records which model produced the response.
+	answeredBy := model
+	generate := func(userPrompt string) (string, error) {
+		if useMaaza {
+			text, err := callMaaza(cfg, systemPrompt, userPrompt, temperature)
+			if err == nil {
+				answeredBy = maazaModel(cfg)
+				return text, nil
+			}
+			fmt.Fprintf(os.Stderr, "Note: Maaza failed (%v); falling back to %s\n\n", sanitizeError(err), model)
+			useMaaza = false
+		}
+		answeredBy = model
+		return callAPIStreaming(cfg, model, temperature, systemPrompt, userPrompt)
+	}
+
+	var response string
+	cacheKey := ""
+	if cacheResponse {
+		provider, _, _, _ := getEffectiveConfig(cfg)
+		cacheModel := model
+		if useMaaza {
+			provider, cacheModel = "maaza", maazaModel(cfg)
+		}
+		cacheKey = responseCacheKey(provider, cacheModel, temperature, systemPrompt, apiPrompt)
+		if !noCache {
+			if cached, created, ok := loadCachedResponse(cacheKey); ok {
+				fmt.Printf("(cached response from %s; --no-cache to bypass)\n\n", created.Format("2006-01-02 15:04"))
+				fmt.Println(cached)
+				response = cached
+			}
+		}
+	}
+	if response == "" {
+		response, err = generate(apiPrompt)
+		if err != nil {
+			fatalError("API error", sanitizeError(err))
+		}
+		if cacheKey != "" {
+			storeCachedResponse(cacheKey, answeredBy, response)
+		}
+	}
+
+	// Track ask usage
+	trackCommandUsage("ask", prompt, 0)
+
+	// The response has already been streamed to the terminal
+	if explainOnly {
+		return
+	}
+
+	// Parse code blocks
+	files := parseCodeBlocks(response)
+
+	// Validate against the schema, asking the model to fix failures
+	for attempt := 1; schema != nil; attempt++ {
+		validationErr := validateSchemaFiles(files, schema)
+		if validationErr == nil {
+			fmt.Println("Schema validation passed")
+			break
+		}
+		if attempt >= maxSchemaAttempts {
+			fatalError(fmt.Sprintf("Output failed schema validation after %d attempts", attempt), validationErr)
+		}
+		fmt.Printf("\nSchema validation failed: %v\nRetrying (%d/%d)...\n\n", validationErr, attempt+1, maxSchemaAttempts)
+		retryPrompt := fmt.Sprintf("%s\n\nYour previous output was:\n%s\n\nIt failed schema validation: %v\nReturn corrected output.",
+			apiPrompt, response, validationErr)
+		response, err = generate(retryPrompt)
+		if err != nil {
+			fatalError("API error", sanitizeError(err))
+		}
+		files = parseCodeBlocks(response)
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No code blocks found in response")
+		fmt.Println("Response:")
+		fmt.Println(response)
+		return
+	}
+
+	// Never commit apparent credentials
+	if findings := scanForSecrets(files); len(findings) > 0 {
+		abort := (abortOnSecret || cfg.Ask.SecretScan) && !allowSecrets
+		fmt.Println()
+		if abort {
+			fmt.Println("Aborted: generated files contain apparent secrets:")
+		} else {
+			fmt.Println("Warning: generated files may contain secrets:")
+		}
+		for _, f := range findings {
+			fmt.Printf("  %s:%d  %s (%s)\n", f.Path, f.Line, f.Kind, f.Match)
+		}
+		if abort {
+			fmt.Println("Nothing was written. Re-run with --allow-secrets if these are false positives.")
+			os.Exit(1)
+		}
+		fmt.Println()
+	}
+
+	if diffOnly {
+		patch, err := askPatch(files)
+		if err != nil {
+			fatalError("Could not produce a patch", err)
+		}
+		fmt.Fprint(patchOut, patch)
+		return
+	}
+
+	// Confirm before touching the working tree
+	if !assumeYes {
+		fmt.Println()
+		fmt.Println("Files to change:")
+		for _, path := range sortedFilePaths(files) {
+			marker := "M"
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				marker = "A"
+			}
+			fmt.Printf("  %s %s\n", marker, path)
+		}
+		fmt.Printf("\nApply these %d changes? [Y/n]: ", len(files))
+		reader := bufio.NewReader(os.Stdin)
+		answer, err := reader.ReadString('\n')
+		if err != nil && answer == "" {
+			// stdin is closed (e.g. the prompt was piped in)
+			fmt.Println()
+			fmt.Println("No confirmation on stdin; nothing was written. Re-run with --yes")
+			return
+		}
+		answer = strings.TrimSpace(strings.ToLower(answer))
+		if answer != "" && answer != "y" && answer != "yes" {
+			fmt.Println("Cancelled; nothing was written")
+			return
+		}
+	}
+
+	// Create branch (or switch to the duplicate PR's or an existing --branch)
+	origBranch := getCurrentBranch()
+	branchName := fmt.Sprintf("gg-ask-%d", time.Now().Unix())
+	if branchFlag != "" {
+		branchName = branchFlag
+	}
+	createdBranch := false
+	switch {
+	case reuseBranch != "":
+		if branchFlag != "" && branchFlag != reuseBranch {
+			fmt.Printf("Ignoring --branch %s: adding to the existing PR's branch\n", branchFlag)
+		}
+		branchName = reuseBranch
+		if err := gitStep("fetch", "origin", branchName); err != nil {
+			fatalError(fmt.Sprintf("Cannot fetch branch %s of the existing PR", branchName), err)
+		}
+		if err := gitStep("checkout", branchName); err != nil {
+			fatalError(fmt.Sprintf("Cannot switch to branch %s (uncommitted changes in the way?)", branchName), err)
+		}
+	case branchFlag != "" && branchExists(branchFlag):
+		if branchName != origBranch {
+			if err := gitStep("checkout", branchName); err != nil {
+				fatalError(fmt.Sprintf("Cannot switch to branch %s (uncommitted changes in the way?)", branchName), err)
+			}
+		}
+		fmt.Printf("Adding a commit to existing branch %s\n", branchName)
+		if output, err := commandOutput("gh", "pr", "list", "--head", branchName, "--state", "open", "--json", "url", "-q", ".[0].url"); err == nil {
+			if url := strings.TrimSpace(string(output)); url != "null" {
+				reuseURL = url
+			}
+		}
+	default:
+		createdBranch = true
+		if err := gitStep("checkout", "-b", branchName); err != nil {
+			if strings.Contains(err.Error(), "already exists") {
+				fatalError(fmt.Sprintf("Branch %s already exists", branchName), nil)
+			}
+			fatalError(fmt.Sprintf("Cannot create branch %s", branchName), err)
+		}
+	}
+
+	// Apply changes, keeping the originals of overwritten files
+	overwritten, err := backupAskFiles(files, branchName)
+	if err != nil {
+		restoreAskChanges(files, origBranch, branchName, createdBranch)
+		fatalError("Cannot back up files before overwriting them; nothing was written", err)
+	}
+	writeErrs := writeAskFiles(files, maxParallel)
+	created := 0
+	for _, path := range sortedFilePaths(files) {
+		if err := writeErrs[path]; err != nil {
+			fmt.Printf("Failed to write %s: %v\n", path, err)
+			delete(files, path)
+			continue
+		}
+		if overwritten[path] {
+			fmt.Printf("~ %s\n", path)
+		} else {
+			fmt.Printf("+ %s\n", path)
+			created++
+		}
+	}
+	fmt.Printf("%d created, %d overwritten", created, len(files)-created)
+	if len(overwritten) > 0 {
+		fmt.Printf(" (originals in %s)", getBackupDir(branchName))
+	}
+	fmt.Println()
+
+	// Make sure the change at least compiles
+	if requireBuild {
+		marker, buildCmd := detectBuildCommand(cfg)
+		fmt.Printf("\nBuilding (%s): %s\n", marker, buildCmd)
+		output, err := command("sh", "-c", buildCmd).CombinedOutput()
+		if err != nil {
+			lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+			if len(lines) > 30 {
+				lines = lines[len(lines)-30:]
+			}
+			fmt.Println(strings.Join(lines, "\n"))
+			restoreAskChanges(files, origBranch, branchName, createdBranch)
+			fmt.Println()
+			fmt.Println("Aborted: build failed; generated changes were reverted")
+			os.Exit(1)
+		}
+		fmt.Println("Build passed")
 	}
 
 	// Commit and push (only stage generated files)
 	commitMsg := fmt.Sprintf("gg ask: %s", truncate(prompt, 60))
+	if messageFlag != "" {
+		commitMsg = messageFlag
+	}
+	for path := range files {
+		if err := gitStep("add", path); err != nil {
+			restoreAskChanges(files, origBranch, branchName, createdBranch)
+			fatalError(fmt.Sprintf("Cannot stage %s; generated changes were reverted", path), err)
+		}
+	}
+
+	// Refuse unreviewably large changes
+	if maxDiffLines > 0 {
+		changed := stagedDiffLines()
+		if changed > maxDiffLines && !force {
+			restoreAskChanges(files, origBranch, branchName, createdBranch)
+			fmt.Println()
+			fmt.Printf("Aborted: change is %d lines (limit %d). Re-run with --force to allow.\n", changed, maxDiffLines)
+			os.Exit(1)
+		}
+		fmt.Printf("Diff size: %d lines (limit %d)\n", changed, maxDiffLines)
+	}
+
+	// Provenance trailers from config and flags
+	trailers, _ := buildCommitTrailers(trailerSpecs, answeredBy)
+	commit := func(msg string, paths ...string) error {
+		if len(trailers) > 0 {
+			msg += "\n\n" + strings.Join(trailers, "\n")
+		}
+		commitArgs := []string{"commit", "-m", msg}
+		if signCommits {
+			commitArgs = []string{"commit", "-S", "-m", msg}
+		}
+		if len(paths) > 0 {
+			commitArgs = append(append(commitArgs, "--"), paths...)
+		}
+		return gitStep(commitArgs...)
+	}
+
+	// Where the branch stood before committing, so a failure part-way
+	// through --commit-each-file can drop the commits already made
+	headBefore, _ := commandOutput("git", "rev-parse", "--verify", "-q", "HEAD")
+	var commitErr error
+	if commitEachFile {
+		for _, path := range sortedFilePaths(files) {
+			verb := "update"
+			if runCommand("git", "cat-file", "-e", "HEAD:"+path) != nil {
+				verb = "add"
+			}
+			if commitErr = commit(fmt.Sprintf("gg ask: %s %s", verb, path), path); commitErr != nil {
+				break
+			}
+		}
+	} else {
+		commitErr = commit(commitMsg)
+	}
+	if commitErr != nil {
+		if head := strings.TrimSpace(string(headBefore)); head != "" {
+			if err := gitStep("reset", "-q", head); err != nil {
+				fatalError(fmt.Sprintf("Commit failed (hook or signing error?), and commits already made on %s could not be undone", branchName), err)
+			}
+		} else if _, err := commandOutput("git", "rev-parse", "--verify", "-q", "HEAD"); err == nil {
+			fatalError(fmt.Sprintf("Commit failed (hook or signing error?); earlier gg ask commits remain on %s", branchName), commitErr)
+		}
+		restoreAskChanges(files, origBranch, branchName, createdBranch)
+		fatalError("Commit failed (hook or signing error?); generated changes were reverted", commitErr)
+	}
+
+	// Remember this ask for gg ask --revert
+	last := lastAsk{
+		Branch:        branchName,
+		BaseBranch:    origBranch,
+		CreatedBranch: createdBranch,
+		Files:         sortedFilePaths(files),
+		PRURL:         reuseURL,
+		Created:       time.Now(),
+	}
+	if root, err := commandOutput("git", "rev-parse", "--show-toplevel"); err == nil {
+		last.Root = strings.TrimSpace(string(root))
+	}
+	last.Dir, _ = os.Getwd()
+	for path := range overwritten {
+		last.Overwritten = append(last.Overwritten, path)
+	}
+	sort.Strings(last.Overwritten)
+	saveLastAsk(last)
+
+	if err := gitStep("push", "-u", "origin", branchName); err != nil {
+		fmt.Fprintf(os.Stderr, "Changes are committed on branch %s; no PR was opened.\n", branchName)
+		fmt.Fprintf(os.Stderr, "Push it yourself with: git push -u origin %s\n", branchName)
+		fatalError("Push rejected — do you have write access to this repo?", err)
+	}
+
+	if reuseURL != "" {
+		recordAskHistory(repoName, promptHash, branchName, reuseURL)
+		fmt.Println()
+		fmt.Printf("PR updated: %s\n", reuseURL)
+		return
+	}
+
+	// Create PR
+	prBody := buildPRBody(fmt.Sprintf("Generated by gg ask:\n\n%s", prompt), ignoreTemplate)
+	if !noChecklist && len(cfg.Ask.ReviewChecklist) > 0 {
+		prBody += "\n\n" + renderChecklist(cfg.Ask.ReviewChecklist)
+	}
+	prBody += fmt.Sprintf("\n\n<!-- gg-ask-hash: %s -->", promptHash)
+	prCmd := command("gh", "pr", "create", "--title", commitMsg, "--body", prBody)
+	prOutput, err := prCmd.Output()
+	if err != nil {
+		fmt.Println("Failed to create PR. Create manually:")
+		fmt.Printf("   Branch: %s\n", branchName)
+		return
+	}
+
+	prURL := strings.TrimSpace(string(prOutput))
+	recordAskHistory(repoName, promptHash, branchName, prURL)
+	last.PRURL = prURL
+	saveLastAsk(last)
+	fmt.Println()
+	fmt.Printf("PR created: %s\n", prURL)
+	fmt.Println()
+	fmt.Println("Next: gg approve")
+
+	// Only open a browser for an interactive session
+	if openPR == "yes" || (openPR == "" && cfg.Ask.OpenPR) {
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 && !jsonOutput {
+			if err := openBrowser(prURL); err != nil {
+				fmt.Printf("Could not open browser: %v\n", err)
+			}
+		}
+	}
+}
+
+func handleApprove() {
+	cfg := loadPlainConfig()
+	method := ""
+	deleteBranch := cfg.GitHub.DeleteBranch
+	prNumber := 0
+	requireChecks := false
+	waitChecks := false
+	checksTimeout := approveChecksTimeout
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--keep-branch":
+			deleteBranch = false
+		case "--delete-branch":
+			deleteBranch = true
+		case "--merge", "--squash", "--rebase":
+			method = strings.TrimPrefix(args[i], "--")
+		case "--require-checks":
+			requireChecks = true
+		case "--wait":
+			requireChecks = true
+			waitChecks = true
+		case "--timeout":
+			if i+1 >= len(args) {
+				fatalError("--timeout requires a duration (e.g. 20m)", nil)
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				fatalError("--timeout requires a duration (e.g. 20m)", err)
+			}
+			checksTimeout = d
+			i++
+		default:
+			if strings.HasPrefix(args[i], "-") {
+				fmt.Printf("Unknown flag: %s\n", args[i])
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimPrefix(args[i], "#"))
+			if err != nil || n <= 0 {
+				fatalError(fmt.Sprintf("Invalid PR number %q: must be a positive integer", args[i]), nil)
+			}
+			prNumber = n
+		}
+	}
+	method = resolveMergeMethod(cfg, method)
+
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
+
+	type approvePR struct {
+		Number      int    `json:"number"`
+		Title       string `json:"title"`
+		HeadRefName string `json:"headRefName"`
+	}
+	var pr approvePR
+	if prNumber > 0 {
+		output, err := commandOutput("gh", "pr", "view", strconv.Itoa(prNumber), "--json", "number,title,headRefName")
+		if err != nil {
+			fatalError(fmt.Sprintf("Failed to fetch PR #%d", prNumber), err)
+		}
+		if err := json.Unmarshal(output, &pr); err != nil {
+			fatalError("Failed to parse PR data", err)
+		}
+	} else {
+		// Get latest PR
+		cmd := command("gh", "pr", "list", "--limit", "1", "--json", "number,title,headRefName")
+		output, err := cmd.Output()
+		if err != nil {
+			fatalError("Failed to list PRs", err)
+		}
+
+		var prs []approvePR
+		if err := json.Unmarshal(output, &prs); err != nil {
+			fatalError("Failed to parse PR list", err)
+		}
+
+		if len(prs) == 0 {
+			fmt.Println("No open PRs found")
+			return
+		}
+		pr = prs[0]
+		fmt.Println("Warning: no PR number given; merging the most recent open PR")
+		fmt.Println("         (use gg approve <number> to pick one)")
+		fmt.Println()
+	}
+
+	fmt.Printf("PR #%d: %s\n", pr.Number, pr.Title)
+	fmt.Printf("Branch: %s\n\n", pr.HeadRefName)
+
+	if requireChecks {
+		requirePassingChecks(strconv.Itoa(pr.Number), waitChecks, checksTimeout)
+	}
+
+	// Confirm
+	fmt.Print("Merge this PR? [Y/n]: ")
+	reader := bufio.NewReader(os.Stdin)
+	response, _ := reader.ReadString('\n')
+	response = strings.TrimSpace(strings.ToLower(response))
+
+	if response != "" && response != "y" {
+		fmt.Println("Cancelled")
+		return
+	}
+
+	mergeCmd := command("gh", prMergeArgs(pr.Number, pr.HeadRefName, method, deleteBranch)...)
+	mergeCmd.Stdout = os.Stdout
+	mergeCmd.Stderr = os.Stderr
+
+	if err := mergeCmd.Run(); err != nil {
+		fatalError("Failed to merge PR", err)
+	}
+
+	fmt.Println()
+	fmt.Println("PR merged successfully!")
+}
+
+// approveChecksTimeout bounds how long gg approve --wait polls CI
+const approveChecksTimeout = 30 * time.Minute
+
+// requirePassingChecks exits unless every required check on the PR has
+// passed. With wait it polls pending checks until timeout.
+func requirePassingChecks(prNumber string, wait bool, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		checks, err := fetchPRChecks(prNumber, true)
+		if err != nil {
+			fatalError("Failed to fetch checks", err)
+		}
+		_, failed, pending := checksRollup(checks)
+
+		if failed == 0 && pending == 0 {
+			if len(checks) == 0 {
+				fmt.Println("No required checks on this PR")
+			} else {
+				fmt.Printf("All %d required check(s) passed\n", len(checks))
+			}
+			fmt.Println()
+			return
+		}
+		if failed == 0 && wait && time.Now().Before(deadline) {
+			fmt.Printf("Waiting for %d pending check(s)...\n", pending)
+			time.Sleep(checksPollInterval)
+			continue
+		}
+
+		fmt.Println("Merge blocked by required checks:")
+		glyphs := map[string]string{"fail": "✗", "pending": "●"}
+		for _, c := range checks {
+			if glyph, ok := glyphs[checkBucket(c.State)]; ok {
+				fmt.Printf("  %s %s (%s) %s\n", glyph, c.Name, strings.ToLower(c.State), c.Link)
+			}
+		}
+		if failed == 0 && wait {
+			fmt.Printf("\nTimed out after %s\n", timeout)
+		} else if failed == 0 {
+			fmt.Println("\nRe-run with --wait to poll until they finish")
+		}
+		os.Exit(1)
+	}
+}
+
+// mergeMethods are the gh pr merge strategies [github] merge_method accepts
+var mergeMethods = []string{"merge", "squash", "rebase"}
+
+// resolveMergeMethod returns override, else [github] merge_method, else
+// squash
+func resolveMergeMethod(cfg *Config, override string) string {
+	method := override
+	if method == "" {
+		method = cfg.GitHub.MergeMethod
+	}
+	if method == "" {
+		return "squash"
+	}
+	if !slices.Contains(mergeMethods, method) {
+		fatalError(fmt.Sprintf("Invalid [github] merge_method %q (use %s)", method, strings.Join(mergeMethods, ", ")), nil)
+	}
+	return method
+}
+
+// prMergeArgs builds the gh pr merge invocation. With deleteBranch the head
+// branch is removed too, unless something else still depends on it.
+func prMergeArgs(prNumber int, headRef, method string, deleteBranch bool) []string {
+	args := []string{"pr", "merge", strconv.Itoa(prNumber), "--" + method}
+	if deleteBranch {
+		if reason := branchDeletionBlocker(headRef, prNumber); reason != "" {
+			fmt.Printf("Warning: keeping branch %s (%s)\n", headRef, reason)
+		} else {
+			args = append(args, "--delete-branch")
+		}
+	}
+	return args
+}
+
+// buildDetectors maps a project marker file to its build command, checked
+// in order. [ask] build_command adds or overrides entries.
+var buildDetectors = []struct {
+	Marker  string
+	Command string
+}{
+	{"go.mod", "go build ./..."},
+	{"Cargo.toml", "cargo build"},
+	{"package.json", "npm run build"},
+}
+
+// detectBuildCommand picks the build for the current directory, returning
+// the marker that matched and the command ("" when nothing applies)
+func detectBuildCommand(cfg *Config) (string, string) {
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	for _, d := range buildDetectors {
+		if !exists(d.Marker) {
+			continue
+		}
+		if custom, ok := cfg.Ask.BuildCommand[d.Marker]; ok {
+			return d.Marker, custom
+		}
+		if d.Marker == "package.json" && !hasNPMScript("build") {
+			continue
+		}
+		return d.Marker, d.Command
+	}
+
+	markers := make([]string, 0, len(cfg.Ask.BuildCommand))
+	for marker := range cfg.Ask.BuildCommand {
+		markers = append(markers, marker)
+	}
+	sort.Strings(markers)
+	for _, marker := range markers {
+		if exists(marker) {
+			return marker, cfg.Ask.BuildCommand[marker]
+		}
+	}
+	return "", ""
+}
+
+// hasNPMScript reports whether ./package.json defines script name
+func hasNPMScript(name string) bool {
+	data, err := os.ReadFile("package.json")
+	if err != nil {
+		return false
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if json.Unmarshal(data, &pkg) != nil {
+		return false
+	}
+	_, ok := pkg.Scripts[name]
+	return ok
+}
+
+// defaultParallelWrites is how many files gg ask writes at once
+const defaultParallelWrites = 4
+
+// writeAskFiles writes generated files with at most parallel writes in
+// flight. Directories are created up front, serially, so concurrent writes
+// never race on MkdirAll. It returns the error for each failed path.
+func writeAskFiles(files map[string]string, parallel int) map[string]error {
+	errs := map[string]error{}
+	dirErrs := map[string]error{}
+	for _, path := range sortedFilePaths(files) {
+		dir := filepath.Dir(path)
+		if dir == "." {
+			continue
+		}
+		if _, seen := dirErrs[dir]; !seen {
+			dirErrs[dir] = os.MkdirAll(dir, 0755)
+		}
+		if err := dirErrs[dir]; err != nil {
+			errs[path] = err
+		}
+	}
+
+	var pending []string
+	for path := range files {
+		if errs[path] == nil {
+			pending = append(pending, path)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for _, path := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := writeFileAtomic(path, []byte(files[path]), 0644); err != nil {
+				mu.Lock()
+				errs[path] = err
+				mu.Unlock()
+			}
+		}(path)
+	}
+	wg.Wait()
+	return errs
+}
+
+// getBackupDir is where gg ask keeps the files it overwrote on branch
+func getBackupDir(branch string) string {
+	return filepath.Join(getGGDir(), "backups", branch)
+}
+
+// backupPath maps a repo path to its copy under backupDir, keeping
+// absolute and ../ paths inside it
+func backupPath(backupDir, path string) string {
+	return filepath.Join(backupDir, filepath.Clean("/"+path))
+}
+
+// backupAskFiles copies every existing file gg ask is about to overwrite
+// to getBackupDir(branch), returning the set of paths it backed up
+func backupAskFiles(files map[string]string, branch string) (map[string]bool, error) {
+	backedUp := map[string]bool{}
+	dir := getBackupDir(branch)
+	for _, path := range sortedFilePaths(files) {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dest := backupPath(dir, path)
+		if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(dest, data, 0600); err != nil {
+			return nil, err
+		}
+		backedUp[path] = true
+	}
+	return backedUp, nil
+}
+
+// sortedFilePaths returns the paths of files in a stable order for reporting
+func sortedFilePaths(files map[string]string) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// renderChecklist formats items as a Markdown reviewer checklist
+func renderChecklist(items []string) string {
+	var sb strings.Builder
+	sb.WriteString("### Review checklist\n\n")
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			fmt.Fprintf(&sb, "- [ ] %s\n", item)
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// trailerKeyRe matches a git trailer token
+var trailerKeyRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*$`)
+
+// buildCommitTrailers turns trailer specs into "Key: value" lines. The
+// built-in keys Generated-By, Model and Tokens are filled from this run;
+// anything else must be Key=Value.
+func buildCommitTrailers(specs []string, model string) ([]string, error) {
+	var trailers []string
+	for _, spec := range specs {
+		key, value, hasValue := strings.Cut(spec, "=")
+		key = strings.TrimSpace(key)
+		if !trailerKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("bad trailer key %q", key)
+		}
+		if !hasValue {
+			switch strings.ToLower(key) {
+			case "generated-by":
+				value = "gg v" + version
+			case "model":
+				value = model
+			case "tokens":
+				value = fmt.Sprintf("%d/%d", sessionUsage.InputTokens, sessionUsage.OutputTokens)
+			default:
+				return nil, fmt.Errorf("%q needs a value (KEY=VAL); built-ins are Generated-By, Model, Tokens", key)
+			}
+		}
+		trailers = append(trailers, fmt.Sprintf("%s: %s", key, strings.TrimSpace(value)))
+	}
+	return trailers, nil
+}
+
+// branchExists reports whether name is a local branch or one on origin
+// that git checkout can track
+func branchExists(name string) bool {
+	return runCommand("git", "rev-parse", "--verify", "--quiet", "refs/heads/"+name) == nil ||
+		runCommand("git", "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+name) == nil
+}
+
+// getCurrentBranch returns the checked-out branch name, or "" if detached
+func getCurrentBranch() string {
+	output, err := commandOutput("git", "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return ""
+	}
+	branch := strings.TrimSpace(string(output))
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
+}
+
+// stagedDiffLines totals added+removed lines in the index
+func stagedDiffLines() int {
+	output, err := commandOutput("git", "diff", "--cached", "--numstat")
+	if err != nil {
+		return 0
+	}
+
+	total := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		// Binary files report "-"
+		added, _ := strconv.Atoi(fields[0])
+		removed, _ := strconv.Atoi(fields[1])
+		total += added + removed
+	}
+	return total
+}
+
+// lastAsk records the most recent gg ask for gg ask --revert
+type lastAsk struct {
+	Root          string    `json:"root"` // repository top level
+	Dir           string    `json:"dir"`  // directory Files are relative to
+	Branch        string    `json:"branch"`
+	BaseBranch    string    `json:"base_branch"`
+	CreatedBranch bool      `json:"created_branch"`
+	Files         []string  `json:"files"`
+	Overwritten   []string  `json:"overwritten,omitempty"` // backed up under getBackupDir(Branch)
+	PRURL         string    `json:"pr_url,omitempty"`
+	Created       time.Time `json:"created"`
+}
+
+func getLastAskPath() string {
+	return filepath.Join(getGGDir(), "last_ask.json")
+}
+
+func saveLastAsk(last lastAsk) {
+	data, _ := json.MarshalIndent(last, "", "  ")
+	os.MkdirAll(getGGDir(), 0700)
+	os.WriteFile(getLastAskPath(), data, 0600)
+}
+
+// revertLastAsk undoes the last gg ask: it switches back to the branch the
+// ask started from, deletes the ask branch, optionally restores the
+// backed-up originals and offers to close the PR. Uncommitted changes to
+// anything but the ask's own files make it refuse.
+func revertLastAsk(args []string) {
+	assumeYes := false
+	restore := false
+	for _, arg := range args {
+		switch arg {
+		case "--yes", "-y":
+			assumeYes = true
+		case "--restore-backups":
+			restore = true
+		default:
+			fmt.Printf("Unknown flag: %s\n", arg)
+			fmt.Println("Usage: gg ask --revert [--restore-backups] [--yes]")
+			return
+		}
+	}
+
+	data, err := os.ReadFile(getLastAskPath())
+	if err != nil {
+		fmt.Println("No gg ask to revert")
+		return
+	}
+	var last lastAsk
+	if err := json.Unmarshal(data, &last); err != nil {
+		fatalError("Cannot read "+getLastAskPath(), err)
+	}
+
+	root, err := commandOutput("git", "rev-parse", "--show-toplevel")
+	if err != nil || strings.TrimSpace(string(root)) != last.Root {
+		fatalError(fmt.Sprintf("The last gg ask ran in %s; run gg ask --revert there", last.Root), nil)
+	}
+	if !last.CreatedBranch {
+		fatalError(fmt.Sprintf("The last gg ask added commits to the existing branch %s; undo them with git revert", last.Branch), nil)
+	}
+	if last.BaseBranch == "" || last.BaseBranch == last.Branch {
+		fatalError("Don't know which branch the last gg ask started from", nil)
+	}
+
+	askPaths := map[string]bool{}
+	for _, path := range last.Files {
+		if rel, err := filepath.Rel(last.Root, filepath.Join(last.Dir, path)); err == nil {
+			askPaths[filepath.ToSlash(rel)] = true
+		}
+	}
+	status, err := commandOutput("git", "-C", last.Root, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		fatalError("git status failed", err)
+	}
+	var unrelated []string
+	for _, line := range strings.Split(strings.TrimRight(string(status), "\n"), "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		path := line[3:]
+		if i := strings.Index(path, " -> "); i >= 0 {
+			path = path[i+4:]
+		}
+		if !askPaths[strings.Trim(path, "\"")] {
+			unrelated = append(unrelated, path)
+		}
+	}
+	if len(unrelated) > 0 {
+		fmt.Println("Refusing to revert: uncommitted changes outside the last ask:")
+		for _, path := range unrelated {
+			fmt.Printf("  %s\n", path)
+		}
+		fmt.Println("Commit or stash them first.")
+		os.Exit(1)
+	}
+
+	fmt.Printf("Last ask: branch %s (%d files) from %s, %s ago\n",
+		last.Branch, len(last.Files), last.BaseBranch, formatAge(time.Since(last.Created)))
+	if !assumeYes {
+		fmt.Printf("Switch to %s and delete %s? [y/N]: ", last.BaseBranch, last.Branch)
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Cancelled")
+			return
+		}
+	}
+
+	// The ask's own files are the only dirty ones, so -f discards nothing else
+	if err := gitStep("-C", last.Root, "checkout", "-f", last.BaseBranch); err != nil {
+		fatalError("Cannot switch back to "+last.BaseBranch, err)
+	}
+	if err := gitStep("-C", last.Root, "branch", "-D", last.Branch); err != nil {
+		fatalError("Cannot delete branch "+last.Branch, err)
+	}
+	fmt.Printf("Deleted branch %s\n", last.Branch)
+
+	backupDir := getBackupDir(last.Branch)
+	if restore {
+		for _, path := range last.Overwritten {
+			data, err := os.ReadFile(backupPath(backupDir, path))
+			if err == nil {
+				err = writeFileAtomic(filepath.Join(last.Dir, path), data, 0644)
+			}
+			if err != nil {
+				fmt.Printf("Failed to restore %s: %v\n", path, err)
+				continue
+			}
+			fmt.Printf("Restored %s\n", path)
+		}
+		os.RemoveAll(backupDir)
+	} else if len(last.Overwritten) > 0 {
+		fmt.Printf("Pre-ask copies of %d overwritten files are in %s (--restore-backups puts them back)\n", len(last.Overwritten), backupDir)
+	}
+	os.Remove(getLastAskPath())
+
+	if last.PRURL == "" {
+		return
+	}
+	output, err := commandOutput("gh", "pr", "view", last.PRURL, "--json", "state", "-q", ".state")
+	if err != nil || strings.TrimSpace(string(output)) != "OPEN" {
+		return
+	}
+	if !assumeYes {
+		fmt.Printf("Close %s and delete its remote branch? [y/N]: ", last.PRURL)
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Printf("PR left open: %s\n", last.PRURL)
+			return
+		}
+	}
+	closePR(last.PRURL, "", true)
+}
+
+// gitStep runs one git step of gg ask, folding git's own message into the
+// error so the caller can abort with it
+func gitStep(args ...string) error {
+	output, err := command("git", args...).CombinedOutput()
+	debugExit("git", err, output)
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("%s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreAskChanges undoes uncommitted gg ask writes: tracked files are
+// reset to HEAD, new files removed, and the ask branch dropped if created
+func restoreAskChanges(files map[string]string, origBranch, branchName string, createdBranch bool) {
 	for path := range files {
-		exec.Command("git", "add", path).Run()
+		runCommand("git", "reset", "-q", "HEAD", "--", path)
+		if runCommand("git", "cat-file", "-e", "HEAD:"+path) == nil {
+			runCommand("git", "checkout", "HEAD", "--", path)
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	if origBranch != "" && origBranch != branchName {
+		runCommand("git", "checkout", origBranch)
+		if createdBranch {
+			runCommand("git", "branch", "-D", branchName)
+		}
+	}
+}
+
+// askPatch returns files as a unified diff against HEAD without touching
+// the working tree: the HEAD and generated versions are written under a
+// temp dir as a/<path> and b/<path> and compared with git diff --no-index.
+func askPatch(files map[string]string) (string, error) {
+	tmp, err := os.MkdirTemp("", "gg-patch-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, path := range sortedFilePaths(files) {
+		rel := filepath.Clean("/" + path)
+		mode := os.FileMode(0644)
+		if old, err := commandOutput("git", "show", "HEAD:./"+path); err == nil {
+			if tree, _ := commandOutput("git", "ls-tree", "HEAD", "--", path); strings.HasPrefix(string(tree), "100755") {
+				mode = 0755
+			}
+			if err := writePatchSide(filepath.Join(tmp, "a", rel), old, mode); err != nil {
+				return "", err
+			}
+		}
+		if err := writePatchSide(filepath.Join(tmp, "b", rel), []byte(files[path]), mode); err != nil {
+			return "", err
+		}
+	}
+	os.MkdirAll(filepath.Join(tmp, "a"), 0755)
+
+	cmd := command("git", "diff", "--no-index", "--no-color", "--no-ext-diff", "--no-prefix", "a", "b")
+	cmd.Dir = tmp
+	diff, err := cmd.Output()
+	// --no-index exits 1 when the sides differ
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return "", fmt.Errorf("git diff: %w", err)
+	}
+	// New files only exist under b/; name them as git diff would
+	return strings.ReplaceAll("\n"+string(diff), "\ndiff --git b/", "\ndiff --git a/")[1:], nil
+}
+
+// writePatchSide writes one side of an askPatch comparison
+func writePatchSide(path string, data []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+// AskHistoryEntry records one gg ask run in ~/.gg/ask_history.jsonl
+type AskHistoryEntry struct {
+	Time       string `json:"time"`
+	Repo       string `json:"repo"`
+	PromptHash string `json:"prompt_hash"`
+	Branch     string `json:"branch"`
+	PRURL      string `json:"pr_url"`
+}
+
+func getAskHistoryPath() string {
+	return filepath.Join(getGGDir(), "ask_history.jsonl")
+}
+
+// hashPrompt normalizes whitespace and case so trivially different
+// invocations of the same prompt hash equally
+func hashPrompt(prompt string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func recordAskHistory(repo, promptHash, branch, prURL string) {
+	entry := AskHistoryEntry{
+		Time:       time.Now().Format(time.RFC3339),
+		Repo:       repo,
+		PromptHash: promptHash,
+		Branch:     branch,
+		PRURL:      prURL,
+	}
+	data, _ := json.Marshal(entry)
+
+	os.MkdirAll(getGGDir(), 0700)
+	f, err := os.OpenFile(getAskHistoryPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+// findDuplicateAskPR returns the branch and URL of an open PR generated from
+// the same prompt, checking local history first and then PR bodies on GitHub
+func findDuplicateAskPR(repo, promptHash string) (string, string) {
+	type prRef struct {
+		URL         string `json:"url"`
+		State       string `json:"state"`
+		HeadRefName string `json:"headRefName"`
+	}
+
+	if data, err := os.ReadFile(getAskHistoryPath()); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for i := len(lines) - 1; i >= 0; i-- {
+			var entry AskHistoryEntry
+			if json.Unmarshal([]byte(lines[i]), &entry) != nil {
+				continue
+			}
+			if entry.Repo != repo || entry.PromptHash != promptHash || entry.PRURL == "" {
+				continue
+			}
+			output, err := commandOutput("gh", "pr", "view", entry.PRURL, "--json", "url,state,headRefName")
+			if err != nil {
+				continue
+			}
+			var pr prRef
+			if json.Unmarshal(output, &pr) == nil && pr.State == "OPEN" {
+				return pr.HeadRefName, pr.URL
+			}
+		}
+	}
+
+	output, err := commandOutput("gh", "pr", "list", "--state", "open", "--search", promptHash+" in:body", "--json", "url,state,headRefName")
+	if err != nil {
+		return "", ""
+	}
+	var prs []prRef
+	if json.Unmarshal(output, &prs) == nil && len(prs) > 0 {
+		return prs[0].HeadRefName, prs[0].URL
+	}
+	return "", ""
+}
+
+// branchDeletionBlocker returns why branch must not be deleted after merging
+// prNumber, or "" when deletion is safe
+func branchDeletionBlocker(branch string, prNumber int) string {
+	output, err := commandOutput("gh", "repo", "view", "--json", "defaultBranchRef", "-q", ".defaultBranchRef.name")
+	if err != nil {
+		return "could not determine default branch"
+	}
+	if strings.TrimSpace(string(output)) == branch {
+		return "it is the repository default branch"
+	}
+
+	var prs []struct {
+		Number int `json:"number"`
+	}
+	for _, flag := range []string{"--head", "--base"} {
+		output, err := commandOutput("gh", "pr", "list", flag, branch, "--state", "open", "--json", "number")
+		if err != nil {
+			return "could not list open PRs for branch"
+		}
+		if err := json.Unmarshal(output, &prs); err != nil {
+			return "could not parse open PRs for branch"
+		}
+		for _, other := range prs {
+			if other.Number != prNumber {
+				return fmt.Sprintf("PR #%d also uses it", other.Number)
+			}
+		}
+	}
+	return ""
+}
+
+// ============================================================================
+// ASK CONTEXT
+// ============================================================================
+
+// maxContextBytes caps the total size of file context sent with gg ask
+const maxContextBytes = 100 * 1024
+
+// buildFileContext reads paths into a delimited context block, stopping at
+// maxContextBytes. It returns the block and the paths that fit.
+func buildFileContext(paths []string) (string, []string) {
+	var sb strings.Builder
+	var included []string
+	total := 0
+
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Warning: cannot read %s: %v\n", path, err)
+			continue
+		}
+		if total+len(content) > maxContextBytes {
+			continue
+		}
+		total += len(content)
+		included = append(included, path)
+		fmt.Fprintf(&sb, "FILE: %s\n```\n%s\n```\n\n", path, string(content))
+	}
+
+	if len(included) == 0 {
+		return "", nil
+	}
+	return "Existing files for context:\n\n" + sb.String() + "REQUEST:\n", included
+}
+
+// responseCacheTTL is how long gg ask --cache-response reuses a response
+const responseCacheTTL = 24 * time.Hour
+
+// cachedResponse is a stored model response in cache/responses
+type cachedResponse struct {
+	Created  time.Time `json:"created"`
+	Model    string    `json:"model"`
+	Response string    `json:"response"`
+}
+
+// responseCacheKey hashes everything that determines a model response
+func responseCacheKey(provider, model string, temperature float64, systemPrompt, prompt string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%g\x00%s\x00%s", provider, model, temperature, systemPrompt, prompt)))
+	return hex.EncodeToString(sum[:])
+}
+
+func responseCachePath(key string) string {
+	return filepath.Join(getCacheDir(), "responses", key+".json")
+}
+
+// loadCachedResponse returns a cached response younger than responseCacheTTL
+func loadCachedResponse(key string) (string, time.Time, bool) {
+	data, err := readCacheFile(responseCachePath(key))
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	var entry cachedResponse
+	if json.Unmarshal(data, &entry) != nil || entry.Response == "" || time.Since(entry.Created) > responseCacheTTL {
+		return "", time.Time{}, false
+	}
+	return entry.Response, entry.Created, true
+}
+
+func storeCachedResponse(key, model, response string) {
+	data, _ := json.Marshal(cachedResponse{Created: time.Now(), Model: model, Response: response})
+	writeCacheFile(responseCachePath(key), data)
+}
+
+// maxSummaryInputBytes caps how much of one file is sent for summarizing
+const maxSummaryInputBytes = 200 * 1024
+
+// summaryModels are the cheap models used for --summarize-context. Ollama
+// uses the configured model.
+var summaryModels = map[string]string{
+	ProviderAnthropic: "claude-3-5-haiku-20241022",
+	ProviderOpenAI:    "gpt-4o-mini",
+}
+
+// summarizeContextFiles summarizes the paths buildFileContext left out with
+// a cheap model call each. It returns a context block and the summarized paths.
+func summarizeContextFiles(cfg *Config, paths, included []string) (string, []string) {
+	provider, model, endpoint, apiKey := getEffectiveConfig(cfg)
+	if m, ok := summaryModels[provider]; ok {
+		model = m
+	}
+	systemPrompt := "Summarize this source file for a developer who will modify the codebase. " +
+		"List its purpose, exported types and functions with signatures, and important conventions. Be terse."
+
+	var sb strings.Builder
+	var summarized []string
+	var inChars, outChars int
+	for _, path := range paths {
+		if slices.Contains(included, path) {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if len(content) > maxSummaryInputBytes {
+			content = content[:maxSummaryInputBytes]
+		}
+		fmt.Printf("Summarizing %s (%d KB)...\n", path, len(content)/1024)
+		userPrompt := fmt.Sprintf("FILE: %s\n```\n%s\n```", path, string(content))
+		summary, err := callAPIWithModel(provider, endpoint, apiKey, model, systemPrompt, userPrompt)
+		if err != nil {
+			fmt.Printf("Warning: cannot summarize %s: %v\n", path, sanitizeError(err))
+			continue
+		}
+		inChars += len(systemPrompt) + len(userPrompt)
+		outChars += len(summary)
+		summarized = append(summarized, path)
+		fmt.Fprintf(&sb, "FILE: %s (summary, too large to include)\n%s\n\n", path, strings.TrimSpace(summary))
+	}
+
+	if len(summarized) == 0 {
+		return "", nil
+	}
+
+	// The non-streaming API helpers don't report usage; ~4 chars per token
+	inTokens, outTokens := int64(inChars/4), int64(outChars/4)
+	trackTokenUsage(provider, model, inTokens, outTokens)
+	fmt.Printf("Summarized %d file(s) with %s: ~%d input + ~%d output tokens\n", len(summarized), model, inTokens, outTokens)
+
+	return "Summaries of large files:\n\n" + sb.String(), summarized
+}
+
+// searchRepoFiles lists files containing query, using ripgrep when available
+// and a built-in walker otherwise. Both skip gitignored files unless
+// includeIgnored.
+func searchRepoFiles(query string, includeIgnored bool) ([]string, error) {
+	if _, err := exec.LookPath("rg"); err == nil {
+		rgArgs := []string{"-l"}
+		if includeIgnored {
+			rgArgs = append(rgArgs, "--no-ignore")
+		}
+		output, err := commandOutput("rg", append(rgArgs, "--", query)...)
+		if err != nil {
+			// rg exits 1 when nothing matched
+			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var files []string
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			if line != "" {
+				files = append(files, line)
+			}
+		}
+		return files, nil
+	}
+
+	re, err := regexp.Compile(query)
+	if err != nil {
+		re = regexp.MustCompile(regexp.QuoteMeta(query))
+	}
+
+	var files []string
+	err = filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case ".git", "node_modules", "vendor", "dist", "build":
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > maxContextBytes {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil || bytes.IndexByte(content, 0) >= 0 {
+			return nil
+		}
+		if re.Match(content) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil || includeIgnored {
+		return files, err
+	}
+
+	ignored := gitIgnoredPaths(files)
+	kept := files[:0]
+	for _, path := range files {
+		if !ignored[path] {
+			kept = append(kept, path)
+		}
+	}
+	return kept, nil
+}
+
+// gitIgnoredPaths reports which of paths git ignores. Outside a repo
+// nothing is ignored.
+func gitIgnoredPaths(paths []string) map[string]bool {
+	ignored := map[string]bool{}
+	if len(paths) == 0 {
+		return ignored
+	}
+	cmd := command("git", "check-ignore", "--stdin")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\n") + "\n")
+	// Exit status 1 means none are ignored; 128 means no repo
+	output, _ := cmd.Output()
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			ignored[line] = true
+		}
+	}
+	return ignored
+}
+
+// ============================================================================
+// JSON SCHEMA VALIDATION
+// ============================================================================
+
+// maxSchemaAttempts bounds model calls when output keeps failing validation
+const maxSchemaAttempts = 3
+
+// validateSchemaFiles checks every generated file parses as JSON and
+// conforms to schema
+func validateSchemaFiles(files map[string]string, schema map[string]interface{}) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no files in response")
+	}
+	for path, content := range files {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(content), &doc); err != nil {
+			return fmt.Errorf("%s: invalid JSON: %v", path, err)
+		}
+		if err := validateJSONSchema(doc, schema, "$"); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// validateJSONSchema implements the commonly used subset of JSON Schema:
+// type, enum, const, properties, required, additionalProperties, items,
+// min/max(Length|Items|imum)
+func validateJSONSchema(doc interface{}, schema map[string]interface{}, at string) error {
+	if types, ok := schema["type"]; ok {
+		var allowed []string
+		switch t := types.(type) {
+		case string:
+			allowed = []string{t}
+		case []interface{}:
+			for _, v := range t {
+				if str, ok := v.(string); ok {
+					allowed = append(allowed, str)
+				}
+			}
+		}
+		actual := jsonTypeOf(doc)
+		matched := false
+		for _, t := range allowed {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected %s, got %s", at, strings.Join(allowed, "|"), actual)
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, v := range enum {
+			if reflect.DeepEqual(v, doc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", at)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, doc) {
+		return fmt.Errorf("%s: value does not match const", at)
+	}
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if key, ok := r.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", at, key)
+					}
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for key, val := range v {
+			if sub, ok := props[key].(map[string]interface{}); ok {
+				if err := validateJSONSchema(val, sub, at+"."+key); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: unexpected property %q", at, key)
+				}
+			case map[string]interface{}:
+				if err := validateJSONSchema(val, extra, at+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %d items", at, int(n))
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %d items", at, int(n))
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateJSONSchema(item, items, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		if n, ok := schema["minLength"].(float64); ok && float64(len([]rune(v))) < n {
+			return fmt.Errorf("%s: shorter than %d characters", at, int(n))
+		}
+		if n, ok := schema["maxLength"].(float64); ok && float64(len([]rune(v))) > n {
+			return fmt.Errorf("%s: longer than %d characters", at, int(n))
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			return fmt.Errorf("%s: %v is below minimum %v", at, v, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			return fmt.Errorf("%s: %v is above maximum %v", at, v, n)
+		}
+	}
+	return nil
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if t == float64(int64(t)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// ============================================================================
+// EDIT COMMAND
+// ============================================================================
+
+func handleEdit() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg edit <file> [instruction]")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  gg edit main.go                    # Interactive edit")
+		fmt.Println("  gg edit main.go \"add error handling\"")
+		fmt.Println("  gg edit src/*.ts \"add types\"       # Multiple files")
+		return
+	}
+
+	filePath := os.Args[2]
+	var instruction string
+	if len(os.Args) > 3 {
+		instruction = strings.Join(os.Args[3:], " ")
+	}
+
+	// Check if file exists
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		fatalError("Cannot read file", err)
+	}
+
+	// Get instruction if not provided
+	if instruction == "" {
+		fmt.Printf("Editing: %s (%d bytes)\n", filePath, len(content))
+		fmt.Print("\nWhat changes do you want? > ")
+		reader := bufio.NewReader(os.Stdin)
+		instruction, _ = reader.ReadString('\n')
+		instruction = strings.TrimSpace(instruction)
+		if instruction == "" {
+			fmt.Println("No instruction provided, exiting")
+			return
+		}
+	}
+
+	// Load config
+	cfg, err := loadConfig()
+	if err != nil {
+		fatalError("Config error. Run: gg config init", err)
+	}
+
+	provider, model, _, apiKey := getEffectiveConfig(cfg)
+	if provider != ProviderOllama && apiKey == "" {
+		fatalError("API key not configured. Run: gg config init", nil)
+	}
+
+	// Create edit prompt
+	editPrompt := fmt.Sprintf("Edit this file according to the instruction.\n\n"+
+		"FILE: %s\n"+
+		"```\n%s\n```\n\n"+
+		"INSTRUCTION: %s\n\n"+
+		"Return ONLY the complete edited file content, no explanations. "+
+		"Wrap in ```language:filename code block.", filePath, string(content), instruction)
+
+	systemPrompt := "You are a code editor. Return only the edited file content in a code block."
+
+	fmt.Printf("Editing %s with %s/%s...\n\n", filePath, provider, model)
+
+	response, err := callAPIStreaming(cfg, model, effectiveTemperature(cfg), systemPrompt, editPrompt)
+	if err != nil {
+		fatalError("API error", sanitizeError(err))
+	}
+
+	// Parse the response for code blocks
+	files := parseCodeBlocks(response)
+	if len(files) == 0 {
+		// Try to extract content between ``` markers
+		re := regexp.MustCompile("```[^\\s:`]*\n([\\s\\S]*?)```")
+		matches := re.FindStringSubmatch(response)
+		if len(matches) >= 2 {
+			files[filePath] = matches[1]
+		}
+	}
+
+	if len(files) == 0 {
+		fmt.Println("\nNo code block found in response. Raw response:")
+		fmt.Println(response)
+		return
+	}
+
+	// Get the edited content
+	var newContent string
+	for _, c := range files {
+		newContent = c
+		break
+	}
+
+	// Show diff summary
+	oldLines := strings.Count(string(content), "\n")
+	newLines := strings.Count(newContent, "\n")
+	fmt.Printf("\nChanges: %d lines -> %d lines\n", oldLines, newLines)
+
+	// Confirm
+	fmt.Print("\nApply changes? [Y/n]: ")
+	reader := bufio.NewReader(os.Stdin)
+	confirm, _ := reader.ReadString('\n')
+	confirm = strings.TrimSpace(strings.ToLower(confirm))
+
+	if confirm != "" && confirm != "y" {
+		fmt.Println("Cancelled")
+		return
+	}
+
+	// Write the file
+	if err := os.WriteFile(filePath, []byte(newContent), 0644); err != nil {
+		fatalError("Failed to write file", err)
+	}
+
+	fmt.Printf("Updated: %s\n", filePath)
+}
+
+// ============================================================================
+// PROMPTS COMMAND
+// ============================================================================
+
+func handlePrompts() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg prompts <command>")
+		fmt.Println()
+		fmt.Println("Commands:")
+		fmt.Println("  list               # List saved prompts")
+		fmt.Println("  add <name> \"...\"   # Save a prompt")
+		fmt.Println("  run <name>         # Run a saved prompt with gg ask")
+		fmt.Println("  delete <name>      # Delete a prompt")
+		fmt.Println()
+		fmt.Println("Examples:")
+		fmt.Println("  gg prompts add refactor \"refactor this code for clarity\"")
+		fmt.Println("  gg prompts run refactor")
+		return
+	}
+
+	subCmd := os.Args[2]
+
+	switch subCmd {
+	case "list", "ls":
+		listPrompts()
+	case "add", "save":
+		if len(os.Args) < 5 {
+			fmt.Println("Usage: gg prompts add <name> \"prompt text\"")
+			return
+		}
+		name := os.Args[3]
+		promptText := strings.Join(os.Args[4:], " ")
+		savePrompt(name, promptText)
+	case "run", "use":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: gg prompts run <name>")
+			return
+		}
+		usePrompt(os.Args[3])
+	case "delete", "rm":
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: gg prompts delete <name>")
+			return
+		}
+		deletePrompt(os.Args[3])
+	default:
+		// Try to run it as a prompt name
+		usePrompt(subCmd)
+	}
+}
+
+func getPromptsDir() string {
+	return filepath.Join(getGGDir(), "prompts")
+}
+
+func listPrompts() {
+	promptsDir := getPromptsDir()
+	files, err := os.ReadDir(promptsDir)
+	if err != nil || len(files) == 0 {
+		fmt.Println("No saved prompts")
+		fmt.Println("Save one: gg prompts save <name> \"prompt text\"")
+		return
+	}
+
+	fmt.Println("Saved prompts:")
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".txt") {
+			name := strings.TrimSuffix(f.Name(), ".txt")
+			content, _ := os.ReadFile(filepath.Join(promptsDir, f.Name()))
+			preview := string(content)
+			if len(preview) > 50 {
+				preview = preview[:50] + "..."
+			}
+			fmt.Printf("  - %s: %s\n", name, preview)
+		}
+	}
+}
+
+func savePrompt(name, text string) {
+	promptsDir := getPromptsDir()
+	os.MkdirAll(promptsDir, 0755)
+
+	path := filepath.Join(promptsDir, name+".txt")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		fatalError("Failed to save prompt", err)
+	}
+	fmt.Printf("Saved prompt '%s'\n", name)
+}
+
+func usePrompt(name string) {
+	promptsDir := getPromptsDir()
+	path := filepath.Join(promptsDir, name+".txt")
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Prompt not found: %s\n", name)
+		fmt.Println("Run 'gg prompts list' to see saved prompts")
+		return
+	}
+
+	promptText := string(content)
+	fmt.Printf("Using prompt '%s': %s\n\n", name, promptText)
+
+	// Inject prompt into handleAsk by setting os.Args
+	os.Args = []string{"gg", "ask", promptText}
+	handleAsk()
+}
+
+func deletePrompt(name string) {
+	promptsDir := getPromptsDir()
+	path := filepath.Join(promptsDir, name+".txt")
+
+	if err := os.Remove(path); err != nil {
+		fmt.Printf("Prompt not found: %s\n", name)
+		return
+	}
+	fmt.Printf("Deleted prompt '%s'\n", name)
+}
+
+// ============================================================================
+// UTILITIES
+// ============================================================================
+
+func getCurrentRepo() string {
+	cmd := command("git", "remote", "get-url", "origin")
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	url := strings.TrimSpace(string(output))
+	return parseGitHubURL(url)
+}
+
+// checkSigningKey verifies git has a key to sign commits with. Without
+// user.signingkey, gpg signs with its default secret key, so having one is
+// only worth a warning.
+func checkSigningKey() error {
+	output, _ := commandOutput("git", "config", "--get", "user.signingkey")
+	if strings.TrimSpace(string(output)) != "" {
+		return nil
+	}
+
+	format, _ := commandOutput("git", "config", "--get", "gpg.format")
+	switch strings.TrimSpace(string(format)) {
+	case "ssh":
+		return fmt.Errorf("no SSH signing key: git config user.signingkey ~/.ssh/id_ed25519.pub")
+	case "", "openpgp":
+		program := "gpg"
+		if out, _ := commandOutput("git", "config", "--get", "gpg.program"); strings.TrimSpace(string(out)) != "" {
+			program = strings.TrimSpace(string(out))
+		}
+		keys, err := commandOutput(program, "--list-secret-keys", "--with-colons")
+		if err == nil && slices.ContainsFunc(strings.Split(string(keys), "\n"), func(line string) bool {
+			return strings.HasPrefix(line, "sec:")
+		}) {
+			fmt.Fprintln(os.Stderr, "Warning: user.signingkey is not set; gpg will sign with its default secret key")
+			return nil
+		}
+	}
+	return fmt.Errorf("no signing key: git config user.signingkey <key-id> (or gpg.format ssh)")
+}
+
+func checkProTier(cfg *Config) bool {
+	return cfg.Secrets.ProLicenseKey != "" &&
+		strings.HasPrefix(cfg.Secrets.ProLicenseKey, "gg_pro_")
+}
+
+// handleUpgrade starts the Pro upgrade flow
+func handleUpgrade() {
+	fmt.Println("gg Pro — $15/month")
+	fmt.Println()
+	fmt.Println("Benefits:")
+	fmt.Println("  - Unlimited gg ask (code generation)")
+	fmt.Println("  - Unlimited CLI2CLI (a2a) calls")
+	fmt.Println("  - Priority API routing")
+	fmt.Println("  - Support development")
+	fmt.Println()
+
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter your email: ")
+	email, _ := reader.ReadString('\n')
+	email = strings.TrimSpace(email)
+
+	if email == "" || !strings.Contains(email, "@") {
+		fmt.Println("Invalid email")
+		return
+	}
+
+	// Create checkout session
+	fmt.Println()
+	fmt.Println("Creating checkout session...")
+
+	reqBody, _ := json.Marshal(map[string]string{"email": email})
+	resp, err := newHTTPClient(httpTimeout).Post(getBackendURL()+"/checkout", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Try: https://ggdotdev.com/pro")
+		return
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if errMsg, ok := result["error"].(string); ok {
+		if licenseKey, hasKey := result["license_key"].(string); hasKey {
+			fmt.Printf("Already subscribed! Your license key: %s\n", licenseKey)
+			fmt.Println()
+			fmt.Println("Add to ~/.gg/config.toml:")
+			fmt.Printf("  pro_license_key = \"%s\"\n", licenseKey)
+			return
+		}
+		fmt.Printf("Error: %s\n", errMsg)
+		return
+	}
+
+	if checkoutURL, ok := result["checkout_url"].(string); ok {
+		fmt.Println()
+		fmt.Println("Opening checkout...")
+		fmt.Println(checkoutURL)
+		fmt.Println()
+		fmt.Println("After payment, run: gg pro --activate")
+
+		// Try to open browser
+		openBrowser(checkoutURL)
+	}
+}
+
+// handlePro shows Pro status or activates license
+func handlePro() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println("Run 'gg init' first")
+		return
+	}
+
+	// Check for --activate flag
+	if len(os.Args) > 2 && os.Args[2] == "--activate" {
+		activateProLicense(cfg)
+		return
+	}
+
+	// Check for --portal flag (manage subscription)
+	if len(os.Args) > 2 && os.Args[2] == "--portal" {
+		openCustomerPortal(cfg)
+		return
+	}
+
+	// Show current status
+	fmt.Println("gg Pro Status")
+	fmt.Println()
+
+	if checkProTier(cfg) {
+		fmt.Println("Status: Active")
+		fmt.Printf("License: %s...%s\n",
+			cfg.Secrets.ProLicenseKey[:12],
+			cfg.Secrets.ProLicenseKey[len(cfg.Secrets.ProLicenseKey)-4:])
+		fmt.Println()
+		fmt.Println("Commands:")
+		fmt.Println("  gg pro --portal    Manage subscription")
+	} else {
+		fmt.Println("Status: Free tier")
+		fmt.Println()
+		allowed, inGrace, remaining := checkA2ALimit(cfg)
+		if !allowed {
+			fmt.Println("Daily limit: Reached")
+		} else if inGrace {
+			fmt.Println("Daily limit: In grace period")
+		} else {
+			fmt.Printf("Daily limit: %d remaining\n", remaining)
+		}
+		fmt.Println()
+		fmt.Println("Upgrade: gg upgrade")
+	}
+}
+
+// showTierStatus handles gg config tier status: the active tier, what
+// each tier unlocks, and how much free quota is left
+func showTierStatus() {
+	cfg, err := loadConfig()
+	if err != nil {
+		cfg = loadPlainConfig()
+	}
+	pro := checkProTier(cfg)
+
+	if pro {
+		fmt.Println("Tier: pro")
+	} else {
+		fmt.Println("Tier: free")
+	}
+	fmt.Println()
+
+	fmt.Println("Features:")
+	fmt.Println("  gg ., npm, brew, chain, cool, run, pr   all tiers")
+	if pro {
+		fmt.Println("  gg ask (code + PR generation)           unlimited")
+		fmt.Println("  gg a2a / gg chat                        unlimited")
+	} else {
+		remaining := askFreeMonthlyLimit - monthlyAskCount()
+		if remaining < 0 {
+			remaining = 0
+		}
+		fmt.Printf("  gg ask (code + PR generation)           %d/month (%d remaining)\n", askFreeMonthlyLimit, remaining)
+		allowed, inGrace, remaining := checkA2ALimit(cfg)
+		quota := fmt.Sprintf("%d remaining today", remaining)
+		if !allowed {
+			quota = "limit reached today"
+		} else if inGrace {
+			quota = "in grace period"
+		}
+		fmt.Printf("  gg a2a / gg chat                        %d/day + %d grace (%s)\n",
+			a2aFreeLimit, a2aGraceLimit, quota)
+	}
+
+	if stats, ok := loadMonthStats(time.Now().Format("2006-01")); ok {
+		fmt.Println()
+		fmt.Printf("This month: %d asks, %d tokens (~$%.4f)\n", stats.AskCount, stats.TotalTokens, stats.EstimatedCost)
+	}
+
+	if !pro {
+		fmt.Println()
+		fmt.Println("Upgrade: gg upgrade")
+	}
+}
+
+// activateProLicense fetches and saves the license key after payment
+func activateProLicense(cfg *Config) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter email used for purchase: ")
+	email, _ := reader.ReadString('\n')
+	email = strings.TrimSpace(email)
+
+	if email == "" {
+		fmt.Println("Email required")
+		return
+	}
+
+	fmt.Println("Checking for license...")
+
+	resp, err := newHTTPClient(httpTimeout).Get(getBackendURL() + "/license?email=" + email)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if errMsg, ok := result["error"].(string); ok {
+		fmt.Printf("Error: %s\n", errMsg)
+		fmt.Println()
+		fmt.Println("If you just purchased, wait a moment and try again.")
+		fmt.Println("Or open an issue: github.com/cyclecore-dev/gg/issues")
+		return
+	}
+
+	if licenseKey, ok := result["license_key"].(string); ok {
+		// Save the tier to config; cfg.Secrets may hold GG_* env keys, and
+		// secrets only go to the encrypted file
+		ggDir := getConfigDir()
+		plain := *cfg
+		plain.GG.Tier = "pro"
+		plain.Secrets = SecretsData{}
+		if _, err := saveConfig(&plain); err != nil {
+			fmt.Printf("Failed to save config: %v\n", err)
+			fmt.Println("Manually run: gg config set keys.pro_license_key <key>")
+			return
+		}
+		cfg.Secrets.ProLicenseKey = licenseKey
+		cfg.GG.Tier = "pro"
+
+		// Re-encrypt the stored secrets (not env overrides) with the new
+		// license key
+		keyPath := filepath.Join(ggDir, ".key")
+		keyData, err := os.ReadFile(keyPath)
+		if err == nil {
+			identity, err := parseIdentityFile(keyData)
+			if err == nil {
+				secretsPath := filepath.Join(ggDir, "secrets")
+				var secrets SecretsData
+				if err := decryptSecrets(&secrets, identity, secretsPath); err == nil || os.IsNotExist(err) {
+					secrets.ProLicenseKey = licenseKey
+					encryptSecrets(secrets, identity, secretsPath)
+				}
+			}
+		}
+
+		fmt.Println()
+		fmt.Println("Pro activated!")
+		fmt.Printf("License: %s\n", licenseKey)
+		fmt.Println()
+		fmt.Println("You now have unlimited access to:")
+		fmt.Println("  - gg ask")
+		fmt.Println("  - gg a2a")
+		fmt.Println()
+		fmt.Println("Thank you for supporting gg!")
+	}
+}
+
+// openCustomerPortal opens Stripe billing portal
+func openCustomerPortal(cfg *Config) {
+	if !checkProTier(cfg) {
+		fmt.Println("No active subscription")
+		fmt.Println("Run: gg upgrade")
+		return
+	}
+
+	fmt.Println("Opening billing portal...")
+
+	reqBody, _ := json.Marshal(map[string]string{
+		"license_key": cfg.Secrets.ProLicenseKey,
+	})
+	resp, err := newHTTPClient(httpTimeout).Post(getBackendURL()+"/portal", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if portalURL, ok := result["portal_url"].(string); ok {
+		fmt.Println(portalURL)
+		openBrowser(portalURL)
+	} else if errMsg, ok := result["error"].(string); ok {
+		fmt.Printf("Error: %s\n", errMsg)
+	}
+}
+
+// A2A rate limiting for free tier
+const a2aFreeLimit = 10 // soft limit per day
+const a2aGraceLimit = 2 // extra grace calls
+
+// askFreeMonthlyLimit is how many gg ask generations the free tier gets
+// per calendar month, counted from UsageStats.AskCount
+const askFreeMonthlyLimit = 5
+
+// checkBudget compares this month's estimated cost against [limits]
+// monthly_usd, warning past warn_pct. It reports false when the cap is
+// reached and force is not set.
+func checkBudget(cfg *Config, force bool) bool {
+	limit := cfg.Limits.MonthlyUSD
+	if limit <= 0 {
+		return true
+	}
+	warnPct := cfg.Limits.WarnPct
+	if warnPct <= 0 {
+		warnPct = 80
+	}
+
+	stats, _ := loadMonthStats(time.Now().Format("2006-01"))
+	spent := stats.EstimatedCost
+	remaining := max(limit-spent, 0)
+	switch {
+	case spent >= limit && !force:
+		fmt.Printf("Monthly budget reached: ~$%.2f of $%.2f spent ([limits] monthly_usd)\n", spent, limit)
+		fmt.Println("Re-run with --force to go over, or raise the limit: gg config set limits.monthly_usd <usd>")
+		return false
+	case spent >= limit:
+		fmt.Printf("Warning: over monthly budget (~$%.2f of $%.2f); continuing because of --force\n\n", spent, limit)
+	case spent >= limit*float64(warnPct)/100:
+		fmt.Printf("Warning: %.0f%% of monthly budget used; $%.2f of $%.2f left\n\n", spent/limit*100, remaining, limit)
+	default:
+		fmt.Printf("Budget: $%.2f of $%.2f left this month\n\n", remaining, limit)
+	}
+	return true
+}
+
+// monthlyAskCount returns this month's ask count from stats.json
+func monthlyAskCount() int {
+	stats, _ := loadMonthStats(time.Now().Format("2006-01"))
+	return stats.AskCount
+}
+
+type A2AUsage struct {
+	Date  string `json:"date"`
+	Count int    `json:"count"`
+}
+
+func getA2AUsagePath() string {
+	return filepath.Join(getGGDir(), "a2a_usage.json")
+}
+
+// Returns: (allowed, inGrace, remaining)
+func checkA2ALimit(cfg *Config) (bool, bool, int) {
+	// Pro users have unlimited access
+	if checkProTier(cfg) {
+		return true, false, -1
+	}
+
+	// Load usage
+	usagePath := getA2AUsagePath()
+	today := time.Now().Format("2006-01-02")
+
+	var usage A2AUsage
+	data, err := os.ReadFile(usagePath)
+	if err == nil {
+		json.Unmarshal(data, &usage)
+	}
+
+	// Reset if new day
+	if usage.Date != today {
+		usage = A2AUsage{Date: today, Count: 0}
+	}
+
+	hardLimit := a2aFreeLimit + a2aGraceLimit
+	remaining := a2aFreeLimit - usage.Count
+	inGrace := usage.Count >= a2aFreeLimit && usage.Count < hardLimit
+
+	return usage.Count < hardLimit, inGrace, remaining
+}
+
+func incrementA2AUsage() {
+	usagePath := getA2AUsagePath()
+	today := time.Now().Format("2006-01-02")
+
+	var usage A2AUsage
+	data, err := os.ReadFile(usagePath)
+	if err == nil {
+		json.Unmarshal(data, &usage)
+	}
+
+	if usage.Date != today {
+		usage = A2AUsage{Date: today, Count: 0}
+	}
+
+	usage.Count++
+	newData, _ := json.Marshal(usage)
+	os.WriteFile(usagePath, newData, 0644)
+}
+
+// codeFenceRe matches a fence line: the fence itself, an optional
+// language tag (any case, e.g. C++ or Dockerfile) and an optional :path
+var codeFenceRe = regexp.MustCompile("^(`{3,}|~{3,})\\s*([^\\s:`~]*)(?::\\s*(.+))?$")
+
+// fileLabelRe matches a "File: path" line naming the block after it
+var fileLabelRe = regexp.MustCompile("(?i)^[*_#\\s]*(?:file|filename|path)[*_]*:[*_]*\\s*`?([^`*\\s]+)`?[*_]*$")
+
+// parseCodeBlocks returns path -> content for each fenced block in a model
+// response. The path comes from ```lang:path or, failing that, a
+// "File: path" line right before the fence; blocks with neither are
+// skipped. Fences inside a block (e.g. a generated README) are tracked by
+// depth, so only the matching bare fence closes it.
+func parseCodeBlocks(response string) map[string]string {
+	files := make(map[string]string)
+
+	var (
+		inBlock   bool
+		fence     string
+		depth     int
+		path      string
+		content   []string
+		labelPath string
+	)
+	for _, line := range strings.Split(response, "\n") {
+		trimmed := strings.TrimSpace(line)
+		m := codeFenceRe.FindStringSubmatch(trimmed)
+
+		if !inBlock {
+			switch {
+			case m != nil:
+				inBlock, fence, depth, content = true, m[1], 0, nil
+				path = strings.TrimSpace(m[3])
+				if path == "" {
+					path = labelPath
+				}
+			case trimmed == "":
+				continue
+			default:
+				labelPath = ""
+				if lm := fileLabelRe.FindStringSubmatch(trimmed); lm != nil {
+					labelPath = lm[1]
+				}
+			}
+			continue
+		}
+
+		if m != nil && m[1][0] == fence[0] && len(m[1]) >= len(fence) {
+			if m[2] != "" || m[3] != "" {
+				depth++
+			} else if depth > 0 {
+				depth--
+			} else {
+				if path != "" && len(content) > 0 {
+					files[path] = strings.Join(content, "\n") + "\n"
+				} else if path != "" {
+					files[path] = ""
+				}
+				inBlock, labelPath = false, ""
+				continue
+			}
+		}
+		content = append(content, line)
 	}
-	exec.Command("git", "commit", "-m", commitMsg).Run()
-	exec.Command("git", "push", "-u", "origin", branchName).Run()
 
-	// Create PR
-	prCmd := exec.Command("gh", "pr", "create", "--title", commitMsg, "--body", fmt.Sprintf("Generated by gg ask:\n\n%s", prompt))
-	prOutput, err := prCmd.Output()
+	return files
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+// debugMode logs external commands, model request sizes and cache
+// lookups to stderr (--debug/--verbose before the command, or GG_DEBUG=1)
+var debugMode bool
+
+// debugf writes a [debug] line to stderr under debugMode, redacting
+// secrets the same way sanitizeError does
+func debugf(format string, args ...interface{}) {
+	if !debugMode {
+		return
+	}
+	msg := sanitizeError(fmt.Errorf(format, args...)).Error()
+	fmt.Fprintf(os.Stderr, "[debug] %s\n", msg)
+}
+
+// command is exec.Command, logging the invocation under debugMode
+func command(name string, args ...string) *exec.Cmd {
+	debugf("exec: %s", strings.Join(append([]string{name}, args...), " "))
+	return exec.Command(name, args...)
+}
+
+// runCommand runs a command whose output is not needed, logging its exit
+// status (and stderr on failure) under debugMode
+func runCommand(name string, args ...string) error {
+	cmd := command(name, args...)
+	var stderr bytes.Buffer
+	if debugMode {
+		cmd.Stderr = &stderr
+	}
+	err := cmd.Run()
+	debugExit(name, err, stderr.Bytes())
+	return err
+}
+
+// commandOutput is exec.Command(...).Output(), logging the exit status
+// under debugMode
+func commandOutput(name string, args ...string) ([]byte, error) {
+	output, err := command(name, args...).Output()
+	var stderr []byte
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		stderr = exitErr.Stderr
+	}
+	debugExit(name, err, stderr)
+	return output, err
+}
+
+// debugExit logs how a command finished
+func debugExit(name string, err error, stderr []byte) {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		debugf("exit: %s ok", name)
+	case errors.As(err, &exitErr):
+		debugf("exit: %s status %d: %s", name, exitErr.ExitCode(), strings.TrimSpace(string(stderr)))
+	default:
+		debugf("exit: %s: %v", name, err)
+	}
+}
+
+// readCacheFile reads a cache entry, logging the hit or miss under
+// debugMode
+func readCacheFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Println("Failed to create PR. Create manually:")
-		fmt.Printf("   Branch: %s\n", branchName)
+		debugf("cache miss: %s", path)
+	} else if info, statErr := os.Stat(path); statErr == nil {
+		debugf("cache hit: %s (%s old)", path, formatAge(time.Since(info.ModTime())))
+	}
+	return data, err
+}
+
+func sanitizeError(err error) error {
+	msg := err.Error()
+	// Sanitize various API key formats
+	msg = regexp.MustCompile(`sk-ant-[a-zA-Z0-9-]+`).ReplaceAllString(msg, "sk-***")
+	msg = regexp.MustCompile(`sk-[a-zA-Z0-9]+`).ReplaceAllString(msg, "sk-***")
+	msg = regexp.MustCompile(`mcpb_[a-zA-Z0-9]+`).ReplaceAllString(msg, "mcpb_***")
+	msg = regexp.MustCompile(`gg_pro_[a-zA-Z0-9]+`).ReplaceAllString(msg, "gg_pro_***")
+	for _, p := range secretPatterns {
+		msg = p.Re.ReplaceAllString(msg, "***")
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// secretPatterns match credentials that must not leak into errors or
+// generated files
+var secretPatterns = []struct {
+	Name string
+	Re   *regexp.Regexp
+}{
+	{"Anthropic API key", regexp.MustCompile(`sk-ant-[a-zA-Z0-9_-]{20,}`)},
+	{"OpenAI API key", regexp.MustCompile(`sk-(?:proj-)?[a-zA-Z0-9_-]{20,}`)},
+	{"gg Pro license", regexp.MustCompile(`gg_pro_[a-zA-Z0-9]{8,}`)},
+	{"MCP key", regexp.MustCompile(`mcpb_[a-zA-Z0-9]{8,}`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{40,})`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[0-9A-Za-z-]{10,}`)},
+	{"private key", regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY( BLOCK)?-----`)},
+}
+
+var (
+	secretContextRe = regexp.MustCompile(`(?i)(key|secret|token|passw|credential|auth)`)
+	entropyTokenRe  = regexp.MustCompile(`[A-Za-z0-9+/=_-]{32,}`)
+)
+
+// SecretFinding is an apparent secret in a generated file
+type SecretFinding struct {
+	Path  string
+	Line  int
+	Kind  string
+	Match string // masked
+}
+
+// scanForSecrets looks for known credential formats, plus high-entropy
+// strings on lines that mention keys/tokens/passwords
+func scanForSecrets(files map[string]string) []SecretFinding {
+	var findings []SecretFinding
+	for _, path := range sortedFilePaths(files) {
+		for i, line := range strings.Split(files[path], "\n") {
+			found := false
+			for _, p := range secretPatterns {
+				if m := p.Re.FindString(line); m != "" {
+					findings = append(findings, SecretFinding{path, i + 1, p.Name, maskSecret(m)})
+					found = true
+					break
+				}
+			}
+			if found || !secretContextRe.MatchString(line) {
+				continue
+			}
+			for _, tok := range entropyTokenRe.FindAllString(line, -1) {
+				if shannonEntropy(tok) >= 4.5 {
+					findings = append(findings, SecretFinding{path, i + 1, "high-entropy string", maskSecret(tok)})
+					break
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// maskSecret keeps just enough of s to recognise it
+func maskSecret(s string) string {
+	if len(s) <= 8 {
+		return "***"
+	}
+	return s[:6] + "***"
+}
+
+// shannonEntropy returns the bits of entropy per character of s
+func shannonEntropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	n := float64(len([]rune(s)))
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func fatalError(msg string, err error) {
+	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "  %v\n", err)
+	}
+	os.Exit(1)
+}
+
+// openBrowser opens url in the platform's default browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = command("open", url)
+	case "windows":
+		cmd = command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+func getHomeDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return os.Getenv("HOME")
+	}
+	return homeDir
+}
+
+func getGGDir() string {
+	return filepath.Join(getHomeDir(), ".gg")
+}
+
+// ============================================================================
+// PROFILES
+// ============================================================================
+
+// Active profile and where it came from (flag, env, default). An empty
+// profile means the top-level ~/.gg config.
+var (
+	activeProfile string
+	profileSource string
+)
+
+// jsonOutput is set by the global --json flag (or GG_JSON=1): commands that
+// support it print one JSON document instead of human output
+var jsonOutput bool
+
+var profileNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// extractGlobalFlags removes gg-wide flags (like --profile) from os.Args.
+// They are only global before the command name, so gg run <cmd> --json or
+// --profile still reaches the command.
+func extractGlobalFlags() {
+	switch strings.ToLower(os.Getenv("GG_JSON")) {
+	case "1", "true", "yes":
+		jsonOutput = true
+	}
+	switch strings.ToLower(os.Getenv("GG_DEBUG")) {
+	case "1", "true", "yes":
+		debugMode = true
+	}
+
+	args := []string{os.Args[0]}
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "--json" && len(args) == 1:
+			jsonOutput = true
+		case (arg == "--debug" || arg == "--verbose") && len(args) == 1:
+			debugMode = true
+		case arg == "--profile" && i+1 < len(os.Args) && len(args) == 1:
+			activeProfile = os.Args[i+1]
+			profileSource = "flag"
+			i++
+		case strings.HasPrefix(arg, "--profile=") && len(args) == 1:
+			activeProfile = strings.TrimPrefix(arg, "--profile=")
+			profileSource = "flag"
+		default:
+			args = append(args, arg)
+		}
+	}
+	os.Args = args
+}
+
+// resolveProfile picks the active profile: --profile, then GG_PROFILE,
+// then the ~/.gg/profile default marker
+func resolveProfile() {
+	if activeProfile == "" {
+		if env := os.Getenv("GG_PROFILE"); env != "" {
+			activeProfile = env
+			profileSource = "env"
+		} else if data, err := os.ReadFile(getDefaultProfilePath()); err == nil {
+			if name := strings.TrimSpace(string(data)); name != "" {
+				activeProfile = name
+				profileSource = "default"
+			}
+		}
+	}
+
+	if activeProfile == "default" {
+		activeProfile = ""
+	}
+	if activeProfile != "" && !profileNameRe.MatchString(activeProfile) {
+		fatalError(fmt.Sprintf("Invalid profile name: %s", activeProfile), nil)
+	}
+}
+
+func getDefaultProfilePath() string {
+	return filepath.Join(getGGDir(), "profile")
+}
+
+func getProfilesDir() string {
+	return filepath.Join(getGGDir(), "profiles")
+}
+
+// getConfigDir returns the directory holding config.toml, .key and secrets
+// for the active profile
+func getConfigDir() string {
+	if activeProfile == "" {
+		return getGGDir()
+	}
+	return filepath.Join(getProfilesDir(), activeProfile)
+}
+
+func setDefaultProfile(name string) {
+	if name == "default" {
+		os.Remove(getDefaultProfilePath())
+		fmt.Println("Default profile cleared (using ~/.gg)")
+		return
+	}
+
+	if !profileNameRe.MatchString(name) {
+		fatalError(fmt.Sprintf("Invalid profile name: %s", name), nil)
+	}
+	if _, err := os.Stat(filepath.Join(getProfilesDir(), name)); err != nil {
+		fmt.Printf("Profile not found: %s\n", name)
+		fmt.Printf("Create it: gg --profile %s init\n", name)
+		return
+	}
+
+	os.MkdirAll(getGGDir(), 0700)
+	if err := os.WriteFile(getDefaultProfilePath(), []byte(name+"\n"), 0644); err != nil {
+		fatalError("Failed to save default profile", err)
+	}
+	fmt.Printf("Default profile: %s\n", name)
+}
+
+// listProfiles shows ~/.gg and each profile under ~/.gg/profiles, marking
+// the active (*) and default ones. Settings come from config.toml only;
+// secrets stay encrypted.
+func listProfiles() {
+	names := []string{"default"}
+	entries, _ := os.ReadDir(getProfilesDir())
+	for _, e := range entries {
+		if e.IsDir() && profileNameRe.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+
+	defaultName := "default"
+	if data, err := os.ReadFile(getDefaultProfilePath()); err == nil {
+		if name := strings.TrimSpace(string(data)); name != "" {
+			defaultName = name
+		}
+	}
+	active := activeProfile
+	if active == "" {
+		active = "default"
+	}
+
+	fmt.Printf("  %-20s %-6s %-10s %s\n", "PROFILE", "TIER", "PROVIDER", "MODEL")
+	for _, name := range names {
+		dir := getGGDir()
+		if name != "default" {
+			dir = filepath.Join(getProfilesDir(), name)
+		}
+
+		var cfg Config
+		tier, provider, model := "-", "-", "-"
+		if _, err := toml.DecodeFile(filepath.Join(dir, "config.toml"), &cfg); err == nil {
+			provider, model, _, _ = getEffectiveConfig(&cfg)
+			tier = cfg.GG.Tier
+			if tier == "" {
+				tier = "free"
+			}
+		}
+
+		marker := " "
+		if name == active {
+			marker = "*"
+		}
+		label := name
+		if name == defaultName && name != "default" {
+			label += " (default)"
+		}
+		fmt.Printf("%s %-20s %-6s %-10s %s\n", marker, label, tier, provider, model)
+	}
+
+	if len(names) == 1 {
+		fmt.Println()
+		fmt.Println("No profiles yet. Create one: gg --profile <name> init")
+	}
+}
+
+// handleWhoami shows the active profile and the identity it resolves to
+func handleWhoami() {
+	name := activeProfile
+	source := profileSource
+	if name == "" {
+		name = "default"
+		source = "builtin"
+	}
+
+	fmt.Printf("Profile: %s (%s)\n", name, source)
+	fmt.Printf("Config:  %s\n", getConfigDir())
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Println("Status:  not configured")
+		return
+	}
+
+	provider, model, _, _ := getEffectiveConfig(cfg)
+	tier := "free"
+	if checkProTier(cfg) {
+		tier = "pro"
+	}
+	fmt.Printf("Provider: %s\n", provider)
+	fmt.Printf("Model:    %s\n", model)
+	fmt.Printf("Tier:     %s\n", tier)
+}
+
+// ============================================================================
+// SHELL COMPLETION
+// ============================================================================
+
+// completionCommands are the top-level commands and, for each, the
+// subcommands and flags offered after it. Chain and toolbelt names are
+// completed at runtime from gg chain --list / gg cool --list.
+var completionCommands = []struct {
+	Name  string
+	Words string
+	Files bool // also complete file names
+}{
+	{"ask", "--model --temp --local --maaza --cloud --pro --context --context-from-search --summarize-context --include-gitignored " +
+		"--prompt-file --json-schema --explain-only --diff-only-output --raw --commit-each-file --commit-trailer " +
+		"--sign-commits --require-clean-build --open-pr --no-open-pr --no-stream --no-cache --cache-response " +
+		"--max-parallel-files --max-retries-total --max-diff-lines --header --ignore-template --no-system-context " +
+		"--no-checklist --abort-on-secret --allow-secrets --from-template-pr --dedupe --branch --message " +
+		"--revert --restore-backups --yes --force", true},
+	{"approve", "--merge --squash --rebase --delete-branch --keep-branch --require-checks --wait --timeout", false},
+	{"pr", "view list diff checkout create checks assign unassign close edit --web --merge --squash --rebase --delete-branch --keep-branch --branch --force", false},
+	{"run", "--capture --exec --json --json-stream --label --stdin --stdin-file --tee-stats --timeout --timeout-signal", true},
+	{"npm", "audit search --limit --fn --readme --deps --json", false},
+	{"brew", "uninstall -i --cask --cleanup --yes", false},
+	{"pip", "", false},
+	{"chain", "run --list --save --delete --rename --force --install --serve --concurrency --continue-on-error --env --env-file", false},
+	{"cool", "graph --list --save --delete --force --format --out", false},
+	{"cache", "status clean migrate lock unlock npm pip brew cask responses --all --max-age --dry-run", false},
+	{"config", "init get set set-default-profile list-profiles schema import-from-env set-model-alias set-proxy tier rotate-key --passphrase", false},
+	{"stats", "top reset export --month --by-label --per-command --estimate --format --out --all --yes", false},
+	{"prompts", "list add run delete", false},
+	{"edit", "", true},
+	{"a2a", "ask plan code .", false},
+	{"chat", "", false},
+	{"doctor", "--json", false},
+	{"init", "", false},
+	{"maaza", "", false},
+	{"upgrade", "", false},
+	{"pro", "", false},
+	{"whoami", "", false},
+	{"version", "", false},
+	{"help", "", false},
+	{"completion", "bash zsh fish", false},
+}
+
+// Shell snippets listing saved chains and toolbelts by parsing --list
+const (
+	completionChains    = `gg chain --list 2>/dev/null | awk '/^   - /{print $2}'`
+	completionToolbelts = `gg cool --list 2>/dev/null | awk '/^   [^ -]/{print $1}'`
+)
+
+func handleCompletion() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg completion <bash|zsh|fish>")
+		fmt.Println()
+		fmt.Println("  bash: echo 'source <(gg completion bash)' >> ~/.bashrc")
+		fmt.Println("  zsh:  echo 'source <(gg completion zsh)' >> ~/.zshrc   (after compinit)")
+		fmt.Println("  fish: gg completion fish > ~/.config/fish/completions/gg.fish")
+		return
+	}
+
+	var names []string
+	for _, c := range completionCommands {
+		names = append(names, c.Name)
+	}
+	commands := strings.Join(names, " ")
+	const global = "--json --profile"
+
+	var b strings.Builder
+	switch os.Args[2] {
+	case "bash":
+		b.WriteString("# bash completion for gg\n")
+		b.WriteString("_gg_chains() { " + completionChains + "; }\n")
+		b.WriteString("_gg_toolbelts() { " + completionToolbelts + "; }\n\n")
+		b.WriteString("_gg() {\n")
+		b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\" words=\"\"\n")
+		b.WriteString("\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+		fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W \"%s %s\" -- \"$cur\"))\n\t\treturn\n\tfi\n", commands, global)
+		b.WriteString("\tcase \"${COMP_WORDS[1]}\" in\n")
+		for _, c := range completionCommands {
+			if c.Words != "" {
+				fmt.Fprintf(&b, "\t%s) words=\"%s\" ;;\n", c.Name, c.Words)
+			}
+		}
+		b.WriteString("\tesac\n")
+		b.WriteString("\tcase \"${COMP_WORDS[1]}:$prev\" in\n")
+		b.WriteString("\tchain:run | chain:--delete | chain:--rename) words=\"$(_gg_chains)\" ;;\n")
+		b.WriteString("\tcool:cool | cool:--delete) words=\"$words $(_gg_toolbelts)\" ;;\n")
+		b.WriteString("\tesac\n")
+		b.WriteString("\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+		b.WriteString("}\n\n")
+		b.WriteString("complete -o default -F _gg gg\n")
+	case "zsh":
+		b.WriteString("#compdef gg\n")
+		b.WriteString("_gg_chains() { " + completionChains + "; }\n")
+		b.WriteString("_gg_toolbelts() { " + completionToolbelts + "; }\n\n")
+		b.WriteString("_gg() {\n")
+		b.WriteString("\tif (( CURRENT == 2 )); then\n")
+		fmt.Fprintf(&b, "\t\tcompadd -- %s %s\n\t\treturn\n\tfi\n", commands, global)
+		b.WriteString("\tcase \"${words[2]}:${words[CURRENT-1]}\" in\n")
+		b.WriteString("\tchain:run | chain:--delete | chain:--rename) compadd -- $(_gg_chains); return ;;\n")
+		b.WriteString("\tcool:cool | cool:--delete) compadd -- $(_gg_toolbelts) ;;\n")
+		b.WriteString("\tesac\n")
+		b.WriteString("\tcase \"${words[2]}\" in\n")
+		for _, c := range completionCommands {
+			if c.Words == "" && !c.Files {
+				continue
+			}
+			fmt.Fprintf(&b, "\t%s)", c.Name)
+			if c.Words != "" {
+				fmt.Fprintf(&b, " compadd -- %s;", c.Words)
+			}
+			if c.Files {
+				b.WriteString(" _files;")
+			}
+			b.WriteString(" ;;\n")
+		}
+		b.WriteString("\tesac\n")
+		b.WriteString("}\n\n")
+		b.WriteString("compdef _gg gg\n")
+	case "fish":
+		b.WriteString("# fish completion for gg\n")
+		b.WriteString("function __gg_chains; " + completionChains + "; end\n")
+		b.WriteString("function __gg_toolbelts; " + completionToolbelts + "; end\n\n")
+		b.WriteString("complete -c gg -f\n")
+		fmt.Fprintf(&b, "complete -c gg -n __fish_use_subcommand -a \"%s %s\"\n", commands, global)
+		for _, c := range completionCommands {
+			cond := "__fish_seen_subcommand_from " + c.Name
+			if c.Words != "" {
+				fmt.Fprintf(&b, "complete -c gg -n '%s' -a \"%s\"\n", cond, c.Words)
+			}
+			if c.Files {
+				fmt.Fprintf(&b, "complete -c gg -n '%s' -F\n", cond)
+			}
+		}
+		b.WriteString("complete -c gg -n '__fish_seen_subcommand_from chain; and __fish_seen_subcommand_from run --delete --rename' -a '(__gg_chains)'\n")
+		b.WriteString("complete -c gg -n '__fish_seen_subcommand_from cool' -a '(__gg_toolbelts)'\n")
+	default:
+		fatalError(fmt.Sprintf("Unsupported shell %q (expected bash, zsh or fish)", os.Args[2]), nil)
+	}
+	fmt.Print(b.String())
+}
+
+// ============================================================================
+// NETWORK & DOCTOR
+// ============================================================================
+
+// configureNetwork applies [network] settings to the default transport,
+// which every http.Get and http.Client in gg uses
+func configureNetwork() {
+	network := loadPlainConfig().Network
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if network.Proxy != "" {
+		proxyURL, err := url.Parse(network.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring invalid [network] proxy %q\n", network.Proxy)
+		} else {
+			transport.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+	if network.CABundle != "" {
+		if pool, err := loadCABundle(network.CABundle); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring [network] ca_bundle: %v\n", err)
+		} else {
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+	http.DefaultTransport = transport
+}
+
+// loadCABundle returns the system roots plus the certificates in path
+func loadCABundle(path string) (*x509.CertPool, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, rest)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// httpTimeout bounds registry, backend and other non-model requests
+const httpTimeout = 30 * time.Second
+
+// newHTTPClient is the client for every outbound request gg makes. Its
+// transport is the one configureNetwork set up, so [network] proxy,
+// HTTP(S)_PROXY and ca_bundle all apply.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: http.DefaultTransport}
+}
+
+func setProxy(value string) {
+	cfg := loadPlainConfig()
+	if value == "none" || value == "" {
+		cfg.Network.Proxy = ""
+	} else {
+		proxyURL, err := url.Parse(value)
+		if err != nil || proxyURL.Host == "" {
+			fatalError("Invalid proxy URL (expected e.g. http://proxy.corp:8080)", err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			fatalError("Proxy scheme must be http, https or socks5", nil)
+		}
+		cfg.Network.Proxy = value
+	}
+	if _, err := saveConfig(cfg); err != nil {
+		fatalError("Failed to write config", err)
+	}
+	if cfg.Network.Proxy == "" {
+		fmt.Println("Proxy cleared (HTTP(S)_PROXY from the environment still apply)")
+	} else {
+		fmt.Printf("Proxy set to %s\n", cfg.Network.Proxy)
+		fmt.Println("Check connectivity with: gg doctor")
+	}
+}
+
+// doctorCheck is one gg doctor result. Status is "ok", "fail" (critical;
+// gg doctor exits non-zero) or "warn".
+type doctorCheck struct {
+	Name   string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// newDoctorCheck reports a failed critical check as "fail" and any other
+// failure as "warn"
+func newDoctorCheck(name string, ok, critical bool, detail string) doctorCheck {
+	status := "ok"
+	if !ok {
+		status = "warn"
+		if critical {
+			status = "fail"
+		}
+	}
+	return doctorCheck{Name: name, Status: status, Detail: detail}
+}
+
+// doctorEndpoint is a service gg talks to; critical ones fail gg doctor
+type doctorEndpoint struct {
+	Name     string
+	URL      string
+	Critical bool
+}
+
+// doctorEndpoints returns the model API for the active config plus the
+// package registries and GitHub
+func doctorEndpoints() []doctorEndpoint {
+	model := doctorEndpoint{"Anthropic API", "https://api.anthropic.com", true}
+	if cfg, err := loadConfig(); err == nil {
+		provider, _, endpoint, _ := getEffectiveConfig(cfg)
+		switch provider {
+		case ProviderOpenAI:
+			if endpoint == "" {
+				endpoint = defaultOpenAIBaseURL
+			}
+			model = doctorEndpoint{"OpenAI API", endpoint, true}
+		case ProviderOllama:
+			if endpoint == "" {
+				endpoint = "http://localhost:11434"
+			}
+			model = doctorEndpoint{"Ollama", endpoint, true}
+		}
+	}
+	return []doctorEndpoint{
+		model,
+		{"npm registry", "https://registry.npmjs.org", false},
+		{"Homebrew API", "https://formulae.brew.sh/api/formula.json", false},
+		{"GitHub", githubAPIBase(), true},
+	}
+}
+
+func handleDoctor() {
+	for _, arg := range os.Args[2:] {
+		if arg == "--json" {
+			jsonOutput = true
+		} else {
+			fmt.Printf("Unknown flag: %s\n", arg)
+			fmt.Println("Usage: gg doctor [--json]")
+			os.Exit(2)
+		}
+	}
+
+	checks := runDoctorChecks()
+	failed := 0
+	for _, c := range checks {
+		if c.Status == "fail" {
+			failed++
+		}
+	}
+
+	if jsonOutput {
+		data, _ := json.MarshalIndent(checks, "", "  ")
+		fmt.Println(string(data))
+		if failed > 0 {
+			os.Exit(1)
+		}
 		return
 	}
 
-	prURL := strings.TrimSpace(string(prOutput))
+	fmt.Println("gg doctor")
 	fmt.Println()
-	fmt.Printf("PR created: %s\n", prURL)
+	for _, c := range checks {
+		mark := "✓"
+		switch c.Status {
+		case "fail":
+			mark = "✗"
+		case "warn":
+			mark = "!"
+		}
+		fmt.Printf("  %s %-16s %s\n", mark, c.Name, c.Detail)
+	}
 	fmt.Println()
-	fmt.Println("Next: gg approve")
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("All checks passed")
 }
 
-func handleApprove() {
+func runDoctorChecks() []doctorCheck {
+	var checks []doctorCheck
+
+	configPath := filepath.Join(getConfigDir(), "config.toml")
+	if _, err := os.Stat(configPath); err == nil {
+		checks = append(checks, newDoctorCheck("config", true, true, configPath))
+	} else {
+		checks = append(checks, newDoctorCheck("config", false, true, "not found (run: gg config init)"))
+	}
+
+	for _, tool := range []string{"git", "gh"} {
+		if path, err := exec.LookPath(tool); err == nil {
+			checks = append(checks, newDoctorCheck(tool, true, true, path))
+		} else {
+			checks = append(checks, newDoctorCheck(tool, false, true, "not installed"))
+		}
+	}
+	if authed, _ := checkGitHubAuth(); authed {
+		checks = append(checks, newDoctorCheck("gh auth", true, true, "logged in"))
+	} else {
+		checks = append(checks, newDoctorCheck("gh auth", false, true, "not logged in (run: gh auth login)"))
+	}
+
+	client := newHTTPClient(10 * time.Second)
+	transport := http.DefaultTransport.(*http.Transport)
+	for _, ep := range doctorEndpoints() {
+		req, _ := http.NewRequest("HEAD", ep.URL, nil)
+		via := "direct"
+		if proxyURL, err := transport.Proxy(req); err == nil && proxyURL != nil {
+			via = "via " + proxyURL.Redacted()
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			checks = append(checks, newDoctorCheck(ep.Name, false, ep.Critical, fmt.Sprintf("%s: %v", via, err)))
+			continue
+		}
+		resp.Body.Close()
+		// Any HTTP response proves connectivity; auth errors are expected
+		checks = append(checks, newDoctorCheck(ep.Name, true, ep.Critical,
+			fmt.Sprintf("%s, HTTP %d in %dms", via, resp.StatusCode, time.Since(start).Milliseconds())))
+	}
+
+	return checks
+}
+
+// ============================================================================
+// PR, RUN, STATS
+// ============================================================================
+
+func handlePR() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg pr <number> [--web] [--merge|--squash|--rebase] [--delete-branch|--keep-branch]")
+		fmt.Println("       gg pr view <number> [--web]")
+		fmt.Println("       gg pr list [--state open|closed|merged|all] [--limit N]")
+		fmt.Println("       gg pr diff <number> [--save <file> [--also-print]]")
+		fmt.Println("       gg pr checkout <number> [--branch <name>] [--force]")
+		fmt.Println("       gg pr create [--title T] [--body B] [--ignore-template]")
+		fmt.Println("       gg pr checks <number> [--watch]")
+		fmt.Println("       gg pr assign|unassign <number> <user>... [--me]")
+		fmt.Println("       gg pr close <number> [--comment <reason>] [--delete-branch] [--yes]")
+		fmt.Println("       gg pr edit <number> [--title T] [--body B | --body-file F|-]")
+		return
+	}
+
+	args := os.Args[2:]
+	switch args[0] {
+	case "create":
+		handlePRCreate(args[1:])
+		return
+	case "checks":
+		handlePRChecks(args[1:])
+		return
+	case "assign", "unassign":
+		handlePRAssign(args[1:], args[0] == "unassign")
+		return
+	case "close":
+		handlePRClose(args[1:])
+		return
+	case "edit":
+		handlePREdit(args[1:])
+		return
+	case "list", "ls":
+		handlePRList(args[1:])
+		return
+	case "diff":
+		handlePRDiff(args[1:])
+		return
+	case "checkout", "co":
+		handlePRCheckout(args[1:])
+		return
+	case "view":
+		args = args[1:]
+	}
+
+	var prNumber string
+	web := false
+	cfg := loadPlainConfig()
+	method := ""
+	deleteBranch := cfg.GitHub.DeleteBranch
+	for _, arg := range args {
+		switch arg {
+		case "--web":
+			web = true
+		case "--merge", "--squash", "--rebase":
+			method = strings.TrimPrefix(arg, "--")
+		case "--delete-branch":
+			deleteBranch = true
+		case "--keep-branch":
+			deleteBranch = false
+		default:
+			prNumber = arg
+		}
+	}
+	method = resolveMergeMethod(cfg, method)
+	if prNumber == "" {
+		fmt.Println("Usage: gg pr view <number> [--web]")
+		return
+	}
+
 	if err := ensureGitHubAuth(); err != nil {
 		return
 	}
 
-	// Get latest PR
-	cmd := exec.Command("gh", "pr", "list", "--limit", "1", "--json", "number,title,headRefName")
+	repoName := getCurrentRepo()
+	if repoName == "" {
+		fatalError("Not in a git repository", nil)
+	}
+
+	// Fetch PR details
+	cmd := command("gh", "pr", "view", prNumber, "--json", "number,title,author,state,body,additions,deletions,changedFiles,headRefName,baseRefName,url")
 	output, err := cmd.Output()
 	if err != nil {
-		fatalError("Failed to list PRs", err)
+		fatalError("Failed to fetch PR", err)
 	}
 
-	var prs []struct {
-		Number      int    `json:"number"`
-		Title       string `json:"title"`
-		HeadRefName string `json:"headRefName"`
+	var pr struct {
+		Number       int    `json:"number"`
+		Title        string `json:"title"`
+		Author       struct{ Login string } `json:"author"`
+		State        string `json:"state"`
+		Body         string `json:"body"`
+		Additions    int    `json:"additions"`
+		Deletions    int    `json:"deletions"`
+		ChangedFiles int    `json:"changedFiles"`
+		HeadRefName  string `json:"headRefName"`
+		BaseRefName  string `json:"baseRefName"`
+		URL          string `json:"url"`
 	}
 
-	if err := json.Unmarshal(output, &prs); err != nil {
-		fatalError("Failed to parse PR list", err)
+	if err := json.Unmarshal(output, &pr); err != nil {
+		fatalError("Failed to parse PR data", err)
 	}
 
-	if len(prs) == 0 {
-		fmt.Println("No open PRs found")
+	fmt.Printf("PR #%d: %s\n", pr.Number, pr.Title)
+	fmt.Printf("Author: %s | State: %s\n", pr.Author.Login, pr.State)
+	fmt.Printf("Branch: %s -> %s\n", pr.HeadRefName, pr.BaseRefName)
+	fmt.Printf("Changes: +%d -%d (%d files)\n", pr.Additions, pr.Deletions, pr.ChangedFiles)
+	fmt.Println()
+
+	if pr.Body != "" {
+		fmt.Println("Description:")
+		fmt.Println(truncate(pr.Body, 500))
+		fmt.Println()
+	}
+
+	fmt.Printf("URL: %s\n", pr.URL)
+	fmt.Println()
+
+	if web {
+		if err := openBrowser(pr.URL); err != nil {
+			fmt.Printf("Could not open browser: %v\n", err)
+		}
 		return
 	}
 
-	pr := prs[0]
-	fmt.Printf("PR #%d: %s\n", pr.Number, pr.Title)
-	fmt.Printf("Branch: %s\n\n", pr.HeadRefName)
+	// Show action menu
+	if pr.State == "OPEN" {
+		fmt.Println("Actions:")
+		fmt.Println("  [a]pprove - Merge this PR")
+		fmt.Println("  [d]iff   - Show full diff")
+		fmt.Println("  [c]lose  - Close without merging")
+		fmt.Println("  [s]tatus - Show CI checks")
+		fmt.Println("  [w]eb    - Open in browser")
+		fmt.Println("  [q]uit   - Exit")
+		fmt.Print("\nChoice: ")
 
-	// Confirm
-	fmt.Print("Merge this PR? [Y/n]: ")
-	reader := bufio.NewReader(os.Stdin)
-	response, _ := reader.ReadString('\n')
-	response = strings.TrimSpace(strings.ToLower(response))
+		reader := bufio.NewReader(os.Stdin)
+		choice, _ := reader.ReadString('\n')
+		choice = strings.TrimSpace(strings.ToLower(choice))
 
-	if response != "" && response != "y" {
-		fmt.Println("Cancelled")
+		switch choice {
+		case "a":
+			mergeCmd := command("gh", prMergeArgs(pr.Number, pr.HeadRefName, method, deleteBranch)...)
+			mergeCmd.Stdout = os.Stdout
+			mergeCmd.Stderr = os.Stderr
+			if err := mergeCmd.Run(); err != nil {
+				fatalError("Failed to merge PR", err)
+			}
+			fmt.Println("PR merged!")
+		case "d":
+			diffCmd := command("gh", "pr", "diff", prNumber)
+			diffCmd.Stdout = os.Stdout
+			diffCmd.Stderr = os.Stderr
+			diffCmd.Run()
+		case "c":
+			fmt.Print("Reason (optional, posted as a comment): ")
+			reason, _ := reader.ReadString('\n')
+			closePR(prNumber, strings.TrimSpace(reason), false)
+		case "s":
+			checks, err := fetchPRChecks(prNumber, false)
+			if err != nil {
+				fatalError("Failed to fetch checks", err)
+			}
+			printPRChecks(checks)
+		case "w":
+			if err := openBrowser(pr.URL); err != nil {
+				fmt.Printf("Could not open browser: %v\n", err)
+			}
+		default:
+			fmt.Println("Exiting")
+		}
+	}
+}
+
+func handlePRClose(args []string) {
+	var prNumber, comment string
+	deleteBranch := false
+	yes := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--comment", "-c":
+			if i+1 >= len(args) {
+				fmt.Println("--comment requires a reason")
+				return
+			}
+			comment = args[i+1]
+			i++
+		case "--delete-branch", "-d":
+			deleteBranch = true
+		case "--yes", "-y":
+			yes = true
+		default:
+			prNumber = args[i]
+		}
+	}
+	if prNumber == "" {
+		fmt.Println("Usage: gg pr close <number> [--comment <reason>] [--delete-branch] [--yes]")
 		return
 	}
 
-	// Merge
-	mergeCmd := exec.Command("gh", "pr", "merge", fmt.Sprintf("%d", pr.Number), "--squash", "--delete-branch")
-	mergeCmd.Stdout = os.Stdout
-	mergeCmd.Stderr = os.Stderr
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
 
-	if err := mergeCmd.Run(); err != nil {
-		fatalError("Failed to merge PR", err)
+	if !yes {
+		what := "Close PR #" + prNumber
+		if deleteBranch {
+			what += " and delete its branch"
+		}
+		fmt.Printf("%s? [y/N]: ", what)
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Cancelled")
+			return
+		}
 	}
 
-	fmt.Println()
-	fmt.Println("PR merged successfully!")
+	closePR(prNumber, comment, deleteBranch)
 }
 
-// ============================================================================
-// EDIT COMMAND
-// ============================================================================
+// closePR closes a PR, posting comment first when given
+func closePR(prNumber, comment string, deleteBranch bool) {
+	closeArgs := []string{"pr", "close", prNumber}
+	if comment != "" {
+		closeArgs = append(closeArgs, "--comment", comment)
+	}
+	if deleteBranch {
+		closeArgs = append(closeArgs, "--delete-branch")
+	}
+	closeCmd := command("gh", closeArgs...)
+	closeCmd.Stdout = os.Stdout
+	closeCmd.Stderr = os.Stderr
+	if err := closeCmd.Run(); err != nil {
+		fatalError("Failed to close PR", err)
+	}
+	fmt.Println("PR closed")
+}
 
-func handleEdit() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg edit <file> [instruction]")
-		fmt.Println()
-		fmt.Println("Examples:")
-		fmt.Println("  gg edit main.go                    # Interactive edit")
-		fmt.Println("  gg edit main.go \"add error handling\"")
-		fmt.Println("  gg edit src/*.ts \"add types\"       # Multiple files")
+// handlePRDiff prints a PR's diff, or with --save writes the raw gh pr diff
+// output to a file (--also-print shows it too)
+func handlePRDiff(args []string) {
+	var prNumber, savePath string
+	alsoPrint := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--save", "-o":
+			if i+1 >= len(args) {
+				fatalError("--save requires a file", nil)
+			}
+			savePath = args[i+1]
+			i++
+		case "--also-print":
+			alsoPrint = true
+		default:
+			if strings.HasPrefix(args[i], "-") || prNumber != "" {
+				fmt.Printf("Unknown flag: %s\n", args[i])
+				return
+			}
+			prNumber = args[i]
+		}
+	}
+	if prNumber == "" {
+		fmt.Println("Usage: gg pr diff <number> [--save <file> [--also-print]]")
+		return
+	}
+
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
+
+	if savePath == "" {
+		diffCmd := command("gh", "pr", "diff", prNumber)
+		diffCmd.Stdout = os.Stdout
+		diffCmd.Stderr = os.Stderr
+		if err := diffCmd.Run(); err != nil {
+			fatalError(fmt.Sprintf("Failed to fetch diff for PR #%s", prNumber), err)
+		}
+		return
+	}
+
+	// --color=never keeps escape codes out of the saved file
+	diffCmd := command("gh", "pr", "diff", prNumber, "--color=never")
+	diffCmd.Stderr = os.Stderr
+	diff, err := diffCmd.Output()
+	if err != nil {
+		fatalError(fmt.Sprintf("Failed to fetch diff for PR #%s", prNumber), err)
+	}
+	if err := os.WriteFile(savePath, diff, 0644); err != nil {
+		fatalError("Failed to save diff", err)
+	}
+	if alsoPrint {
+		os.Stdout.Write(diff)
+	}
+	fmt.Fprintf(os.Stderr, "Saved diff for PR #%s to %s (%s)\n", prNumber, savePath, formatSize(int64(len(diff))))
+}
+
+// handlePRCheckout fetches a PR's head branch and switches to it
+func handlePRCheckout(args []string) {
+	var prNumber string
+	ghArgs := []string{"pr", "checkout"}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--branch", "-b":
+			if i+1 >= len(args) {
+				fatalError("--branch requires a name", nil)
+			}
+			ghArgs = append(ghArgs, "--branch", args[i+1])
+			i++
+		case "--force", "-f":
+			ghArgs = append(ghArgs, "--force")
+		default:
+			if strings.HasPrefix(args[i], "-") || prNumber != "" {
+				fmt.Printf("Unknown flag: %s\n", args[i])
+				return
+			}
+			prNumber = args[i]
+		}
+	}
+	if prNumber == "" {
+		fmt.Println("Usage: gg pr checkout <number> [--branch <name>] [--force]")
+		return
+	}
+
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
+
+	cmd := command("gh", append(ghArgs, prNumber)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalError(fmt.Sprintf("Failed to check out PR #%s", prNumber), err)
+	}
+}
+
+// prListStates are the --state values gh pr list accepts
+var prListStates = []string{"open", "closed", "merged", "all"}
+
+// handlePRList prints a compact table of PRs in the current repo
+func handlePRList(args []string) {
+	state := "open"
+	limit := 30
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--state", "-s":
+			if i+1 >= len(args) || !slices.Contains(prListStates, args[i+1]) {
+				fatalError("--state must be one of: "+strings.Join(prListStates, ", "), nil)
+			}
+			state = args[i+1]
+			i++
+		case "--limit", "-L":
+			if i+1 >= len(args) {
+				fatalError("--limit requires a number", nil)
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fatalError("--limit must be a positive integer", nil)
+			}
+			limit = n
+			i++
+		default:
+			fmt.Printf("Unknown flag: %s\n", args[i])
+			fmt.Println("Usage: gg pr list [--state open|closed|merged|all] [--limit N]")
+			return
+		}
+	}
+
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
+
+	output, err := command("gh", "pr", "list", "--state", state, "--limit", strconv.Itoa(limit),
+		"--json", "number,title,author,state,headRefName").Output()
+	if err != nil {
+		fatalError("Failed to list PRs", err)
+	}
+
+	var prs []struct {
+		Number      int                    `json:"number"`
+		Title       string                 `json:"title"`
+		Author      struct{ Login string } `json:"author"`
+		State       string                 `json:"state"`
+		HeadRefName string                 `json:"headRefName"`
+	}
+	if err := json.Unmarshal(output, &prs); err != nil {
+		fatalError("Failed to parse PR list", err)
+	}
+	if len(prs) == 0 {
+		fmt.Printf("No %s PRs\n", state)
+		return
+	}
+
+	numWidth, authorWidth := len("#"), len("AUTHOR")
+	for _, pr := range prs {
+		numWidth = max(numWidth, len(strconv.Itoa(pr.Number))+1)
+		authorWidth = max(authorWidth, len(pr.Author.Login))
+	}
+	showState := state != "open"
+
+	header := fmt.Sprintf("%-*s  %-50s  %-*s  ", numWidth, "#", "TITLE", authorWidth, "AUTHOR")
+	if showState {
+		header += fmt.Sprintf("%-7s  ", "STATE")
+	}
+	fmt.Println(header + "BRANCH")
+	for _, pr := range prs {
+		line := fmt.Sprintf("%-*s  %-50s  %-*s  ", numWidth, fmt.Sprintf("#%d", pr.Number),
+			truncate(pr.Title, 47), authorWidth, pr.Author.Login)
+		if showState {
+			line += fmt.Sprintf("%-7s  ", strings.ToLower(pr.State))
+		}
+		fmt.Println(line + pr.HeadRefName)
+	}
+}
+
+// handlePREdit rewrites a PR's title and/or body via gh pr edit. The body
+// can come from a file or stdin (--body-file - or --body -).
+func handlePREdit(args []string) {
+	var prNumber, title, body, bodyFile string
+	var setTitle, setBody bool
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--title", "-t":
+			if i+1 < len(args) {
+				title = args[i+1]
+				setTitle = true
+				i++
+			}
+		case "--body", "-b":
+			if i+1 < len(args) {
+				body = args[i+1]
+				setBody = true
+				i++
+			}
+		case "--body-file", "-F":
+			if i+1 < len(args) {
+				bodyFile = args[i+1]
+				setBody = true
+				i++
+			}
+		default:
+			if strings.HasPrefix(args[i], "-") || prNumber != "" {
+				fmt.Printf("Unknown flag: %s\n", args[i])
+				return
+			}
+			prNumber = args[i]
+		}
+	}
+	if prNumber == "" || (!setTitle && !setBody) {
+		fmt.Println("Usage: gg pr edit <number> [--title T] [--body B | --body-file F|-]")
 		return
 	}
-
-	filePath := os.Args[2]
-	var instruction string
-	if len(os.Args) > 3 {
-		instruction = strings.Join(os.Args[3:], " ")
+	if setTitle && strings.TrimSpace(title) == "" {
+		fatalError("PR title must not be empty", nil)
 	}
 
-	// Check if file exists
-	content, err := os.ReadFile(filePath)
-	if err != nil {
-		fatalError("Cannot read file", err)
+	if body == "-" && bodyFile == "" {
+		bodyFile = "-"
 	}
-
-	// Get instruction if not provided
-	if instruction == "" {
-		fmt.Printf("Editing: %s (%d bytes)\n", filePath, len(content))
-		fmt.Print("\nWhat changes do you want? > ")
-		reader := bufio.NewReader(os.Stdin)
-		instruction, _ = reader.ReadString('\n')
-		instruction = strings.TrimSpace(instruction)
-		if instruction == "" {
-			fmt.Println("No instruction provided, exiting")
-			return
+	if bodyFile == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatalError("Failed to read body from stdin", err)
+		}
+		body = string(data)
+	} else if bodyFile != "" {
+		data, err := os.ReadFile(bodyFile)
+		if err != nil {
+			fatalError("Failed to read body file", err)
 		}
+		body = string(data)
 	}
 
-	// Load config
-	cfg, err := loadConfig()
-	if err != nil {
-		fatalError("Config error. Run: gg config init", err)
+	if err := ensureGitHubAuth(); err != nil {
+		return
 	}
 
-	provider, model, endpoint, apiKey := getEffectiveConfig(cfg)
-	if provider != ProviderOllama && apiKey == "" {
-		fatalError("API key not configured. Run: gg config init", nil)
+	editArgs := []string{"pr", "edit", prNumber}
+	if setTitle {
+		editArgs = append(editArgs, "--title", strings.TrimSpace(title))
+	}
+	if setBody {
+		editArgs = append(editArgs, "--body", strings.TrimRight(body, "\n"))
+	}
+	cmd := command("gh", editArgs...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalError(fmt.Sprintf("Failed to edit PR #%s", prNumber), err)
 	}
 
-	// Create edit prompt
-	editPrompt := fmt.Sprintf("Edit this file according to the instruction.\n\n"+
-		"FILE: %s\n"+
-		"```\n%s\n```\n\n"+
-		"INSTRUCTION: %s\n\n"+
-		"Return ONLY the complete edited file content, no explanations. "+
-		"Wrap in ```language:filename code block.", filePath, string(content), instruction)
-
-	systemPrompt := "You are a code editor. Return only the edited file content in a code block."
-
-	fmt.Printf("Editing %s with %s/%s...\n\n", filePath, provider, model)
-
-	var response string
-	switch provider {
-	case ProviderOpenAI:
-		response, err = callOpenAIStreaming(apiKey, model, systemPrompt, editPrompt)
-	case ProviderOllama:
-		response, err = callOllamaStreaming(endpoint, model, systemPrompt, editPrompt)
-	default:
-		response, err = callAnthropicStreaming(apiKey, model, systemPrompt, editPrompt, cfg.API.Temperature)
+	var changed []string
+	if setTitle {
+		changed = append(changed, "title")
+	}
+	if setBody {
+		changed = append(changed, "body")
 	}
+	fmt.Printf("Updated %s of PR #%s\n", strings.Join(changed, " and "), prNumber)
+}
 
-	if err != nil {
-		fatalError("API error", sanitizeError(err))
+// handlePRAssign adds (or with remove, removes) PR assignees via gh pr edit
+func handlePRAssign(args []string, remove bool) {
+	verb := "assign"
+	if remove {
+		verb = "unassign"
 	}
 
-	// Parse the response for code blocks
-	files := parseCodeBlocks(response)
-	if len(files) == 0 {
-		// Try to extract content between ``` markers
-		re := regexp.MustCompile("```[a-z]*\n([\\s\\S]*?)```")
-		matches := re.FindStringSubmatch(response)
-		if len(matches) >= 2 {
-			files[filePath] = matches[1]
+	var prNumber string
+	var users []string
+	for _, arg := range args {
+		switch {
+		case arg == "--me":
+			users = append(users, "@me")
+		case prNumber == "":
+			prNumber = arg
+		default:
+			user := strings.TrimPrefix(strings.TrimSpace(arg), "@")
+			if user == "" {
+				fatalError("Assignee names must not be empty", nil)
+			}
+			users = append(users, user)
 		}
 	}
-
-	if len(files) == 0 {
-		fmt.Println("\nNo code block found in response. Raw response:")
-		fmt.Println(response)
+	if prNumber == "" || len(users) == 0 {
+		fmt.Printf("Usage: gg pr %s <number> <user>... [--me]\n", verb)
 		return
 	}
 
-	// Get the edited content
-	var newContent string
-	for _, c := range files {
-		newContent = c
-		break
+	if err := ensureGitHubAuth(); err != nil {
+		return
 	}
 
-	// Show diff summary
-	oldLines := strings.Count(string(content), "\n")
-	newLines := strings.Count(newContent, "\n")
-	fmt.Printf("\nChanges: %d lines -> %d lines\n", oldLines, newLines)
-
-	// Confirm
-	fmt.Print("\nApply changes? [Y/n]: ")
-	reader := bufio.NewReader(os.Stdin)
-	confirm, _ := reader.ReadString('\n')
-	confirm = strings.TrimSpace(strings.ToLower(confirm))
-
-	if confirm != "" && confirm != "y" {
-		fmt.Println("Cancelled")
-		return
+	flag := "--add-assignee"
+	if remove {
+		flag = "--remove-assignee"
+	}
+	cmd := command("gh", "pr", "edit", prNumber, flag, strings.Join(users, ","))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalError(fmt.Sprintf("Failed to %s PR #%s", verb, prNumber), err)
 	}
 
-	// Write the file
-	if err := os.WriteFile(filePath, []byte(newContent), 0644); err != nil {
-		fatalError("Failed to write file", err)
+	if remove {
+		fmt.Printf("Unassigned %s from PR #%s\n", strings.Join(users, ", "), prNumber)
+	} else {
+		fmt.Printf("Assigned %s to PR #%s\n", strings.Join(users, ", "), prNumber)
 	}
+}
 
-	fmt.Printf("Updated: %s\n", filePath)
+// PRCheck is one CI check as reported by gh pr checks
+type PRCheck struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+	Link  string `json:"link"`
 }
 
-// ============================================================================
-// PROMPTS COMMAND
-// ============================================================================
+// checksPollInterval is how often --watch re-polls pending checks
+const checksPollInterval = 10 * time.Second
 
-func handlePrompts() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg prompts <command>")
-		fmt.Println()
-		fmt.Println("Commands:")
-		fmt.Println("  list               # List saved prompts")
-		fmt.Println("  add <name> \"...\"   # Save a prompt")
-		fmt.Println("  run <name>         # Run a saved prompt with gg ask")
-		fmt.Println("  delete <name>      # Delete a prompt")
-		fmt.Println()
-		fmt.Println("Examples:")
-		fmt.Println("  gg prompts add refactor \"refactor this code for clarity\"")
-		fmt.Println("  gg prompts run refactor")
+func handlePRChecks(args []string) {
+	var prNumber string
+	watch := false
+	for _, arg := range args {
+		if arg == "--watch" {
+			watch = true
+		} else {
+			prNumber = arg
+		}
+	}
+	if prNumber == "" {
+		fmt.Println("Usage: gg pr checks <number> [--watch]")
 		return
 	}
 
-	subCmd := os.Args[2]
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
 
-	switch subCmd {
-	case "list", "ls":
-		listPrompts()
-	case "add", "save":
-		if len(os.Args) < 5 {
-			fmt.Println("Usage: gg prompts add <name> \"prompt text\"")
-			return
+	for {
+		checks, err := fetchPRChecks(prNumber, false)
+		if err != nil {
+			fatalError("Failed to fetch checks", err)
 		}
-		name := os.Args[3]
-		promptText := strings.Join(os.Args[4:], " ")
-		savePrompt(name, promptText)
-	case "run", "use":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: gg prompts run <name>")
-			return
+		printPRChecks(checks)
+
+		_, failed, pending := checksRollup(checks)
+		if watch && pending > 0 {
+			fmt.Printf("\nWaiting for %d pending check(s)...\n\n", pending)
+			time.Sleep(checksPollInterval)
+			continue
 		}
-		usePrompt(os.Args[3])
-	case "delete", "rm":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: gg prompts delete <name>")
-			return
+		if failed > 0 {
+			os.Exit(1)
 		}
-		deletePrompt(os.Args[3])
-	default:
-		// Try to run it as a prompt name
-		usePrompt(subCmd)
-	}
-}
-
-func getPromptsDir() string {
-	return filepath.Join(getGGDir(), "prompts")
-}
-
-func listPrompts() {
-	promptsDir := getPromptsDir()
-	files, err := os.ReadDir(promptsDir)
-	if err != nil || len(files) == 0 {
-		fmt.Println("No saved prompts")
-		fmt.Println("Save one: gg prompts save <name> \"prompt text\"")
 		return
 	}
+}
 
-	fmt.Println("Saved prompts:")
-	for _, f := range files {
-		if strings.HasSuffix(f.Name(), ".txt") {
-			name := strings.TrimSuffix(f.Name(), ".txt")
-			content, _ := os.ReadFile(filepath.Join(promptsDir, f.Name()))
-			preview := string(content)
-			if len(preview) > 50 {
-				preview = preview[:50] + "..."
+// fetchPRChecks lists CI checks for a PR, only the required ones with
+// required. gh exits non-zero when checks are failing or pending, so the
+// exit status is only an error without output.
+func fetchPRChecks(prNumber string, required bool) ([]PRCheck, error) {
+	args := []string{"pr", "checks", prNumber, "--json", "name,state,link"}
+	if required {
+		args = append(args, "--required")
+	}
+	output, err := commandOutput("gh", args...)
+	if err != nil && len(bytes.TrimSpace(output)) == 0 {
+		// "no checks reported", or with --required "no required checks reported"
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			msg := string(exitErr.Stderr)
+			if strings.Contains(msg, "no checks") || strings.Contains(msg, "no required checks") {
+				return nil, nil
 			}
-			fmt.Printf("  - %s: %s\n", name, preview)
 		}
+		return nil, err
+	}
+	var checks []PRCheck
+	if err := json.Unmarshal(output, &checks); err != nil {
+		return nil, err
 	}
+	return checks, nil
 }
 
-func savePrompt(name, text string) {
-	promptsDir := getPromptsDir()
-	os.MkdirAll(promptsDir, 0755)
-
-	path := filepath.Join(promptsDir, name+".txt")
-	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
-		fatalError("Failed to save prompt", err)
+// checkBucket groups a gh check state into pass, fail, pending or skip
+func checkBucket(state string) string {
+	switch strings.ToUpper(state) {
+	case "SUCCESS", "PASS":
+		return "pass"
+	case "FAILURE", "FAIL", "ERROR", "CANCELLED", "TIMED_OUT", "ACTION_REQUIRED", "STARTUP_FAILURE":
+		return "fail"
+	case "SKIPPED", "NEUTRAL", "STALE":
+		return "skip"
+	default:
+		return "pending"
 	}
-	fmt.Printf("Saved prompt '%s'\n", name)
 }
 
-func usePrompt(name string) {
-	promptsDir := getPromptsDir()
-	path := filepath.Join(promptsDir, name+".txt")
+func checksRollup(checks []PRCheck) (passed, failed, pending int) {
+	for _, c := range checks {
+		switch checkBucket(c.State) {
+		case "pass":
+			passed++
+		case "fail":
+			failed++
+		case "pending":
+			pending++
+		}
+	}
+	return
+}
 
-	content, err := os.ReadFile(path)
-	if err != nil {
-		fmt.Printf("Prompt not found: %s\n", name)
-		fmt.Println("Run 'gg prompts list' to see saved prompts")
+func printPRChecks(checks []PRCheck) {
+	if len(checks) == 0 {
+		fmt.Println("No CI checks reported for this PR")
 		return
 	}
 
-	promptText := string(content)
-	fmt.Printf("Using prompt '%s': %s\n\n", name, promptText)
+	glyphs := map[string]string{"pass": "✓", "fail": "✗", "pending": "●", "skip": "-"}
+	width := 0
+	for _, c := range checks {
+		if len(c.Name) > width {
+			width = len(c.Name)
+		}
+	}
+	for _, c := range checks {
+		fmt.Printf("  %s %-*s  %-12s %s\n", glyphs[checkBucket(c.State)], width, c.Name, strings.ToLower(c.State), c.Link)
+	}
 
-	// Inject prompt into handleAsk by setting os.Args
-	os.Args = []string{"gg", "ask", promptText}
-	handleAsk()
+	passed, failed, pending := checksRollup(checks)
+	overall := "passing"
+	if failed > 0 {
+		overall = "failing"
+	} else if pending > 0 {
+		overall = "pending"
+	}
+	fmt.Printf("\nChecks %s: %d passed, %d failed, %d pending (%d total)\n", overall, passed, failed, pending, len(checks))
 }
 
-func deletePrompt(name string) {
-	promptsDir := getPromptsDir()
-	path := filepath.Join(promptsDir, name+".txt")
+// prTemplatePaths are where GitHub looks for a default PR template
+var prTemplatePaths = []string{
+	".github/pull_request_template.md",
+	".github/PULL_REQUEST_TEMPLATE.md",
+	"pull_request_template.md",
+	"PULL_REQUEST_TEMPLATE.md",
+	"docs/pull_request_template.md",
+	"docs/PULL_REQUEST_TEMPLATE.md",
+}
 
-	if err := os.Remove(path); err != nil {
-		fmt.Printf("Prompt not found: %s\n", name)
-		return
+// summaryHeadingRe matches the template section that describes the change
+var summaryHeadingRe = regexp.MustCompile(`(?im)^#{1,4}\s*(summary|description|what|changes|overview)\b.*$`)
+
+// findPRTemplate returns the repo's PR template, if any
+func findPRTemplate() string {
+	for _, path := range prTemplatePaths {
+		if data, err := os.ReadFile(path); err == nil {
+			return string(data)
+		}
 	}
-	fmt.Printf("Deleted prompt '%s'\n", name)
+	return ""
 }
 
-// ============================================================================
-// UTILITIES
-// ============================================================================
-
-func getCurrentRepo() string {
-	cmd := exec.Command("git", "remote", "get-url", "origin")
-	output, err := cmd.Output()
-	if err != nil {
-		return ""
+// buildPRBody places summary into the repo's PR template under its summary
+// heading (or at the top), falling back to summary alone
+func buildPRBody(summary string, ignoreTemplate bool) string {
+	if ignoreTemplate {
+		return summary
+	}
+	template := findPRTemplate()
+	if template == "" {
+		return summary
 	}
 
-	url := strings.TrimSpace(string(output))
-	return parseGitHubURL(url)
+	loc := summaryHeadingRe.FindStringIndex(template)
+	if loc == nil {
+		return summary + "\n\n" + template
+	}
+	return template[:loc[1]] + "\n\n" + summary + "\n" + template[loc[1]:]
 }
 
-func checkProTier(cfg *Config) bool {
-	return cfg.Secrets.ProLicenseKey != "" &&
-		strings.HasPrefix(cfg.Secrets.ProLicenseKey, "gg_pro_")
-}
+// handlePRCreate opens a PR for the current branch
+func handlePRCreate(args []string) {
+	var title, body string
+	ignoreTemplate := false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--title":
+			if i+1 < len(args) {
+				title = args[i+1]
+				i++
+			}
+		case "--body":
+			if i+1 < len(args) {
+				body = args[i+1]
+				i++
+			}
+		case "--ignore-template":
+			ignoreTemplate = true
+		default:
+			fmt.Printf("Unknown flag: %s\n", args[i])
+			return
+		}
+	}
 
-// handleUpgrade starts the Pro upgrade flow
-func handleUpgrade() {
-	fmt.Println("gg Pro — $15/month")
-	fmt.Println()
-	fmt.Println("Benefits:")
-	fmt.Println("  - Unlimited gg ask (code generation)")
-	fmt.Println("  - Unlimited CLI2CLI (a2a) calls")
-	fmt.Println("  - Priority API routing")
-	fmt.Println("  - Support development")
-	fmt.Println()
+	if err := ensureGitHubAuth(); err != nil {
+		return
+	}
+
+	branch := getCurrentBranch()
+	if branch == "" {
+		fatalError("Not on a branch", nil)
+	}
+
+	// Default to the latest commit's subject and body
+	if title == "" {
+		output, _ := commandOutput("git", "log", "-1", "--format=%s")
+		title = strings.TrimSpace(string(output))
+	}
+	if body == "" {
+		output, _ := commandOutput("git", "log", "-1", "--format=%b")
+		body = strings.TrimSpace(string(output))
+	}
 
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter your email: ")
-	email, _ := reader.ReadString('\n')
-	email = strings.TrimSpace(email)
+	runCommand("git", "push", "-u", "origin", branch)
 
-	if email == "" || !strings.Contains(email, "@") {
-		fmt.Println("Invalid email")
-		return
+	output, err := commandOutput("gh", "pr", "create", "--title", title, "--body", buildPRBody(body, ignoreTemplate))
+	if err != nil {
+		fatalError("Failed to create PR", err)
 	}
+	fmt.Printf("PR created: %s\n", strings.TrimSpace(string(output)))
+}
 
-	// Create checkout session
-	fmt.Println()
-	fmt.Println("Creating checkout session...")
+// maxTemplateDiffBytes caps how much of a template PR diff is sent to the model
+const maxTemplateDiffBytes = 60 * 1024
 
-	reqBody, _ := json.Marshal(map[string]string{"email": email})
-	resp, err := http.Post(getBackendURL()+"/checkout", "application/json", bytes.NewReader(reqBody))
+// fetchPRDiff returns the unified diff of a PR via gh, capped in size
+func fetchPRDiff(prNumber string) (string, error) {
+	output, err := commandOutput("gh", "pr", "diff", prNumber)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		fmt.Println("Try: https://ggdotdev.com/pro")
-		return
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
+	diff := string(output)
+	if len(diff) > maxTemplateDiffBytes {
+		diff = diff[:maxTemplateDiffBytes] + "\n... (diff truncated)"
+	}
+	return diff, nil
+}
 
-	if errMsg, ok := result["error"].(string); ok {
-		if licenseKey, hasKey := result["license_key"].(string); hasKey {
-			fmt.Printf("Already subscribed! Your license key: %s\n", licenseKey)
-			fmt.Println()
-			fmt.Println("Add to ~/.gg/config.toml:")
-			fmt.Printf("  pro_license_key = \"%s\"\n", licenseKey)
+func handleRun() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: gg run [options] <command>")
+		fmt.Println()
+		fmt.Println("Options:")
+		fmt.Println("  --json-stream   Emit NDJSON events as output arrives")
+		fmt.Println("  --tee-stats     Record CPU time and max RSS")
+		fmt.Println("  --exec          Run argv directly, without sh -c (no re-splitting/globbing)")
+		fmt.Println("  --stdin-file <path>  Feed a file to the command's stdin")
+		fmt.Println("  --stdin -       Pass gg's own stdin through to the command")
+		fmt.Println("  --label <name>  Tag the run for gg stats --by-label")
+		fmt.Println("  --timeout <d>   Kill the command (and its children) after d, e.g. 30s")
+		fmt.Println("  --timeout-signal <TERM|INT|KILL|HUP>  Signal sent on timeout (default TERM, KILL after 5s)")
+		fmt.Println("  --capture       Collect output and print the first/last lines instead of streaming")
+		fmt.Println("  --json          Print one JSON object with the exit code and captured output")
+		fmt.Println("                  (also gg --json run ..., or GG_JSON=1)")
+		fmt.Println()
+		fmt.Println("Example: gg run npm test")
+		fmt.Println("         gg run --stdin-file data.json \"jq .\"")
+		return
+	}
+
+	// Leading flags belong to gg; everything after is the command
+	cmdArgs := os.Args[2:]
+	jsonStream := false
+	teeStats := false
+	execMode := false
+	label := ""
+	stdinPath := ""
+	var timeout time.Duration
+	timeoutSignal := ""
+	capture := false
+flags:
+	for len(cmdArgs) > 0 && strings.HasPrefix(cmdArgs[0], "--") {
+		switch cmdArgs[0] {
+		case "--label":
+			if len(cmdArgs) < 2 || strings.TrimSpace(cmdArgs[1]) == "" {
+				fmt.Println("--label requires a name")
+				return
+			}
+			label = strings.TrimSpace(cmdArgs[1])
+			cmdArgs = cmdArgs[1:]
+		case "--stdin-file", "--stdin":
+			if len(cmdArgs) < 2 {
+				fmt.Printf("%s requires a value\n", cmdArgs[0])
+				return
+			}
+			stdinPath = cmdArgs[1]
+			if cmdArgs[0] == "--stdin" && stdinPath != "-" {
+				fmt.Println("--stdin only accepts - (use --stdin-file <path> for files)")
+				return
+			}
+			cmdArgs = cmdArgs[1:]
+		case "--timeout":
+			if len(cmdArgs) < 2 {
+				fmt.Println("--timeout requires a duration (e.g. 30s)")
+				return
+			}
+			d, err := time.ParseDuration(cmdArgs[1])
+			if err != nil || d <= 0 {
+				fmt.Printf("Invalid --timeout %q (e.g. 30s, 5m)\n", cmdArgs[1])
+				return
+			}
+			timeout = d
+			cmdArgs = cmdArgs[1:]
+		case "--timeout-signal":
+			if len(cmdArgs) < 2 {
+				fmt.Println("--timeout-signal requires TERM, INT, KILL or HUP")
+				return
+			}
+			timeoutSignal = cmdArgs[1]
+			cmdArgs = cmdArgs[1:]
+		case "--capture":
+			capture = true
+		case "--json-stream":
+			jsonStream = true
+		case "--json":
+			jsonOutput = true
+		case "--tee-stats":
+			teeStats = true
+		case "--exec":
+			execMode = true
+		case "--":
+			cmdArgs = cmdArgs[1:]
+			break flags
+		default:
+			fmt.Printf("Unknown run flag: %s\n", cmdArgs[0])
 			return
 		}
-		fmt.Printf("Error: %s\n", errMsg)
+		cmdArgs = cmdArgs[1:]
+	}
+	if len(cmdArgs) == 0 {
+		fmt.Println("No command provided")
 		return
 	}
+	cmdStr := strings.Join(cmdArgs, " ")
+	if execMode {
+		// Show exact argument boundaries
+		quoted := make([]string, len(cmdArgs))
+		for i, arg := range cmdArgs {
+			quoted[i] = arg
+			if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$*?") {
+				quoted[i] = strconv.Quote(arg)
+			}
+		}
+		cmdStr = strings.Join(quoted, " ")
+	}
 
-	if checkoutURL, ok := result["checkout_url"].(string); ok {
-		fmt.Println()
-		fmt.Println("Opening checkout...")
-		fmt.Println(checkoutURL)
-		fmt.Println()
-		fmt.Println("After payment, run: gg pro --activate")
-
-		// Try to open browser
-		exec.Command("open", checkoutURL).Start()
-		exec.Command("xdg-open", checkoutURL).Start()
+	// Wire stdin; left unset the command reads an empty stdin
+	var stdin io.Reader
+	if stdinPath == "-" {
+		stdin = os.Stdin
+	} else if stdinPath != "" {
+		f, err := os.Open(stdinPath)
+		if err != nil {
+			fatalError("Cannot open stdin file", err)
+		}
+		defer f.Close()
+		stdin = f
 	}
-}
 
-// handlePro shows Pro status or activates license
-func handlePro() {
-	cfg, err := loadConfig()
+	if timeoutSignal == "" {
+		timeoutSignal = loadPlainConfig().Run.TimeoutSignal
+	}
+	sig, err := parseTimeoutSignal(timeoutSignal)
 	if err != nil {
-		fmt.Println("Run 'gg init' first")
+		fmt.Println(err)
 		return
 	}
 
-	// Check for --activate flag
-	if len(os.Args) > 2 && os.Args[2] == "--activate" {
-		activateProLicense(cfg)
-		return
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	// Check for --portal flag (manage subscription)
-	if len(os.Args) > 2 && os.Args[2] == "--portal" {
-		openCustomerPortal(cfg)
+	if jsonStream {
+		cmd := buildRunCommand(ctx, cmdArgs, execMode, sig)
+		cmd.Stdin = stdin
+		runJSONStream(ctx, cmd, cmdStr, runOptions{TeeStats: teeStats, Label: label, Exec: execMode})
+		return
+	}
+	if jsonOutput {
+		cmd := buildRunCommand(ctx, cmdArgs, execMode, sig)
+		cmd.Stdin = stdin
+		runJSON(ctx, cmd, cmdStr, runOptions{TeeStats: teeStats, Label: label, Exec: execMode})
 		return
 	}
 
-	// Show current status
-	fmt.Println("gg Pro Status")
+	fmt.Printf("Running: %s\n", cmdStr)
 	fmt.Println()
 
-	if checkProTier(cfg) {
-		fmt.Println("Status: Active")
-		fmt.Printf("License: %s...%s\n",
-			cfg.Secrets.ProLicenseKey[:12],
-			cfg.Secrets.ProLicenseKey[len(cfg.Secrets.ProLicenseKey)-4:])
-		fmt.Println()
-		fmt.Println("Commands:")
-		fmt.Println("  gg pro --portal    Manage subscription")
+	// Execute command, streaming or capturing its output
+	cmd := buildRunCommand(ctx, cmdArgs, execMode, sig)
+	cmd.Stdin = stdin
+	var stdoutCap, stderrCap lineCapture
+	if capture {
+		cmd.Stdout = &stdoutCap
+		cmd.Stderr = &stderrCap
 	} else {
-		fmt.Println("Status: Free tier")
-		fmt.Println()
-		allowed, inGrace, remaining := checkA2ALimit(cfg)
-		if !allowed {
-			fmt.Println("Daily limit: Reached")
-		} else if inGrace {
-			fmt.Println("Daily limit: In grace period")
-		} else {
-			fmt.Printf("Daily limit: %d remaining\n", remaining)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	start := time.Now()
+	err = cmd.Run()
+	elapsed := time.Since(start)
+
+	if capture {
+		stdoutCap.print("stdout")
+		stderrCap.print("stderr")
+	}
+
+	fmt.Println()
+	result := classifyRunResult(err, cmd.ProcessState, !execMode)
+	result.TimedOut = ctx.Err() == context.DeadlineExceeded
+	switch {
+	case result.TimedOut:
+		fmt.Printf("Timed out after %s; sent SIG%s (%.2fs)\n", timeout, sig, elapsed.Seconds())
+	case result.Error != "":
+		fmt.Printf("Failed: %s (%.2fs)\n", result.Error, elapsed.Seconds())
+	case result.Signal != "":
+		fmt.Printf("Killed by %s (%.2fs)\n", result.Signal, elapsed.Seconds())
+	case *result.ExitCode != 0:
+		fmt.Printf("Exit code: %d (%.2fs)\n", *result.ExitCode, elapsed.Seconds())
+	default:
+		fmt.Printf("Success (%.2fs)\n", elapsed.Seconds())
+	}
+
+	if teeStats && cmd.ProcessState != nil {
+		cpu := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		rss := maxRSSKB(cmd.ProcessState)
+		fmt.Printf("CPU: %.2fs (user %.2fs, sys %.2fs)",
+			cpu.Seconds(), cmd.ProcessState.UserTime().Seconds(), cmd.ProcessState.SystemTime().Seconds())
+		if rss > 0 {
+			fmt.Printf(", max RSS: %s", formatSize(rss*1024))
 		}
 		fmt.Println()
-		fmt.Println("Upgrade: gg upgrade")
+		trackRunResources(cpu, rss)
+	}
+
+	// Track usage
+	trackCommandUsage(runUsageType(result), cmdStr, elapsed)
+	if label != "" {
+		trackRunLabel(label, elapsed)
 	}
 }
 
-// activateProLicense fetches and saves the license key after payment
-func activateProLicense(cfg *Config) {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter email used for purchase: ")
-	email, _ := reader.ReadString('\n')
-	email = strings.TrimSpace(email)
+// runUsageType is the trackCommandUsage type for a finished run
+func runUsageType(result RunResult) string {
+	if result.TimedOut {
+		return "run-timeout"
+	}
+	return "run"
+}
 
-	if email == "" {
-		fmt.Println("Email required")
-		return
+// timeoutSignalNames are the --timeout-signal / [run] timeout_signal values
+var timeoutSignalNames = []string{"TERM", "INT", "KILL", "HUP"}
+
+// runKillGrace is how long a timed-out command gets to exit after its
+// timeout signal before being sent KILL
+const runKillGrace = 5 * time.Second
+
+// parseTimeoutSignal normalizes a signal name ("term", "SIGTERM" -> "TERM"),
+// defaulting to TERM
+func parseTimeoutSignal(name string) (string, error) {
+	if name == "" {
+		return "TERM", nil
+	}
+	sig := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	if !slices.Contains(timeoutSignalNames, sig) {
+		return "", fmt.Errorf("invalid timeout signal %q (use %s)", name, strings.Join(timeoutSignalNames, ", "))
 	}
+	return sig, nil
+}
 
-	fmt.Println("Checking for license...")
+// buildRunCommand returns the command for gg run: through sh -c by default,
+// or the argv as given in exec mode. When ctx has a deadline the whole
+// process group is sent sig on expiry.
+func buildRunCommand(ctx context.Context, cmdArgs []string, execMode bool, sig string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if execMode {
+		cmd = exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", strings.Join(cmdArgs, " "))
+	}
+	if _, ok := ctx.Deadline(); ok {
+		killGroupOnCancel(cmd, sig, runKillGrace)
+		// Don't wait forever on pipes held open by stray grandchildren
+		cmd.WaitDelay = runKillGrace + 2*time.Second
+	}
+	return cmd
+}
 
-	resp, err := http.Get(getBackendURL() + "/license?email=" + email)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+// runCaptureLines is how many leading and trailing lines gg run --capture
+// prints per stream
+const runCaptureLines = 10
+
+// lineCapture is an io.Writer that keeps only the first and last
+// runCaptureLines lines written to it, counting the rest
+type lineCapture struct {
+	head    []string
+	tail    []string
+	total   int
+	partial []byte
+}
+
+func (c *lineCapture) Write(p []byte) (int, error) {
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		c.addLine(string(c.partial[:i]))
+		c.partial = c.partial[i+1:]
 	}
-	defer resp.Body.Close()
+	// Bound memory for output without newlines
+	if len(c.partial) > 64*1024 {
+		c.addLine(string(c.partial))
+		c.partial = nil
+	}
+	return len(p), nil
+}
 
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
+func (c *lineCapture) addLine(line string) {
+	c.total++
+	if len(c.head) < runCaptureLines {
+		c.head = append(c.head, line)
+		return
+	}
+	c.tail = append(c.tail, line)
+	if len(c.tail) > runCaptureLines {
+		c.tail = c.tail[1:]
+	}
+}
 
-	if errMsg, ok := result["error"].(string); ok {
-		fmt.Printf("Error: %s\n", errMsg)
-		fmt.Println()
-		fmt.Println("If you just purchased, wait a moment and try again.")
-		fmt.Println("Or open an issue: github.com/cyclecore-dev/gg/issues")
+// print shows the captured lines under a name header, eliding the middle
+func (c *lineCapture) print(name string) {
+	if len(c.partial) > 0 {
+		c.addLine(string(c.partial))
+		c.partial = nil
+	}
+	if c.total == 0 {
 		return
 	}
+	fmt.Printf("%s (%d lines):\n", name, c.total)
+	for _, line := range c.head {
+		fmt.Printf("  %s\n", line)
+	}
+	if omitted := c.total - len(c.head) - len(c.tail); omitted > 0 {
+		fmt.Printf("  ... %d lines omitted ...\n", omitted)
+	}
+	for _, line := range c.tail {
+		fmt.Printf("  %s\n", line)
+	}
+}
 
-	if licenseKey, ok := result["license_key"].(string); ok {
-		// Save license key to config
-		cfg.Secrets.ProLicenseKey = licenseKey
-		cfg.GG.Tier = "pro"
+// runOptions are the gg run flags that shape execution and reporting
+type runOptions struct {
+	TeeStats bool
+	Label    string
+	Exec     bool // argv run directly, not via sh -c
+}
 
-		// Save config and secrets
-		homeDir, _ := os.UserHomeDir()
-		ggDir := filepath.Join(homeDir, ".gg")
-		configPath := filepath.Join(ggDir, "config.toml")
+// RunResult is the final gg run event. Exactly one of ExitCode (normal
+// exit), Signal (killed) or Error (could not launch) describes the outcome;
+// a shell's 126/127 is reported as Error alongside its exit code. TimedOut
+// marks a run killed by --timeout.
+type RunResult struct {
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	Signal     string `json:"signal,omitempty"`
+	Error      string `json:"error,omitempty"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	CPUMS      int64  `json:"cpu_ms,omitempty"`
+	MaxRSSKB   int64  `json:"max_rss_kb,omitempty"`
+}
 
-		f, err := os.Create(configPath)
+// classifyRunResult turns the result of running a command into a RunResult.
+// viaShell reports sh -c execution, where launch failures surface as 126/127.
+func classifyRunResult(err error, ps *os.ProcessState, viaShell bool) RunResult {
+	if ps == nil {
+		msg := "failed to start"
 		if err != nil {
-			fmt.Printf("Failed to save config: %v\n", err)
-			fmt.Printf("Manually add to ~/.gg/config.toml:\n")
-			fmt.Printf("  pro_license_key = \"%s\"\n", licenseKey)
-			return
-		}
-		defer f.Close()
-
-		if err := toml.NewEncoder(f).Encode(cfg); err != nil {
-			fmt.Printf("Failed to write config: %v\n", err)
-			return
+			msg = err.Error()
 		}
+		return RunResult{Error: msg}
+	}
+	if sig := exitSignal(ps); sig != "" {
+		return RunResult{Signal: sig}
+	}
 
-		// Re-encrypt secrets with new license key
-		keyPath := filepath.Join(ggDir, ".key")
-		keyData, err := os.ReadFile(keyPath)
-		if err == nil {
-			identity, err := age.ParseX25519Identity(string(keyData))
-			if err == nil {
-				secretsPath := filepath.Join(ggDir, "secrets")
-				encryptSecrets(cfg.Secrets, identity, secretsPath)
-			}
+	code := ps.ExitCode()
+	result := RunResult{ExitCode: &code}
+	if viaShell {
+		switch code {
+		case 126:
+			result.Error = "command not executable (permission denied)"
+		case 127:
+			result.Error = "command not found"
 		}
-
-		fmt.Println()
-		fmt.Println("Pro activated!")
-		fmt.Printf("License: %s\n", licenseKey)
-		fmt.Println()
-		fmt.Println("You now have unlimited access to:")
-		fmt.Println("  - gg ask")
-		fmt.Println("  - gg a2a")
-		fmt.Println()
-		fmt.Println("Thank you for supporting gg!")
 	}
+	return result
 }
 
-// openCustomerPortal opens Stripe billing portal
-func openCustomerPortal(cfg *Config) {
-	if !checkProTier(cfg) {
-		fmt.Println("No active subscription")
-		fmt.Println("Run: gg upgrade")
-		return
+// runJSONStream runs cmd and emits one JSON object per output line,
+// followed by a final RunResult event
+func runJSONStream(ctx context.Context, cmd *exec.Cmd, cmdStr string, opts runOptions) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	emit := func(v interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(v)
 	}
 
-	fmt.Println("Opening billing portal...")
-
-	reqBody, _ := json.Marshal(map[string]string{
-		"license_key": cfg.Secrets.ProLicenseKey,
-	})
-	resp, err := http.Post(getBackendURL()+"/portal", "application/json", bytes.NewReader(reqBody))
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		emit(RunResult{Error: err.Error()})
 		return
 	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&result)
-
-	if portalURL, ok := result["portal_url"].(string); ok {
-		fmt.Println(portalURL)
-		exec.Command("open", portalURL).Start()
-		exec.Command("xdg-open", portalURL).Start()
-	} else if errMsg, ok := result["error"].(string); ok {
-		fmt.Printf("Error: %s\n", errMsg)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		emit(RunResult{Error: err.Error()})
+		return
 	}
-}
 
-// A2A rate limiting for free tier
-const a2aFreeLimit = 10 // soft limit per day
-const a2aGraceLimit = 2 // extra grace calls
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		emit(classifyRunResult(err, nil, !opts.Exec))
+		return
+	}
 
-type A2AUsage struct {
-	Date  string `json:"date"`
-	Count int    `json:"count"`
-}
+	var wg sync.WaitGroup
+	pump := func(name string, r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			emit(struct {
+				Stream string `json:"stream"`
+				Line   string `json:"line"`
+			}{name, scanner.Text()})
+		}
+	}
+	wg.Add(2)
+	go pump("stdout", stdout)
+	go pump("stderr", stderr)
+	wg.Wait()
 
-func getA2AUsagePath() string {
-	return filepath.Join(getGGDir(), "a2a_usage.json")
-}
+	err = cmd.Wait()
+	elapsed := time.Since(start)
 
-// Returns: (allowed, inGrace, remaining)
-func checkA2ALimit(cfg *Config) (bool, bool, int) {
-	// Pro users have unlimited access
-	if checkProTier(cfg) {
-		return true, false, -1
+	final := classifyRunResult(err, cmd.ProcessState, !opts.Exec)
+	final.TimedOut = ctx.Err() == context.DeadlineExceeded
+	final.DurationMS = elapsed.Milliseconds()
+	if opts.TeeStats && cmd.ProcessState != nil {
+		cpu := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		final.CPUMS = cpu.Milliseconds()
+		final.MaxRSSKB = maxRSSKB(cmd.ProcessState)
+		trackRunResources(cpu, final.MaxRSSKB)
 	}
+	emit(final)
 
-	// Load usage
-	usagePath := getA2AUsagePath()
-	today := time.Now().Format("2006-01-02")
-
-	var usage A2AUsage
-	data, err := os.ReadFile(usagePath)
-	if err == nil {
-		json.Unmarshal(data, &usage)
+	trackCommandUsage(runUsageType(final), cmdStr, elapsed)
+	if opts.Label != "" {
+		trackRunLabel(opts.Label, elapsed)
 	}
+}
 
-	// Reset if new day
-	if usage.Date != today {
-		usage = A2AUsage{Date: today, Count: 0}
+// runJSONMaxOutput caps how much of each stream gg run --json keeps
+const runJSONMaxOutput = 1024 * 1024
+
+// cappedBuffer is an io.Writer that keeps the first limit bytes written
+// to it and notes whether anything was dropped
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.buf.Len(); room < len(p) {
+		c.buf.Write(p[:max(room, 0)])
+		c.truncated = true
+	} else {
+		c.buf.Write(p)
 	}
+	return len(p), nil
+}
 
-	hardLimit := a2aFreeLimit + a2aGraceLimit
-	remaining := a2aFreeLimit - usage.Count
-	inGrace := usage.Count >= a2aFreeLimit && usage.Count < hardLimit
+// RunJSONResult is the document printed by gg run --json
+type RunJSONResult struct {
+	Command string `json:"command"`
+	RunResult
+	Stdout          string `json:"stdout"`
+	Stderr          string `json:"stderr"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
 
-	return usage.Count < hardLimit, inGrace, remaining
+// runJSON runs cmd with its output captured and prints a single
+// RunJSONResult to stdout
+func runJSON(ctx context.Context, cmd *exec.Cmd, cmdStr string, opts runOptions) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.Encode(captureRun(ctx, cmd, cmdStr, opts))
 }
 
-func incrementA2AUsage() {
-	usagePath := getA2AUsagePath()
-	today := time.Now().Format("2006-01-02")
+// captureRun runs cmd with its output captured, records usage and returns
+// the result gg run --json reports
+func captureRun(ctx context.Context, cmd *exec.Cmd, cmdStr string, opts runOptions) RunJSONResult {
+	stdout := &cappedBuffer{limit: runJSONMaxOutput}
+	stderr := &cappedBuffer{limit: runJSONMaxOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
-	var usage A2AUsage
-	data, err := os.ReadFile(usagePath)
-	if err == nil {
-		json.Unmarshal(data, &usage)
-	}
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
 
-	if usage.Date != today {
-		usage = A2AUsage{Date: today, Count: 0}
+	result := classifyRunResult(err, cmd.ProcessState, !opts.Exec)
+	result.TimedOut = ctx.Err() == context.DeadlineExceeded
+	result.DurationMS = elapsed.Milliseconds()
+	if opts.TeeStats && cmd.ProcessState != nil {
+		cpu := cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+		result.CPUMS = cpu.Milliseconds()
+		result.MaxRSSKB = maxRSSKB(cmd.ProcessState)
+		trackRunResources(cpu, result.MaxRSSKB)
 	}
 
-	usage.Count++
-	newData, _ := json.Marshal(usage)
-	os.WriteFile(usagePath, newData, 0644)
+	trackCommandUsage(runUsageType(result), cmdStr, elapsed)
+	if opts.Label != "" {
+		trackRunLabel(opts.Label, elapsed)
+	}
+	return RunJSONResult{
+		Command:         cmdStr,
+		RunResult:       result,
+		Stdout:          stdout.buf.String(),
+		Stderr:          stderr.buf.String(),
+		StdoutTruncated: stdout.truncated,
+		StderrTruncated: stderr.truncated,
+	}
 }
 
-func parseCodeBlocks(response string) map[string]string {
-	files := make(map[string]string)
-
-	// Match ```language:path/to/file
-	re := regexp.MustCompile("```[a-z]*:([^\n]+)\n([\\s\\S]*?)```")
-	matches := re.FindAllStringSubmatch(response, -1)
+func handleStats() {
+	byLabel := false
+	month := time.Now().Format("2006-01")
+	if len(os.Args) > 2 {
+		switch os.Args[2] {
+		case "top":
+			showStatsTop()
+			return
+		case "reset":
+			resetStats(os.Args[3:])
+			return
+		case "export":
+			exportStats(os.Args[3:])
+			return
+		case "--by-label", "--per-command":
+			byLabel = true
+		case "--month":
+			if len(os.Args) < 4 {
+				fmt.Println("Usage: gg stats --month <YYYY-MM>")
+				if months := statsMonths(); len(months) > 0 {
+					fmt.Printf("Recorded months: %s\n", strings.Join(months, ", "))
+				}
+				return
+			}
+			if _, err := time.Parse("2006-01", os.Args[3]); err != nil {
+				fmt.Printf("Invalid month %q (use YYYY-MM)\n", os.Args[3])
+				return
+			}
+			month = os.Args[3]
+			byLabel = len(os.Args) > 4 && (os.Args[4] == "--by-label" || os.Args[4] == "--per-command")
+		case "--estimate":
+			estimateAskCost(os.Args[3:])
+			return
+		default:
+			fmt.Printf("Unknown stats command: %s\n", os.Args[2])
+			fmt.Println("Usage: gg stats [top|reset|export|--month YYYY-MM|--by-label|--estimate \"<prompt>\"]")
+			return
+		}
+	}
 
-	for _, match := range matches {
-		if len(match) >= 3 {
-			path := strings.TrimSpace(match[1])
-			content := match[2]
-			files[path] = content
+	stats, ok := loadMonthStats(month)
+	if !ok {
+		fmt.Println("Usage Statistics")
+		fmt.Println()
+		fmt.Printf("No usage data for %s.\n", month)
+		if months := statsMonths(); len(months) > 0 {
+			fmt.Printf("Recorded months: %s\n", strings.Join(months, ", "))
+		} else {
+			fmt.Println("Run some commands first!")
 		}
+		return
 	}
 
-	return files
-}
+	fmt.Println("Usage Statistics")
+	fmt.Println()
+	fmt.Printf("Month: %s\n", stats.Month)
+	fmt.Printf("Total asks: %d\n", stats.AskCount)
+	if stats.RunTimeouts > 0 {
+		fmt.Printf("Total runs: %d (%d timed out)\n", stats.RunCount, stats.RunTimeouts)
+	} else {
+		fmt.Printf("Total runs: %d\n", stats.RunCount)
+	}
+	fmt.Printf("Total tokens: %d (input: %d, output: %d)\n", stats.TotalTokens, stats.InputTokens, stats.OutputTokens)
+	fmt.Printf("Estimated cost: $%.4f\n", stats.EstimatedCost)
+	if stats.RunCPUSeconds > 0 || stats.RunMaxRSSKB > 0 {
+		fmt.Printf("Run CPU time: %.2fs (peak RSS: %s)\n", stats.RunCPUSeconds, formatSize(stats.RunMaxRSSKB*1024))
+	}
 
-func truncate(s string, max int) string {
-	if len(s) <= max {
-		return s
+	if byLabel {
+		fmt.Println()
+		if len(stats.RunLabels) == 0 {
+			fmt.Println("No labeled runs yet. Tag runs with: gg run --label <name> <cmd>")
+			return
+		}
+		labels := make([]string, 0, len(stats.RunLabels))
+		for l := range stats.RunLabels {
+			labels = append(labels, l)
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return stats.RunLabels[labels[i]].Seconds > stats.RunLabels[labels[j]].Seconds
+		})
+		fmt.Println("Runs by label:")
+		for _, l := range labels {
+			ls := stats.RunLabels[l]
+			fmt.Printf("  %-16s %4d runs  %9.2fs total  %7.2fs avg\n", l, ls.Runs, ls.Seconds, ls.Seconds/float64(ls.Runs))
+		}
 	}
-	return s[:max] + "..."
 }
 
-func sanitizeError(err error) error {
-	msg := err.Error()
-	// Sanitize various API key formats
-	msg = regexp.MustCompile(`sk-ant-[a-zA-Z0-9-]+`).ReplaceAllString(msg, "sk-***")
-	msg = regexp.MustCompile(`sk-[a-zA-Z0-9]+`).ReplaceAllString(msg, "sk-***")
-	msg = regexp.MustCompile(`mcpb_[a-zA-Z0-9]+`).ReplaceAllString(msg, "mcpb_***")
-	msg = regexp.MustCompile(`gg_pro_[a-zA-Z0-9]+`).ReplaceAllString(msg, "gg_pro_***")
-	return fmt.Errorf("%s", msg)
+// askMaxTokens is the max_tokens gg ask requests from the model
+const askMaxTokens = 4096
+
+// modelPricing is USD per million input/output tokens, matched by model
+// ID prefix (longest first). Unknown models fall back to Sonnet pricing.
+var modelPricing = []struct {
+	Prefix string
+	Input  float64
+	Output float64
+}{
+	{"claude-3-5-haiku", 0.80, 4},
+	{"claude-haiku-4", 1, 5},
+	{"claude-sonnet-4", 3, 15},
+	{"claude-opus-4", 15, 75},
+	{"gpt-4o-mini", 0.15, 0.60},
+	{"gpt-4o", 2.50, 10},
+	{"gpt-4-turbo", 10, 30},
 }
 
-func fatalError(msg string, err error) {
-	fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "  %v\n", err)
+// priceForModel returns per-million-token prices for model; local
+// providers are free
+func priceForModel(provider, model string) (input, output float64) {
+	if provider == ProviderOllama {
+		return 0, 0
 	}
-	os.Exit(1)
-}
-
-func getHomeDir() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return os.Getenv("HOME")
+	for _, p := range modelPricing {
+		if strings.HasPrefix(model, p.Prefix) {
+			return p.Input, p.Output
+		}
 	}
-	return homeDir
+	return 3, 15
 }
 
-func getGGDir() string {
-	return filepath.Join(getHomeDir(), ".gg")
+// estimateTokens approximates the token count of text (~4 chars/token)
+func estimateTokens(text string) int64 {
+	return int64((len(text) + 3) / 4)
 }
 
-// ============================================================================
-// PR, RUN, STATS
-// ============================================================================
-
-func handlePR() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg pr <number>")
-		return
+// estimateAskCost handles gg stats --estimate "<prompt>" [--context a,b]
+func estimateAskCost(args []string) {
+	var prompt string
+	var contextPaths []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--context" && i+1 < len(args) {
+			for _, path := range strings.Split(args[i+1], ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					contextPaths = append(contextPaths, path)
+				}
+			}
+			i++
+			continue
+		}
+		prompt = args[i]
 	}
-
-	prNumber := os.Args[2]
-	if err := ensureGitHubAuth(); err != nil {
+	if prompt == "" {
+		fmt.Println("Usage: gg stats --estimate \"<prompt>\" [--context path1,path2]")
 		return
 	}
 
-	repoName := getCurrentRepo()
-	if repoName == "" {
-		fatalError("Not in a git repository", nil)
-	}
+	cfg := loadPlainConfig()
+	provider, model, _, _ := getEffectiveConfig(cfg)
 
-	// Fetch PR details
-	cmd := exec.Command("gh", "pr", "view", prNumber, "--json", "number,title,author,state,body,additions,deletions,changedFiles,headRefName,baseRefName,url")
-	output, err := cmd.Output()
-	if err != nil {
-		fatalError("Failed to fetch PR", err)
+	var contextBytes int64
+	for _, path := range contextPaths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("Warning: cannot read %s\n", path)
+			continue
+		}
+		contextBytes += info.Size()
 	}
-
-	var pr struct {
-		Number       int    `json:"number"`
-		Title        string `json:"title"`
-		Author       struct{ Login string } `json:"author"`
-		State        string `json:"state"`
-		Body         string `json:"body"`
-		Additions    int    `json:"additions"`
-		Deletions    int    `json:"deletions"`
-		ChangedFiles int    `json:"changedFiles"`
-		HeadRefName  string `json:"headRefName"`
-		BaseRefName  string `json:"baseRefName"`
-		URL          string `json:"url"`
+	if contextBytes > maxContextBytes {
+		fmt.Printf("Note: context is %s; gg ask caps it at %s\n", formatSize(contextBytes), formatSize(maxContextBytes))
+		contextBytes = maxContextBytes
 	}
 
-	if err := json.Unmarshal(output, &pr); err != nil {
-		fatalError("Failed to parse PR data", err)
-	}
+	inputTokens := estimateTokens(askSystemPrompt(getCurrentRepo(), false)+prompt) + (contextBytes+3)/4
+	inPrice, outPrice := priceForModel(provider, model)
+	inCost := float64(inputTokens) / 1000000 * inPrice
+	outCost := float64(askMaxTokens) / 1000000 * outPrice
 
-	fmt.Printf("PR #%d: %s\n", pr.Number, pr.Title)
-	fmt.Printf("Author: %s | State: %s\n", pr.Author.Login, pr.State)
-	fmt.Printf("Branch: %s -> %s\n", pr.HeadRefName, pr.BaseRefName)
-	fmt.Printf("Changes: +%d -%d (%d files)\n", pr.Additions, pr.Deletions, pr.ChangedFiles)
+	fmt.Println("Cost estimate (rough: ~4 characters per token)")
 	fmt.Println()
-
-	if pr.Body != "" {
-		fmt.Println("Description:")
-		fmt.Println(truncate(pr.Body, 500))
-		fmt.Println()
+	fmt.Printf("Model:         %s (%s)\n", model, provider)
+	fmt.Printf("Input tokens:  ~%d", inputTokens)
+	if contextBytes > 0 {
+		fmt.Printf(" (incl. %s of context)", formatSize(contextBytes))
 	}
-
-	fmt.Printf("URL: %s\n", pr.URL)
 	fmt.Println()
+	fmt.Printf("Output tokens: up to %d\n", askMaxTokens)
+	fmt.Printf("Pricing:       $%.2f / $%.2f per 1M tokens (in/out)\n", inPrice, outPrice)
+	fmt.Println()
+	fmt.Printf("Estimated cost: $%.4f input + up to $%.4f output = up to $%.4f\n", inCost, outCost, inCost+outCost)
+}
 
-	// Show action menu
-	if pr.State == "OPEN" {
-		fmt.Println("Actions:")
-		fmt.Println("  [a]pprove - Merge this PR")
-		fmt.Println("  [d]iff   - Show full diff")
-		fmt.Println("  [c]lose  - Close without merging")
-		fmt.Println("  [q]uit   - Exit")
-		fmt.Print("\nChoice: ")
+// showStatsTop lists the most frequent asks and run commands this month
+func showStatsTop() {
+	limit := 10
+	for i := 3; i < len(os.Args)-1; i++ {
+		if os.Args[i] == "--limit" {
+			if n, err := strconv.Atoi(os.Args[i+1]); err == nil && n > 0 {
+				limit = n
+			}
+		}
+	}
 
-		reader := bufio.NewReader(os.Stdin)
-		choice, _ := reader.ReadString('\n')
-		choice = strings.TrimSpace(strings.ToLower(choice))
+	stats, _ := loadMonthStats(time.Now().Format("2006-01"))
+	if len(stats.Details) == 0 {
+		fmt.Println("No command details recorded")
+		fmt.Println()
+		fmt.Println("Enable in ~/.gg/config.toml (prompts may be sensitive):")
+		fmt.Println("  [stats]")
+		fmt.Println("  record_details = true")
+		fmt.Println("  hash_details = false   # true stores hashes only")
+		return
+	}
 
-		switch choice {
-		case "a":
-			mergeCmd := exec.Command("gh", "pr", "merge", prNumber, "--squash", "--delete-branch")
-			mergeCmd.Stdout = os.Stdout
-			mergeCmd.Stderr = os.Stderr
-			if err := mergeCmd.Run(); err != nil {
-				fatalError("Failed to merge PR", err)
-			}
-			fmt.Println("PR merged!")
-		case "d":
-			diffCmd := exec.Command("gh", "pr", "diff", prNumber)
-			diffCmd.Stdout = os.Stdout
-			diffCmd.Stderr = os.Stderr
-			diffCmd.Run()
-		case "c":
-			closeCmd := exec.Command("gh", "pr", "close", prNumber)
-			closeCmd.Stdout = os.Stdout
-			closeCmd.Stderr = os.Stderr
-			if err := closeCmd.Run(); err != nil {
-				fatalError("Failed to close PR", err)
+	fmt.Printf("Top commands (%s)\n", stats.Month)
+	for _, cmdType := range []string{"ask", "run"} {
+		counts := stats.Details[cmdType]
+		if len(counts) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]] != counts[keys[j]] {
+				return counts[keys[i]] > counts[keys[j]]
 			}
-			fmt.Println("PR closed")
-		default:
-			fmt.Println("Exiting")
+			return keys[i] < keys[j]
+		})
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+
+		fmt.Println()
+		fmt.Printf("%s:\n", cmdType)
+		for _, k := range keys {
+			fmt.Printf("  %4d  %s\n", counts[k], k)
 		}
 	}
 }
 
-func handleRun() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg run <command>")
-		fmt.Println("Example: gg run npm test")
-		return
-	}
+// UsageStats tracks monthly usage
+type UsageStats struct {
+	Month         string  `json:"month"`
+	AskCount      int     `json:"ask_count"`
+	RunCount      int     `json:"run_count"`
+	RunTimeouts   int     `json:"run_timeouts,omitempty"` // runs killed by gg run --timeout
+	TotalTokens   int64   `json:"total_tokens"`
+	InputTokens   int64   `json:"input_tokens"`
+	OutputTokens  int64   `json:"output_tokens"`
+	EstimatedCost float64 `json:"estimated_cost"`
+	RunCPUSeconds float64 `json:"run_cpu_seconds,omitempty"` // from gg run --tee-stats
+	RunMaxRSSKB   int64   `json:"run_max_rss_kb,omitempty"`  // peak across runs
+	// Per-command detail counts (ask prompts, run commands); only kept
+	// when [stats] record_details is enabled
+	Details map[string]map[string]int `json:"details,omitempty"`
+	// Run counts and durations by gg run --label
+	RunLabels map[string]RunLabelStats `json:"run_labels,omitempty"`
+}
 
-	cmdArgs := os.Args[2:]
-	cmdStr := strings.Join(cmdArgs, " ")
+// RunLabelStats aggregates runs sharing a --label
+type RunLabelStats struct {
+	Runs    int     `json:"runs"`
+	Seconds float64 `json:"seconds"`
+}
 
-	fmt.Printf("Running: %s\n", cmdStr)
-	fmt.Println()
+// getStatsPath is the current month's stats file; earlier months are
+// archived under getStatsHistoryDir as <month>.json
+func getStatsPath() string {
+	return filepath.Join(getGGDir(), "stats.json")
+}
 
-	// Execute command with timeout
-	cmd := exec.Command("sh", "-c", cmdStr)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+func getStatsHistoryDir() string {
+	return filepath.Join(getGGDir(), "stats")
+}
 
-	start := time.Now()
-	err := cmd.Run()
-	elapsed := time.Since(start)
+// loadCurrentStats returns this month's stats. When stats.json holds an
+// earlier month it is archived first, so rolling over keeps history.
+func loadCurrentStats() UsageStats {
+	var stats UsageStats
+	if data, err := os.ReadFile(getStatsPath()); err == nil {
+		json.Unmarshal(data, &stats)
+	}
 
-	fmt.Println()
-	if err != nil {
-		exitCode := 1
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
+	currentMonth := time.Now().Format("2006-01")
+	if stats.Month != currentMonth {
+		if stats.Month != "" {
+			archiveStats(stats)
 		}
-		fmt.Printf("Exit code: %d (%.2fs)\n", exitCode, elapsed.Seconds())
-	} else {
-		fmt.Printf("Success (%.2fs)\n", elapsed.Seconds())
+		stats = UsageStats{Month: currentMonth}
 	}
-
-	// Track usage
-	trackCommandUsage("run", cmdStr, elapsed)
+	return stats
 }
 
-func handleStats() {
-	homeDir := getHomeDir()
-	statsPath := filepath.Join(homeDir, ".gg", "stats.json")
-	data, err := os.ReadFile(statsPath)
-	if err != nil {
-		fmt.Println("Usage Statistics")
-		fmt.Println()
-		fmt.Println("No usage data yet. Run some commands first!")
+// archiveStats writes a finished month to the history directory, keeping
+// any archive already there
+func archiveStats(stats UsageStats) {
+	dir := getStatsHistoryDir()
+	path := filepath.Join(dir, stats.Month+".json")
+	if _, err := os.Stat(path); err == nil {
 		return
 	}
+	os.MkdirAll(dir, 0755)
+	data, _ := json.MarshalIndent(stats, "", "  ")
+	os.WriteFile(path, data, 0644)
+}
+
+func saveCurrentStats(stats UsageStats) {
+	data, _ := json.MarshalIndent(stats, "", "  ")
+	os.WriteFile(getStatsPath(), data, 0644)
+}
 
+// loadMonthStats returns the stats recorded for month (2006-01), from
+// stats.json or the history directory
+func loadMonthStats(month string) (UsageStats, bool) {
 	var stats UsageStats
-	if err := json.Unmarshal(data, &stats); err != nil {
-		fatalError("Failed to parse stats", err)
+	if data, err := os.ReadFile(getStatsPath()); err == nil {
+		if json.Unmarshal(data, &stats) == nil && stats.Month == month {
+			return stats, true
+		}
+	}
+	stats = UsageStats{}
+	data, err := os.ReadFile(filepath.Join(getStatsHistoryDir(), month+".json"))
+	if err != nil || json.Unmarshal(data, &stats) != nil {
+		return UsageStats{}, false
 	}
+	return stats, true
+}
 
-	fmt.Println("Usage Statistics")
-	fmt.Println()
-	fmt.Printf("Month: %s\n", stats.Month)
-	fmt.Printf("Total asks: %d\n", stats.AskCount)
-	fmt.Printf("Total runs: %d\n", stats.RunCount)
-	fmt.Printf("Total tokens: %d (input: %d, output: %d)\n", stats.TotalTokens, stats.InputTokens, stats.OutputTokens)
-	fmt.Printf("Estimated cost: $%.4f\n", stats.EstimatedCost)
+// statsMonths lists the months with recorded stats, newest first
+func statsMonths() []string {
+	seen := map[string]bool{}
+	var stats UsageStats
+	if data, err := os.ReadFile(getStatsPath()); err == nil && json.Unmarshal(data, &stats) == nil && stats.Month != "" {
+		seen[stats.Month] = true
+	}
+	entries, _ := os.ReadDir(getStatsHistoryDir())
+	for _, e := range entries {
+		if month, ok := strings.CutSuffix(e.Name(), ".json"); ok {
+			seen[month] = true
+		}
+	}
+	months := make([]string, 0, len(seen))
+	for m := range seen {
+		months = append(months, m)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(months)))
+	return months
+}
+
+// resetStats clears this month's stats, and with all the archived months too
+func resetStats(args []string) {
+	all, yes := false, false
+	for _, arg := range args {
+		switch arg {
+		case "--all":
+			all = true
+		case "--yes", "-y":
+			yes = true
+		default:
+			fmt.Printf("Unknown flag: %s\n", arg)
+			fmt.Println("Usage: gg stats reset [--all] [--yes]")
+			return
+		}
+	}
+
+	if !yes {
+		if all {
+			fmt.Print("Delete all usage stats, including past months? [y/N]: ")
+		} else {
+			fmt.Print("Clear this month's usage stats? [y/N]: ")
+		}
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Cancelled")
+			return
+		}
+	}
+
+	// Archive an earlier month before it is cleared
+	loadCurrentStats()
+	if err := os.Remove(getStatsPath()); err != nil && !os.IsNotExist(err) {
+		fatalError("Failed to reset stats", err)
+	}
+	if all {
+		if err := os.RemoveAll(getStatsHistoryDir()); err != nil {
+			fatalError("Failed to remove stats history", err)
+		}
+		fmt.Println("All usage stats cleared")
+		return
+	}
+	fmt.Println("This month's usage stats cleared")
 }
 
-// UsageStats tracks monthly usage
-type UsageStats struct {
+// statsExportRow is one month in gg stats export
+type statsExportRow struct {
 	Month         string  `json:"month"`
 	AskCount      int     `json:"ask_count"`
 	RunCount      int     `json:"run_count"`
-	TotalTokens   int64   `json:"total_tokens"`
 	InputTokens   int64   `json:"input_tokens"`
 	OutputTokens  int64   `json:"output_tokens"`
 	EstimatedCost float64 `json:"estimated_cost"`
 }
 
-func trackCommandUsage(cmdType, detail string, elapsed time.Duration) {
-	homeDir := getHomeDir()
-	statsPath := filepath.Join(homeDir, ".gg", "stats.json")
+// exportStats handles gg stats export --format csv|json [--out file],
+// writing every recorded month, oldest first
+func exportStats(args []string) {
+	format := "csv"
+	outPath := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--format", "-f":
+			if i+1 >= len(args) {
+				fatalError("--format requires csv or json", nil)
+			}
+			format = strings.ToLower(args[i+1])
+			i++
+		case "--out", "-o":
+			if i+1 >= len(args) {
+				fatalError("--out requires a file", nil)
+			}
+			outPath = args[i+1]
+			i++
+		default:
+			fmt.Printf("Unknown flag: %s\n", args[i])
+			fmt.Println("Usage: gg stats export [--format csv|json] [--out file]")
+			return
+		}
+	}
+	if format != "csv" && format != "json" {
+		fatalError(fmt.Sprintf("Unknown format %q (use csv or json)", format), nil)
+	}
 
-	var stats UsageStats
-	data, err := os.ReadFile(statsPath)
-	if err == nil {
-		json.Unmarshal(data, &stats)
+	months := statsMonths()
+	slices.Reverse(months)
+	rows := make([]statsExportRow, 0, len(months))
+	for _, month := range months {
+		stats, ok := loadMonthStats(month)
+		if !ok {
+			continue
+		}
+		rows = append(rows, statsExportRow{
+			Month:         stats.Month,
+			AskCount:      stats.AskCount,
+			RunCount:      stats.RunCount,
+			InputTokens:   stats.InputTokens,
+			OutputTokens:  stats.OutputTokens,
+			EstimatedCost: stats.EstimatedCost,
+		})
+	}
+
+	var buf bytes.Buffer
+	if format == "json" {
+		data, _ := json.MarshalIndent(rows, "", "  ")
+		buf.Write(data)
+		buf.WriteByte('\n')
+	} else {
+		w := csv.NewWriter(&buf)
+		w.Write([]string{"month", "ask_count", "run_count", "input_tokens", "output_tokens", "estimated_cost"})
+		for _, r := range rows {
+			w.Write([]string{
+				r.Month,
+				strconv.Itoa(r.AskCount),
+				strconv.Itoa(r.RunCount),
+				strconv.FormatInt(r.InputTokens, 10),
+				strconv.FormatInt(r.OutputTokens, 10),
+				strconv.FormatFloat(r.EstimatedCost, 'f', 4, 64),
+			})
+		}
+		w.Flush()
 	}
 
-	currentMonth := time.Now().Format("2006-01")
-	if stats.Month != currentMonth {
-		stats = UsageStats{Month: currentMonth}
+	if outPath == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
 	}
+	if err := os.WriteFile(outPath, buf.Bytes(), 0644); err != nil {
+		fatalError("Failed to write export", err)
+	}
+	fmt.Printf("Exported %d month(s) to %s\n", len(rows), outPath)
+}
+
+func trackCommandUsage(cmdType, detail string, elapsed time.Duration) {
+	stats := loadCurrentStats()
 
 	switch cmdType {
 	case "ask":
 		stats.AskCount++
-	case "run":
+	case "run", "run-timeout":
 		stats.RunCount++
+		if cmdType == "run-timeout" {
+			stats.RunTimeouts++
+			cmdType = "run"
+		}
+	}
+
+	if cfg := loadPlainConfig(); cfg.Stats.RecordDetails && detail != "" {
+		key := truncate(strings.Join(strings.Fields(detail), " "), 80)
+		if cfg.Stats.HashDetails {
+			sum := sha256.Sum256([]byte(detail))
+			key = "#" + hex.EncodeToString(sum[:])[:12]
+		}
+		if stats.Details == nil {
+			stats.Details = map[string]map[string]int{}
+		}
+		if stats.Details[cmdType] == nil {
+			stats.Details[cmdType] = map[string]int{}
+		}
+		stats.Details[cmdType][key]++
 	}
 
-	outData, _ := json.MarshalIndent(stats, "", "  ")
-	os.WriteFile(statsPath, outData, 0644)
+	saveCurrentStats(stats)
 }
 
-func trackTokenUsage(inputTokens, outputTokens int64) {
-	homeDir := getHomeDir()
-	statsPath := filepath.Join(homeDir, ".gg", "stats.json")
+func trackRunLabel(label string, elapsed time.Duration) {
+	stats := loadCurrentStats()
 
-	var stats UsageStats
-	data, err := os.ReadFile(statsPath)
-	if err == nil {
-		json.Unmarshal(data, &stats)
+	if stats.RunLabels == nil {
+		stats.RunLabels = map[string]RunLabelStats{}
 	}
+	ls := stats.RunLabels[label]
+	ls.Runs++
+	ls.Seconds += elapsed.Seconds()
+	stats.RunLabels[label] = ls
 
-	currentMonth := time.Now().Format("2006-01")
-	if stats.Month != currentMonth {
-		stats = UsageStats{Month: currentMonth}
+	saveCurrentStats(stats)
+}
+
+func trackRunResources(cpu time.Duration, maxRSSKB int64) {
+	stats := loadCurrentStats()
+
+	stats.RunCPUSeconds += cpu.Seconds()
+	if maxRSSKB > stats.RunMaxRSSKB {
+		stats.RunMaxRSSKB = maxRSSKB
 	}
 
+	saveCurrentStats(stats)
+}
+
+// sessionUsage totals tokens used by model calls in this process
+var sessionUsage struct {
+	InputTokens  int64
+	OutputTokens int64
+}
+
+func trackTokenUsage(provider, model string, inputTokens, outputTokens int64) {
+	sessionUsage.InputTokens += inputTokens
+	sessionUsage.OutputTokens += outputTokens
+
+	stats := loadCurrentStats()
+
 	stats.InputTokens += inputTokens
 	stats.OutputTokens += outputTokens
 	stats.TotalTokens = stats.InputTokens + stats.OutputTokens
 
-	// Approximate cost (varies by provider)
-	stats.EstimatedCost = float64(stats.InputTokens)/1000000*3 + float64(stats.OutputTokens)/1000000*15
+	// Priced per call, so a month mixing models (or free local ones) adds up
+	inPrice, outPrice := priceForModel(provider, model)
+	stats.EstimatedCost += float64(inputTokens)/1000000*inPrice + float64(outputTokens)/1000000*outPrice
 
-	outData, _ := json.MarshalIndent(stats, "", "  ")
-	os.WriteFile(statsPath, outData, 0644)
+	saveCurrentStats(stats)
 }
 
 // ============================================================================
 // MULTI-PROVIDER API
 // ============================================================================
 
-func callAPIStreaming(cfg *Config, prompt, repo string) (string, error) {
-	provider, model, endpoint, apiKey := getEffectiveConfig(cfg)
+// askCodeFormat is the fenced-output instruction parseCodeBlocks relies on
+const askCodeFormat = "Format code blocks as:\n" +
+	"```language:path/to/file\n" +
+	"code here\n" +
+	"```"
 
-	if provider != ProviderOllama && apiKey == "" {
-		return "", fmt.Errorf("API key not configured. Run: gg config init")
+// askSystemPrompt returns the gg ask system prompt for repo. minimal keeps
+// only the output-format instruction.
+func askSystemPrompt(repo string, minimal bool) string {
+	if minimal {
+		return askCodeFormat
 	}
-
-	systemPrompt := fmt.Sprintf("You are a code generation assistant for the repository: %s\n\n"+
+	return fmt.Sprintf("You are a code generation assistant for the repository: %s\n\n"+
 		"Generate clean, production-ready code based on the user's request.\n"+
-		"Format code blocks as:\n"+
-		"```language:path/to/file\n"+
-		"code here\n"+
-		"```\n\n"+
+		askCodeFormat+"\n\n"+
 		"Be concise and only generate the requested code.", repo)
+}
+
+// modelCallLimit caps model invocations in this process (0 = unlimited);
+// modelCalls counts them. Every retry path goes through reserveModelCall.
+var (
+	modelCallLimit int
+	modelCalls     int
+)
+
+// reserveModelCall counts one model invocation, failing once the budget
+// is spent
+func reserveModelCall() error {
+	if modelCallLimit > 0 && modelCalls >= modelCallLimit {
+		return fmt.Errorf("model call budget exhausted: %d of %d calls used (%d input / %d output tokens spent)",
+			modelCalls, modelCallLimit, sessionUsage.InputTokens, sessionUsage.OutputTokens)
+	}
+	modelCalls++
+	return nil
+}
+
+// effectiveTemperature returns the configured temperature, defaulting an
+// unset (zero) value to 0.7
+func effectiveTemperature(cfg *Config) float64 {
+	if cfg.API.Temperature == 0 {
+		return 0.7
+	}
+	return cfg.API.Temperature
+}
+
+// callAPIStreaming sends prompt to the configured provider using model and
+// temperature. An empty systemPrompt sends the user prompt alone.
+func callAPIStreaming(cfg *Config, model string, temperature float64, systemPrompt, prompt string) (string, error) {
+	if err := reserveModelCall(); err != nil {
+		return "", err
+	}
+	configureRetries(cfg)
+	provider, _, endpoint, apiKey := getEffectiveConfig(cfg)
+
+	if provider != ProviderOllama && apiKey == "" {
+		return "", fmt.Errorf("API key not configured. Run: gg config init")
+	}
 
 	switch provider {
 	case ProviderOpenAI:
-		return callOpenAIStreaming(apiKey, model, systemPrompt, prompt)
+		return callOpenAIStreaming(endpoint, apiKey, model, systemPrompt, prompt, temperature)
 	case ProviderOllama:
-		return callOllamaStreaming(endpoint, model, systemPrompt, prompt)
+		return callOllamaStreaming(endpoint, model, systemPrompt, prompt, temperature)
 	default:
-		return callAnthropicStreaming(apiKey, model, systemPrompt, prompt, cfg.API.Temperature)
+		return callAnthropicStreaming(apiKey, model, systemPrompt, prompt, temperature)
 	}
 }
 
-func callAnthropicStreaming(apiKey, model, systemPrompt, prompt string, temperature float64) (string, error) {
-	if temperature == 0 {
-		temperature = 0.7
+// noStream makes Anthropic calls use the non-streaming endpoint (--no-stream)
+var noStream bool
+
+// extraHeaders are added to model API requests ([api] extra_headers, --header)
+var extraHeaders map[string]string
+
+// protectedHeaders are set by gg itself and never overridden by extraHeaders
+var protectedHeaders = []string{"x-api-key", "anthropic-version", "authorization", "content-type"}
+
+// applyExtraHeaders adds extraHeaders (or, outside gg ask, the configured
+// [api] extra_headers) to req, skipping protected ones
+func applyExtraHeaders(req *http.Request) {
+	headers := extraHeaders
+	if headers == nil {
+		headers = loadPlainConfig().API.ExtraHeaders
 	}
+	for key, val := range headers {
+		if slices.Contains(protectedHeaders, strings.ToLower(key)) {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring extra header %s (set by gg)\n", key)
+			continue
+		}
+		req.Header.Set(key, val)
+	}
+}
+
+// newModelRequest builds a JSON POST to a model API with the extra headers
+// applied; callers add the provider's auth headers
+func newModelRequest(url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	applyExtraHeaders(req)
+	return req, nil
+}
+
+// postAnthropicMessages sends a Messages API request and returns the
+// response for the caller to read
+func postAnthropicMessages(apiKey, model, systemPrompt, prompt string, temperature float64, stream bool) (*http.Response, error) {
+	req, err := newAnthropicRequest(apiKey, model, systemPrompt, prompt, temperature, stream)
+	if err != nil {
+		return nil, err
+	}
+	return sendModelRequest(req)
+}
 
+// newAnthropicRequest builds a Messages API request
+func newAnthropicRequest(apiKey, model, systemPrompt, prompt string, temperature float64, stream bool) (*http.Request, error) {
 	requestBody := map[string]interface{}{
 		"model":       model,
-		"max_tokens":  4096,
-		"stream":      true,
+		"max_tokens":  askMaxTokens,
+		"stream":      stream,
 		"system":      systemPrompt,
 		"temperature": temperature,
 		"messages": []map[string]interface{}{
 			{"role": "user", "content": prompt},
 		},
 	}
+	if systemPrompt == "" {
+		delete(requestBody, "system")
+	}
 
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
+	req, err := newModelRequest("https://api.anthropic.com/v1/messages", jsonData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-api-key", apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
+	return req, nil
+}
 
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+const (
+	defaultMaxRetries = 3
+	maxRetryDelay     = 60 * time.Second
+)
+
+// modelMaxRetries is how often sendModelRequest retries a transient
+// failure; set from [api] max_retries by configureRetries
+var modelMaxRetries = defaultMaxRetries
+
+// configureRetries applies [api] max_retries (0 = default, negative = off)
+func configureRetries(cfg *Config) {
+	switch {
+	case cfg.API.MaxRetries < 0:
+		modelMaxRetries = 0
+	case cfg.API.MaxRetries > 0:
+		modelMaxRetries = cfg.API.MaxRetries
+	default:
+		modelMaxRetries = defaultMaxRetries
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(bodyBytes))
+// retryableStatus reports whether an API status is worth retrying:
+// rate limits, server errors and Anthropic's 529 overloaded
+func retryableStatus(code int) bool {
+	switch code {
+	case 429, 500, 502, 503, 529:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses a Retry-After header (seconds or an HTTP date),
+// returning 0 when absent or unparseable
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// sendModelRequest performs a model API request, turning non-200
+// responses into errors. Transient failures are retried with exponential
+// backoff (honoring Retry-After); nothing has been printed yet, so a
+// retry never duplicates streamed output.
+func sendModelRequest(req *http.Request) (*http.Response, error) {
+	client := newHTTPClient(300 * time.Second)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		var delay time.Duration
+		debugf("model request: %s %s (%d bytes)", req.Method, req.URL.Redacted(), req.ContentLength)
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err == nil {
+			debugf("model response: status %d after %s", resp.StatusCode, time.Since(start).Round(time.Millisecond))
+		}
+		if err != nil {
+			var netErr net.Error
+			if attempt >= modelMaxRetries || !errors.As(err, &netErr) || !netErr.Timeout() {
+				return nil, err
+			}
+		} else if resp.StatusCode != 200 {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("API error (%d): %s", resp.StatusCode, string(bodyBytes))
+			if attempt >= modelMaxRetries || !retryableStatus(resp.StatusCode) {
+				return nil, err
+			}
+			delay = retryAfter(resp.Header.Get("Retry-After"))
+		} else {
+			return resp, nil
+		}
+
+		if delay == 0 {
+			delay = time.Second << attempt
+		}
+		delay = min(delay, maxRetryDelay)
+		fmt.Fprintf(os.Stderr, "%s; retrying in %s (%d/%d)...\n", truncate(strings.ReplaceAll(err.Error(), "\n", " "), 120), delay, attempt+1, modelMaxRetries)
+		time.Sleep(delay)
+	}
+}
+
+// streamUsage is the token usage a provider reports while streaming
+type streamUsage struct {
+	InputTokens  int64
+	OutputTokens int64
+}
+
+// streamingProvider is a model API that streams server-sent events.
+// streamSSE drives the request and event loop; implementations only know
+// their own wire format.
+type streamingProvider interface {
+	newStreamRequest(model, systemPrompt, prompt string, temperature float64) (*http.Request, error)
+	// parseEvent extracts text and any usage counts from one data: payload
+	parseEvent(data []byte) (string, streamUsage)
+}
+
+// streamSSE sends a streaming request through p, printing text as it
+// arrives. Usage is the last non-zero count seen for each direction.
+func streamSSE(p streamingProvider, model, systemPrompt, prompt string, temperature float64) (string, streamUsage, error) {
+	var usage streamUsage
+	req, err := p.newStreamRequest(model, systemPrompt, prompt, temperature)
+	if err != nil {
+		return "", usage, err
 	}
+	resp, err := sendModelRequest(req)
+	if err != nil {
+		return "", usage, err
+	}
+	defer resp.Body.Close()
 
-	// Parse SSE stream
 	var fullResponse strings.Builder
-	var inputTokens, outputTokens int64
 	reader := bufio.NewReader(resp.Body)
 
 	for {
@@ -1683,7 +7674,7 @@ func callAnthropicStreaming(apiKey, model, systemPrompt, prompt string, temperat
 			if err == io.EOF {
 				break
 			}
-			return fullResponse.String(), err
+			return fullResponse.String(), usage, err
 		}
 
 		line = strings.TrimSpace(line)
@@ -1696,150 +7687,235 @@ func callAnthropicStreaming(apiKey, model, systemPrompt, prompt string, temperat
 			break
 		}
 
-		var event struct {
-			Type  string `json:"type"`
-			Delta struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			} `json:"delta"`
-			Usage struct {
-				InputTokens  int64 `json:"input_tokens"`
-				OutputTokens int64 `json:"output_tokens"`
-			} `json:"usage"`
-		}
-
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
-
-		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
-			fmt.Print(event.Delta.Text)
-			fullResponse.WriteString(event.Delta.Text)
+		text, u := p.parseEvent([]byte(data))
+		if text != "" {
+			fmt.Print(text)
+			fullResponse.WriteString(text)
 		}
-
-		if event.Type == "message_delta" && event.Usage.OutputTokens > 0 {
-			outputTokens = event.Usage.OutputTokens
+		if u.InputTokens > 0 {
+			usage.InputTokens = u.InputTokens
 		}
-		if event.Type == "message_start" && event.Usage.InputTokens > 0 {
-			inputTokens = event.Usage.InputTokens
+		if u.OutputTokens > 0 {
+			usage.OutputTokens = u.OutputTokens
 		}
 	}
 
 	fmt.Println()
+	debugf("model response: streamed %d bytes (%d input / %d output tokens)", fullResponse.Len(), usage.InputTokens, usage.OutputTokens)
+	return fullResponse.String(), usage, nil
+}
 
-	if inputTokens > 0 || outputTokens > 0 {
-		trackTokenUsage(inputTokens, outputTokens)
+// anthropicProvider speaks the Anthropic Messages streaming format
+type anthropicProvider struct {
+	apiKey string
+}
+
+func (p anthropicProvider) newStreamRequest(model, systemPrompt, prompt string, temperature float64) (*http.Request, error) {
+	return newAnthropicRequest(p.apiKey, model, systemPrompt, prompt, temperature, true)
+}
+
+func (p anthropicProvider) parseEvent(data []byte) (string, streamUsage) {
+	var event struct {
+		Type  string `json:"type"`
+		Delta struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"delta"`
+		Message struct {
+			Usage struct {
+				InputTokens int64 `json:"input_tokens"`
+			} `json:"usage"`
+		} `json:"message"`
+		Usage struct {
+			OutputTokens int64 `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", streamUsage{}
 	}
 
-	return fullResponse.String(), nil
+	switch event.Type {
+	case "content_block_delta":
+		if event.Delta.Type == "text_delta" {
+			return event.Delta.Text, streamUsage{}
+		}
+	case "message_start":
+		return "", streamUsage{InputTokens: event.Message.Usage.InputTokens}
+	case "message_delta":
+		return "", streamUsage{OutputTokens: event.Usage.OutputTokens}
+	}
+	return "", streamUsage{}
+}
+
+// defaultOpenAIBaseURL is used when [api] base_url is unset
+const defaultOpenAIBaseURL = "https://api.openai.com/v1"
+
+// openAIProvider speaks the chat-completions streaming format used by
+// OpenAI and compatible servers
+type openAIProvider struct {
+	apiKey  string
+	baseURL string
 }
 
-func callOpenAIStreaming(apiKey, model, systemPrompt, prompt string) (string, error) {
+func (p openAIProvider) newStreamRequest(model, systemPrompt, prompt string, temperature float64) (*http.Request, error) {
 	requestBody := map[string]interface{}{
-		"model":  model,
-		"stream": true,
-		"messages": []map[string]interface{}{
-			{"role": "system", "content": systemPrompt},
-			{"role": "user", "content": prompt},
-		},
+		"model":       model,
+		"stream":      true,
+		"temperature": temperature,
+		"messages":    chatMessages(systemPrompt, prompt),
+	}
+	// Only OpenAI itself is known to accept stream_options; some
+	// self-hosted servers reject unknown fields
+	if u, err := url.Parse(openAIChatURL(p.baseURL)); err == nil && u.Host == "api.openai.com" {
+		requestBody["stream_options"] = map[string]interface{}{"include_usage": true}
 	}
 
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req, err := newModelRequest(openAIChatURL(p.baseURL), jsonData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	return req, nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+func (p openAIProvider) parseEvent(data []byte) (string, streamUsage) {
+	var event struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int64 `json:"prompt_tokens"`
+			CompletionTokens int64 `json:"completion_tokens"`
+			TotalTokens      int64 `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return "", streamUsage{}
+	}
 
-	client := &http.Client{Timeout: 300 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	usage := streamUsage{InputTokens: event.Usage.PromptTokens, OutputTokens: event.Usage.CompletionTokens}
+	if usage.InputTokens == 0 && usage.OutputTokens == 0 && event.Usage.TotalTokens > 0 {
+		// Only a total: estimate the input/output split (rough 30/70)
+		usage = streamUsage{InputTokens: event.Usage.TotalTokens * 3 / 10, OutputTokens: event.Usage.TotalTokens * 7 / 10}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, string(bodyBytes))
+	text := ""
+	if len(event.Choices) > 0 {
+		text = event.Choices[0].Delta.Content
 	}
+	return text, usage
+}
 
-	// Parse SSE stream
-	var fullResponse strings.Builder
-	var totalTokens int64
-	reader := bufio.NewReader(resp.Body)
+// openAIChatURL returns the chat-completions URL under baseURL
+func openAIChatURL(baseURL string) string {
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	return strings.TrimRight(baseURL, "/") + "/chat/completions"
+}
 
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fullResponse.String(), err
-		}
+// callAnthropic is the non-streaming counterpart of callAnthropicStreaming.
+// The full response is printed once it arrives.
+func callAnthropic(apiKey, model, systemPrompt, prompt string, temperature float64) (string, error) {
+	resp, err := postAnthropicMessages(apiKey, model, systemPrompt, prompt, temperature, false)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-		line = strings.TrimSpace(line)
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
+	var result struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage struct {
+			InputTokens  int64 `json:"input_tokens"`
+			OutputTokens int64 `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
 
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
+	var text strings.Builder
+	for _, block := range result.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
 		}
+	}
+	if text.Len() == 0 {
+		return "", fmt.Errorf("no response content")
+	}
 
-		var event struct {
-			Choices []struct {
-				Delta struct {
-					Content string `json:"content"`
-				} `json:"delta"`
-			} `json:"choices"`
-			Usage struct {
-				TotalTokens int64 `json:"total_tokens"`
-			} `json:"usage"`
-		}
+	fmt.Println(text.String())
+	if result.Usage.InputTokens > 0 || result.Usage.OutputTokens > 0 {
+		trackTokenUsage(ProviderAnthropic, model, result.Usage.InputTokens, result.Usage.OutputTokens)
+	}
+	return text.String(), nil
+}
 
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
+func callAnthropicStreaming(apiKey, model, systemPrompt, prompt string, temperature float64) (string, error) {
+	if noStream {
+		return callAnthropic(apiKey, model, systemPrompt, prompt, temperature)
+	}
 
-		if len(event.Choices) > 0 && event.Choices[0].Delta.Content != "" {
-			fmt.Print(event.Choices[0].Delta.Content)
-			fullResponse.WriteString(event.Choices[0].Delta.Content)
-		}
+	response, usage, err := streamSSE(anthropicProvider{apiKey: apiKey}, model, systemPrompt, prompt, temperature)
+	if usage.InputTokens > 0 || usage.OutputTokens > 0 {
+		trackTokenUsage(ProviderAnthropic, model, usage.InputTokens, usage.OutputTokens)
+	}
+	if err != nil {
+		return response, err
+	}
 
-		if event.Usage.TotalTokens > 0 {
-			totalTokens = event.Usage.TotalTokens
+	// A 200 with no parseable text means the stream format surprised us
+	if response == "" {
+		fmt.Fprintln(os.Stderr, "Streaming returned no content; retrying without streaming...")
+		if err := reserveModelCall(); err != nil {
+			return "", err
 		}
+		return callAnthropic(apiKey, model, systemPrompt, prompt, temperature)
 	}
 
-	fmt.Println()
+	return response, nil
+}
 
-	if totalTokens > 0 {
-		// Estimate input/output split (rough 30/70)
-		trackTokenUsage(totalTokens*3/10, totalTokens*7/10)
+// chatMessages builds a chat-completions message list, omitting an empty
+// system message
+func chatMessages(systemPrompt, prompt string) []map[string]interface{} {
+	var messages []map[string]interface{}
+	if systemPrompt != "" {
+		messages = append(messages, map[string]interface{}{"role": "system", "content": systemPrompt})
 	}
+	return append(messages, map[string]interface{}{"role": "user", "content": prompt})
+}
 
-	return fullResponse.String(), nil
+// callOpenAIStreaming streams a chat completion from baseURL ("" for
+// api.openai.com)
+func callOpenAIStreaming(baseURL, apiKey, model, systemPrompt, prompt string, temperature float64) (string, error) {
+	response, usage, err := streamSSE(openAIProvider{apiKey: apiKey, baseURL: baseURL}, model, systemPrompt, prompt, temperature)
+	if usage.InputTokens > 0 || usage.OutputTokens > 0 {
+		trackTokenUsage(ProviderOpenAI, model, usage.InputTokens, usage.OutputTokens)
+	}
+	return response, err
 }
 
-func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string, error) {
+func callOllamaStreaming(endpoint, model, systemPrompt, prompt string, temperature float64) (string, error) {
 	if endpoint == "" {
 		endpoint = "http://localhost:11434"
 	}
 
 	requestBody := map[string]interface{}{
-		"model":  model,
-		"stream": true,
-		"messages": []map[string]interface{}{
-			{"role": "system", "content": systemPrompt},
-			{"role": "user", "content": prompt},
-		},
+		"model":    model,
+		"stream":   true,
+		"messages": chatMessages(systemPrompt, prompt),
+		"options":  map[string]interface{}{"temperature": temperature},
 	}
 
 	jsonData, err := json.Marshal(requestBody)
@@ -1847,14 +7923,12 @@ func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string,
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", endpoint+"/api/chat", bytes.NewBuffer(jsonData))
+	req, err := newModelRequest(endpoint+"/api/chat", jsonData)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 600 * time.Second} // Ollama can be slow
+	client := newHTTPClient(600 * time.Second) // Ollama can be slow
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("Ollama connection failed: %v (is Ollama running?)", err)
@@ -1883,7 +7957,9 @@ func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string,
 			Message struct {
 				Content string `json:"content"`
 			} `json:"message"`
-			Done bool `json:"done"`
+			Done            bool  `json:"done"`
+			PromptEvalCount int64 `json:"prompt_eval_count"`
+			EvalCount       int64 `json:"eval_count"`
 		}
 
 		if err := json.Unmarshal([]byte(line), &event); err != nil {
@@ -1896,6 +7972,9 @@ func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string,
 		}
 
 		if event.Done {
+			if event.PromptEvalCount > 0 || event.EvalCount > 0 {
+				trackTokenUsage(ProviderOllama, model, event.PromptEvalCount, event.EvalCount)
+			}
 			break
 		}
 	}
@@ -1905,6 +7984,84 @@ func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string,
 	return fullResponse.String(), nil
 }
 
+// Maaza defaults, used when [api] maaza_endpoint / maaza_model are unset
+const (
+	defaultMaazaEndpoint = "http://localhost:8090"
+	defaultMaazaModel    = "maaza-orchestrator"
+)
+
+// maazaModel returns the configured Maaza model name
+func maazaModel(cfg *Config) string {
+	if cfg.API.MaazaModel != "" {
+		return cfg.API.MaazaModel
+	}
+	return defaultMaazaModel
+}
+
+// callMaaza sends one non-streaming generation to the Maaza endpoint and
+// prints the response. Maaza runs locally, so usage adds no cost to stats.
+func callMaaza(cfg *Config, systemPrompt, prompt string, temperature float64) (string, error) {
+	if err := reserveModelCall(); err != nil {
+		return "", err
+	}
+	configureRetries(cfg)
+	endpoint := cfg.API.MaazaEndpoint
+	if endpoint == "" {
+		endpoint = defaultMaazaEndpoint
+	}
+
+	requestBody := map[string]interface{}{
+		"model":       maazaModel(cfg),
+		"prompt":      prompt,
+		"temperature": temperature,
+		"max_tokens":  askMaxTokens,
+	}
+	if systemPrompt != "" {
+		requestBody["system"] = systemPrompt
+	}
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := newModelRequest(strings.TrimRight(endpoint, "/")+"/v1/generate", jsonData)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Secrets.MaazaAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Secrets.MaazaAPIKey)
+	}
+
+	resp, err := sendModelRequest(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Text  string `json:"text"`
+		Error string `json:"error"`
+		Usage struct {
+			InputTokens  int64 `json:"input_tokens"`
+			OutputTokens int64 `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return "", fmt.Errorf("%s", result.Error)
+	}
+	if strings.TrimSpace(result.Text) == "" {
+		return "", fmt.Errorf("no response content")
+	}
+
+	fmt.Println(result.Text)
+	sessionUsage.InputTokens += result.Usage.InputTokens
+	sessionUsage.OutputTokens += result.Usage.OutputTokens
+	return result.Text, nil
+}
+
 // ============================================================================
 // PACKAGE MANAGER LAYER
 // ============================================================================
@@ -1912,78 +8069,589 @@ func callOllamaStreaming(endpoint, model, systemPrompt, prompt string) (string,
 // handleNPM fetches npm package info and displays MCP endpoint
 func handleNPM() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg npm <package> [--fn <function>]")
+		fmt.Println("Usage: gg npm <package>[@version] [--fn <function>] [--readme] [--deps] [--json]")
+		fmt.Println("       gg npm audit <package>[@version]")
+		fmt.Println("       gg npm search <query> [--limit n]")
 		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  gg npm prettier")
+		fmt.Println("  gg npm lodash@4.17.21")
 		fmt.Println("  gg npm lodash --fn debounce")
+		fmt.Println("  gg npm zod --readme")
+		fmt.Println("  gg npm express --deps")
+		fmt.Println("  gg npm audit lodash@4.17.15")
+		fmt.Println("  gg npm search markdown parser --limit 5")
+		return
+	}
+	if os.Args[2] == "audit" {
+		handleNPMAudit(os.Args[3:])
+		return
+	}
+	if os.Args[2] == "search" {
+		handleNPMSearch(os.Args[3:])
 		return
 	}
 
-	pkg := os.Args[2]
+	pkg := ""
+	showReadme := false
+	showDeps := false
+	for i := 2; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--readme":
+			showReadme = true
+		case "--deps":
+			showDeps = true
+		case "--json":
+			jsonOutput = true
+		case "--fn":
+			i++
+		default:
+			if pkg == "" {
+				pkg = os.Args[i]
+			}
+		}
+	}
+	if pkg == "" {
+		fmt.Println("Usage: gg npm <package>[@version] [--fn <function>] [--readme] [--deps] [--json]")
+		return
+	}
+	spec := pkg
+	pkg, pinned := splitNPMSpec(spec)
 
-	// Check local cache first
-	cacheDir := filepath.Join(getGGDir(), "cache", "npm")
+	pkgInfo, cached, err := fetchNPMPackage(pkg, pinned)
+	if jsonOutput {
+		if err != nil {
+			fatalError(fmt.Sprintf("Failed to fetch %s", spec), err)
+		}
+		data, _ := json.MarshalIndent(summarizeNPMPackage(pkgInfo, cached), "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if cached {
+		fmt.Printf("%s (cached)\n", spec)
+	} else {
+		fmt.Printf("Fetching %s from npm...\n", spec)
+	}
+	if err != nil {
+		fmt.Printf("Failed to fetch %s: %v\n", spec, err)
+		return
+	}
+
+	// Display MCP format
+	summary := summarizeNPMPackage(pkgInfo, cached)
+	name, pkgVersion, desc := summary.Name, summary.Version, summary.Description
+
+	fmt.Printf("\n%s@%s\n", name, pkgVersion)
+	if desc != "" {
+		fmt.Printf("   %s\n", desc)
+	}
+	if summary.License != "" {
+		fmt.Printf("   license: %s\n", summary.License)
+	}
+	if summary.Homepage != "" {
+		fmt.Printf("   homepage: %s\n", summary.Homepage)
+	}
+	deps := make([]string, 0, len(summary.Dependencies))
+	for dep := range summary.Dependencies {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps)
+	switch {
+	case len(deps) == 0:
+		fmt.Println("   dependencies: none")
+	case showDeps:
+		fmt.Printf("   dependencies: %d\n", len(deps))
+		for _, dep := range deps {
+			fmt.Printf("      %s %s\n", dep, summary.Dependencies[dep])
+		}
+	case len(deps) > npmDepsPreview:
+		fmt.Printf("   dependencies: %d (%s, +%d more; --deps to list)\n", len(deps), strings.Join(deps[:npmDepsPreview], ", "), len(deps)-npmDepsPreview)
+	default:
+		fmt.Printf("   dependencies: %d (%s)\n", len(deps), strings.Join(deps, ", "))
+	}
+
+	// Check for --fn flag
+	for i, arg := range os.Args {
+		if arg == "--fn" && i+1 < len(os.Args) {
+			fnName := os.Args[i+1]
+			fmt.Printf("\nFunction: %s\n", fnName)
+		}
+	}
+
+	fmt.Printf("\nMCP Endpoint: npm:%s\n", name)
+	fmt.Printf("Token cost: ~%d\n", summary.TokenCost)
+
+	if showReadme {
+		readme, err := fetchNPMReadme(pkg, pkgInfo)
+		if err != nil {
+			fmt.Printf("\nFailed to fetch README: %v\n", err)
+			return
+		}
+		if strings.TrimSpace(readme) == "" {
+			fmt.Println("\nNo README published for this package")
+			return
+		}
+		fmt.Println()
+		pageOutput(renderMarkdownLite(readme))
+	}
+}
+
+// npmDepsPreview is how many dependency names gg npm shows without --deps
+const npmDepsPreview = 8
+
+// npmPackageSummary is what gg npm --json prints
+type npmPackageSummary struct {
+	Name            string            `json:"name"`
+	Version         string            `json:"version"`
+	Description     string            `json:"description,omitempty"`
+	License         string            `json:"license,omitempty"`
+	Homepage        string            `json:"homepage,omitempty"`
+	DependencyCount int               `json:"dependency_count"`
+	Dependencies    map[string]string `json:"dependencies"`
+	Endpoint        string            `json:"endpoint"`
+	TokenCost       int64             `json:"token_cost"`
+	Cached          bool              `json:"cached"`
+}
+
+// summarizeNPMPackage extracts the fields gg npm shows from a registry
+// version document. Old packages give license as {"type": ...}.
+func summarizeNPMPackage(info map[string]interface{}, cached bool) npmPackageSummary {
+	s := npmPackageSummary{Dependencies: map[string]string{}, Cached: cached}
+	s.Name, _ = info["name"].(string)
+	s.Version, _ = info["version"].(string)
+	s.Description, _ = info["description"].(string)
+	s.Homepage, _ = info["homepage"].(string)
+	switch license := info["license"].(type) {
+	case string:
+		s.License = license
+	case map[string]interface{}:
+		s.License, _ = license["type"].(string)
+	}
+	if deps, ok := info["dependencies"].(map[string]interface{}); ok {
+		for dep, spec := range deps {
+			s.Dependencies[dep], _ = spec.(string)
+		}
+	}
+	s.DependencyCount = len(s.Dependencies)
+	s.Endpoint = "npm:" + s.Name
+	s.TokenCost = metadataTokens(s.Name, s.Version, s.Description)
+	return s
+}
+
+// splitNPMSpec splits "name@version" into its parts, leaving an @scope/
+// prefix intact. version is empty when none is given.
+func splitNPMSpec(spec string) (name, version string) {
+	if i := strings.LastIndex(spec, "@"); i > 0 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// fetchNPMPackage returns the registry document for pkg at pkgVersion, or
+// at latest when pkgVersion is empty. Pinned versions are cached as
+// <pkg>@<version>.json; latest is cached as <pkg>.json and also recorded
+// under its resolved version.
+func fetchNPMPackage(pkg, pkgVersion string) (map[string]interface{}, bool, error) {
+	cacheDir := filepath.Join(getCacheDir(), "npm")
 	cachePath := filepath.Join(cacheDir, pkg+".json")
+	urlVersion := "latest"
+	if pkgVersion != "" {
+		cachePath = filepath.Join(cacheDir, pkg+"@"+pkgVersion+".json")
+		urlVersion = pkgVersion
+	}
 
-	var pkgInfo map[string]interface{}
+	var info map[string]interface{}
+	if data, err := readCacheFile(cachePath); err == nil && json.Unmarshal(data, &info) == nil {
+		return info, true, nil
+	}
 
-	if data, err := os.ReadFile(cachePath); err == nil {
-		// Cache hit
-		json.Unmarshal(data, &pkgInfo)
-		fmt.Printf("%s (cached)\n", pkg)
+	resp, err := newHTTPClient(httpTimeout).Get(fmt.Sprintf("https://registry.npmjs.org/%s/%s", pkg, urlVersion))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		if pkgVersion != "" {
+			return nil, false, fmt.Errorf("version not found: %s@%s", pkg, pkgVersion)
+		}
+		return nil, false, fmt.Errorf("package not found: %s", pkg)
+	}
+	if resp.StatusCode != 200 {
+		return nil, false, fmt.Errorf("npm registry error: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, false, fmt.Errorf("parse response: %w", err)
+	}
+
+	data, _ := json.Marshal(info)
+	writeCacheFile(cachePath, data)
+	if resolved, _ := info["version"].(string); pkgVersion == "" && resolved != "" {
+		writeCacheFile(filepath.Join(cacheDir, pkg+"@"+resolved+".json"), data)
+	}
+	return info, false, nil
+}
+
+// npmAuditTTL is how long gg npm audit reuses advisory results
+const npmAuditTTL = 6 * time.Hour
+
+// osvVuln is the part of an OSV advisory gg npm audit shows
+type osvVuln struct {
+	ID               string   `json:"id"`
+	Summary          string   `json:"summary"`
+	Aliases          []string `json:"aliases"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+	Affected []struct {
+		Ranges []struct {
+			Events []struct {
+				Fixed string `json:"fixed"`
+			} `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+}
+
+// handleNPMAudit lists known advisories for an npm package version from
+// the OSV database. Exits 1 when any are found.
+func handleNPMAudit(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: gg npm audit <package>[@version]")
+		fmt.Println()
+		fmt.Println("Checks the version (default: latest) against the OSV advisory database")
+		return
+	}
+
+	pkg, pkgVersion := splitNPMSpec(args[0])
+	if pkgVersion == "" {
+		latest, err := fetchNPMLatestVersion(pkg)
+		if err != nil {
+			fatalError(fmt.Sprintf("Cannot resolve latest version of %s", pkg), err)
+		}
+		pkgVersion = latest
+	}
+
+	vulns, cached, err := fetchOSVVulns(pkg, pkgVersion)
+	if err != nil {
+		fatalError("Advisory lookup failed", err)
+	}
+
+	suffix := ""
+	if cached {
+		suffix = " (cached)"
+	}
+	fmt.Printf("%s@%s%s\n", pkg, pkgVersion, suffix)
+	if len(vulns) == 0 {
+		fmt.Println("No known advisories")
+		return
+	}
+
+	fmt.Printf("%d known advisor", len(vulns))
+	if len(vulns) == 1 {
+		fmt.Println("y:")
 	} else {
-		// Fetch from npm registry
-		fmt.Printf("Fetching %s from npm...\n", pkg)
-		url := fmt.Sprintf("https://registry.npmjs.org/%s/latest", pkg)
-		resp, err := http.Get(url)
+		fmt.Println("ies:")
+	}
+	for _, v := range vulns {
+		severity := v.DatabaseSpecific.Severity
+		if severity == "" {
+			severity = "UNKNOWN"
+		}
+		id := v.ID
+		for _, alias := range v.Aliases {
+			if strings.HasPrefix(alias, "CVE-") {
+				id += " / " + alias
+				break
+			}
+		}
+		fmt.Printf("\n  [%s] %s\n", severity, id)
+		if v.Summary != "" {
+			fmt.Printf("    %s\n", v.Summary)
+		}
+		var fixed []string
+		for _, a := range v.Affected {
+			for _, r := range a.Ranges {
+				for _, e := range r.Events {
+					if e.Fixed != "" && !slices.Contains(fixed, e.Fixed) {
+						fixed = append(fixed, e.Fixed)
+					}
+				}
+			}
+		}
+		if len(fixed) > 0 {
+			fmt.Printf("    Fixed in: %s\n", strings.Join(fixed, ", "))
+		}
+	}
+	os.Exit(1)
+}
+
+// fetchNPMLatestVersion returns the latest published version of pkg
+func fetchNPMLatestVersion(pkg string) (string, error) {
+	resp, err := newHTTPClient(httpTimeout).Get(fmt.Sprintf("https://registry.npmjs.org/%s/latest", pkg))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return "", fmt.Errorf("package not found: %s", pkg)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("npm registry error: %d", resp.StatusCode)
+	}
+	var doc struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", err
+	}
+	return doc.Version, nil
+}
+
+// fetchOSVVulns queries OSV for advisories affecting pkg@pkgVersion,
+// reusing a cached answer younger than npmAuditTTL
+func fetchOSVVulns(pkg, pkgVersion string) ([]osvVuln, bool, error) {
+	cachePath := filepath.Join(getCacheDir(), "npm", pkg+"@"+pkgVersion+".audit.json")
+	var result struct {
+		Vulns []osvVuln `json:"vulns"`
+	}
+	if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < npmAuditTTL {
+		if data, err := readCacheFile(cachePath); err == nil && json.Unmarshal(data, &result) == nil {
+			return result.Vulns, true, nil
+		}
+	}
+
+	query, _ := json.Marshal(map[string]interface{}{
+		"package": map[string]string{"name": pkg, "ecosystem": "npm"},
+		"version": pkgVersion,
+	})
+	resp, err := newHTTPClient(httpTimeout).Post("https://api.osv.dev/v1/query", "application/json", bytes.NewReader(query))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, false, fmt.Errorf("OSV API error: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false, err
+	}
+
+	writeCacheFile(cachePath, data)
+	return result.Vulns, false, nil
+}
+
+// npmSearchTTL is how long gg npm search reuses a result page
+const npmSearchTTL = 15 * time.Minute
+
+// npmSearchResult is the part of a registry search hit gg npm search shows
+type npmSearchResult struct {
+	Package struct {
+		Name        string `json:"name"`
+		Version     string `json:"version"`
+		Description string `json:"description"`
+	} `json:"package"`
+}
+
+// handleNPMSearch handles gg npm search <query> [--limit n]
+func handleNPMSearch(args []string) {
+	limit := 20
+	var words []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--limit" && i+1 < len(args) {
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 || n > 250 {
+				fmt.Println("--limit must be between 1 and 250")
+				os.Exit(1)
+			}
+			limit = n
+			i++
+		} else {
+			words = append(words, args[i])
+		}
+	}
+	query := strings.Join(words, " ")
+	if query == "" {
+		fmt.Println("Usage: gg npm search <query> [--limit n]")
+		return
+	}
+
+	results, cached, err := fetchNPMSearch(query, limit)
+	if err != nil {
+		fatalError("npm search failed", err)
+	}
+
+	suffix := ""
+	if cached {
+		suffix = " (cached)"
+	}
+	if len(results) == 0 {
+		fmt.Printf("No packages match %q%s\n", query, suffix)
+		return
+	}
+	fmt.Printf("%d result(s) for %q%s\n\n", len(results), query, suffix)
+	for i, r := range results {
+		fmt.Printf("%3d. %s@%s\n", i+1, r.Package.Name, r.Package.Version)
+		if r.Package.Description != "" {
+			fmt.Printf("     %s\n", truncate(r.Package.Description, 100))
+		}
+	}
+	fmt.Printf("\nDetails: gg npm <package>\n")
+}
+
+// fetchNPMSearch queries the registry search API, reusing a cached page
+// younger than npmSearchTTL
+func fetchNPMSearch(query string, limit int) ([]npmSearchResult, bool, error) {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", query, limit)))
+	cachePath := filepath.Join(getCacheDir(), "npm", "search", hex.EncodeToString(sum[:8])+".json")
+	var result struct {
+		Objects []npmSearchResult `json:"objects"`
+	}
+	if info, err := os.Stat(cachePath); err == nil && time.Since(info.ModTime()) < npmSearchTTL {
+		if data, err := readCacheFile(cachePath); err == nil && json.Unmarshal(data, &result) == nil {
+			return result.Objects, true, nil
+		}
+	}
+
+	searchURL := fmt.Sprintf("https://registry.npmjs.org/-/v1/search?text=%s&size=%d", url.QueryEscape(query), limit)
+	resp, err := newHTTPClient(httpTimeout).Get(searchURL)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, false, fmt.Errorf("npm registry error: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, false, fmt.Errorf("parse response: %w", err)
+	}
+
+	writeCacheFile(cachePath, data)
+	return result.Objects, false, nil
+}
+
+// fetchNPMReadme returns the package README, from the cache, the /latest
+// document, or the full registry document, caching the result
+func fetchNPMReadme(pkg string, latest map[string]interface{}) (string, error) {
+	cachePath := filepath.Join(getCacheDir(), "npm", pkg+".readme.md")
+	if data, err := readCacheFile(cachePath); err == nil {
+		return string(data), nil
+	}
+
+	readme, _ := latest["readme"].(string)
+	if readme == "" {
+		resp, err := newHTTPClient(httpTimeout).Get(fmt.Sprintf("https://registry.npmjs.org/%s", pkg))
 		if err != nil {
-			fmt.Printf("Failed to fetch package: %v\n", err)
-			return
+			return "", err
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return "", fmt.Errorf("npm registry error: %d", resp.StatusCode)
+		}
+		var doc struct {
+			Readme string `json:"readme"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+			return "", err
+		}
+		readme = doc.Readme
+	}
 
-		if resp.StatusCode == 404 {
-			fmt.Printf("Package not found: %s\n", pkg)
-			return
+	writeCacheFile(cachePath, []byte(readme))
+	return readme, nil
+}
+
+var (
+	mdImageRe     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdEmptyLinkRe = regexp.MustCompile(`\[\s*\]\([^)]*\)`)
+	mdLinkRe      = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	mdEmphasisRe  = regexp.MustCompile(`(\*\*|__)(.+?)(\*\*|__)`)
+	htmlTagRe     = regexp.MustCompile(`<[^>]+>`)
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+)
+
+// renderMarkdownLite strips markdown/HTML decoration for terminal reading:
+// headings are underlined, code blocks indented, links shown inline
+func renderMarkdownLite(md string) string {
+	md = htmlCommentRe.ReplaceAllString(md, "")
+
+	var out strings.Builder
+	inCode := false
+	blank := false
+	for _, line := range strings.Split(md, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			out.WriteString("    " + line + "\n")
+			continue
 		}
 
-		if resp.StatusCode != 200 {
-			fmt.Printf("npm registry error: %d\n", resp.StatusCode)
-			return
+		line = htmlTagRe.ReplaceAllString(line, "")
+		line = mdImageRe.ReplaceAllString(line, "")
+		line = mdEmptyLinkRe.ReplaceAllString(line, "") // linked badges
+		line = mdLinkRe.ReplaceAllString(line, "$1 ($2)")
+		line = mdEmphasisRe.ReplaceAllString(line, "$2")
+		line = strings.ReplaceAll(line, "`", "")
+
+		// Collapse runs of blank lines left by stripped badges/HTML
+		if strings.TrimSpace(line) == "" {
+			if !blank {
+				out.WriteString("\n")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+
+		if strings.HasPrefix(line, "#") {
+			level := len(line) - len(strings.TrimLeft(line, "#"))
+			title := strings.TrimSpace(line[level:])
+			underline := "-"
+			if level == 1 {
+				title = strings.ToUpper(title)
+				underline = "="
+			}
+			out.WriteString(title + "\n" + strings.Repeat(underline, len([]rune(title))) + "\n")
+			continue
 		}
-
-		if err := json.NewDecoder(resp.Body).Decode(&pkgInfo); err != nil {
-			fmt.Printf("Failed to parse response: %v\n", err)
-			return
+		if trimmed := strings.TrimLeft(line, " "); strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "- ") {
+			line = line[:len(line)-len(trimmed)] + "• " + trimmed[2:]
 		}
-
-		// Cache it
-		os.MkdirAll(cacheDir, 0755)
-		data, _ := json.Marshal(pkgInfo)
-		os.WriteFile(cachePath, data, 0644)
+		out.WriteString(line + "\n")
 	}
+	return strings.TrimSpace(out.String()) + "\n"
+}
 
-	// Display MCP format
-	name, _ := pkgInfo["name"].(string)
-	pkgVersion, _ := pkgInfo["version"].(string)
-	desc, _ := pkgInfo["description"].(string)
-
-	fmt.Printf("\n%s@%s\n", name, pkgVersion)
-	if desc != "" {
-		fmt.Printf("   %s\n", desc)
+// pageOutput writes text through $PAGER (default less) when stdout is a
+// terminal and the text is long, and prints it directly otherwise
+func pageOutput(text string) {
+	stat, err := os.Stdout.Stat()
+	if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 || strings.Count(text, "\n") < 40 {
+		fmt.Print(text)
+		return
 	}
 
-	// Check for --fn flag
-	for i, arg := range os.Args {
-		if arg == "--fn" && i+1 < len(os.Args) {
-			fnName := os.Args[i+1]
-			fmt.Printf("\nFunction: %s\n", fnName)
-		}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less -R"
+	}
+	cmd := command("sh", "-c", pager)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Print(text)
 	}
-
-	fmt.Printf("\nMCP Endpoint: npm:%s\n", name)
-	fmt.Printf("Token cost: ~%d\n", TokenCostNPM)
 }
 
 // handlePip fetches PyPI package info and displays MCP endpoint
@@ -2005,7 +8673,7 @@ func handlePip() {
 
 	var pkgInfo map[string]interface{}
 
-	if data, err := os.ReadFile(cachePath); err == nil {
+	if data, err := readCacheFile(cachePath); err == nil {
 		// Cache hit
 		json.Unmarshal(data, &pkgInfo)
 		fmt.Printf("%s (cached)\n", pkg)
@@ -2013,7 +8681,7 @@ func handlePip() {
 		// Fetch from PyPI registry
 		fmt.Printf("Fetching %s from PyPI...\n", pkg)
 		url := fmt.Sprintf("https://pypi.org/pypi/%s/json", pkg)
-		resp, err := http.Get(url)
+		resp, err := newHTTPClient(httpTimeout).Get(url)
 		if err != nil {
 			fmt.Printf("Failed to fetch package: %v\n", err)
 			return
@@ -2036,9 +8704,8 @@ func handlePip() {
 		}
 
 		// Cache it
-		os.MkdirAll(cacheDir, 0755)
 		data, _ := json.Marshal(pkgInfo)
-		os.WriteFile(cachePath, data, 0644)
+		writeCacheFile(cachePath, data)
 	}
 
 	// Extract info from nested structure
@@ -2062,30 +8729,43 @@ func handlePip() {
 	}
 
 	fmt.Printf("\nMCP Endpoint: pip:%s\n", name)
-	fmt.Printf("Token cost: ~%d\n", TokenCostNPM) // Same token cost as npm
+	fmt.Printf("Token cost: ~%d\n", metadataTokens(name, pkgVersion, summary))
 }
 
 // handleBrew fetches Homebrew formula info and displays MCP endpoint
 func handleBrew() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg brew [-i] <formula>")
+		fmt.Println("Usage: gg brew [-i] [--cask] <formula|cask>")
+		fmt.Println("       gg brew uninstall [--cask] [--cleanup] [--yes] <formula|cask>")
 		fmt.Println()
 		fmt.Println("Options:")
-		fmt.Println("  -i  Auto-install formula if not installed")
+		fmt.Println("  -i      Auto-install formula if not installed")
+		fmt.Println("  --cask  Look up a cask (GUI app) instead of a formula")
 		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  gg brew ffmpeg")
 		fmt.Println("  gg brew -i jq")
+		fmt.Println("  gg brew --cask visual-studio-code")
+		fmt.Println("  gg brew uninstall --cleanup jq")
+		return
+	}
+
+	if os.Args[2] == "uninstall" {
+		handleBrewUninstall(os.Args[3:])
 		return
 	}
 
-	// Parse -i flag
+	// Parse flags
 	autoInstall := false
+	cask := false
 	formula := ""
 	for _, arg := range os.Args[2:] {
-		if arg == "-i" {
+		switch arg {
+		case "-i":
 			autoInstall = true
-		} else {
+		case "--cask":
+			cask = true
+		default:
 			formula = arg
 		}
 	}
@@ -2095,72 +8775,67 @@ func handleBrew() {
 		return
 	}
 
-	// Check local cache first
-	cacheDir := filepath.Join(getGGDir(), "cache", "brew")
-	cachePath := filepath.Join(cacheDir, formula+".json")
-
 	var info map[string]interface{}
 	installed := false
 
 	// Try local brew first
-	cmd := exec.Command("brew", "info", formula, "--json=v2")
+	kindFlag := "--formula"
+	if cask {
+		kindFlag = "--cask"
+	}
+	cmd := command("brew", "info", kindFlag, formula, "--json=v2")
 	output, err := cmd.Output()
 	if err == nil {
 		var brewInfo map[string]interface{}
 		if json.Unmarshal(output, &brewInfo) == nil {
-			if formulae, ok := brewInfo["formulae"].([]interface{}); ok && len(formulae) > 0 {
-				info = formulae[0].(map[string]interface{})
+			key := "formulae"
+			if cask {
+				key = "casks"
+			}
+			if entries, ok := brewInfo[key].([]interface{}); ok && len(entries) > 0 {
+				info = entries[0].(map[string]interface{})
 				installed = true
+				if cask {
+					installed = info["installed"] != nil
+				}
 			}
 		}
 	}
 
-	// Fall back to API
+	// Fall back to API (formula first, then cask unless --cask was given)
 	if info == nil {
-		// Check cache
-		if data, err := os.ReadFile(cachePath); err == nil {
-			json.Unmarshal(data, &info)
-			fmt.Printf("%s (cached)\n", formula)
-		} else {
-			fmt.Printf("Fetching %s from Homebrew...\n", formula)
-			url := fmt.Sprintf("https://formulae.brew.sh/api/formula/%s.json", formula)
-			resp, err := http.Get(url)
-			if err != nil {
-				fmt.Printf("Failed to fetch formula: %v\n", err)
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode == 404 {
-				fmt.Printf("Formula not found: %s\n", formula)
-				return
-			}
-
-			if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
-				fmt.Printf("Failed to parse response: %v\n", err)
-				return
+		info, err = fetchBrewInfo(formula, cask)
+		if err == errBrewNotFound && !cask {
+			info, err = fetchBrewInfo(formula, true)
+			if err == nil {
+				cask = true
 			}
-
-			// Cache it
-			os.MkdirAll(cacheDir, 0755)
-			data, _ := json.Marshal(info)
-			os.WriteFile(cachePath, data, 0644)
+		}
+		if err == errBrewNotFound && cask {
+			fmt.Printf("Cask not found: %s\n", formula)
+			return
+		}
+		if err == errBrewNotFound {
+			fmt.Printf("No formula or cask named %s\n", formula)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to fetch formula: %v\n", err)
+			return
 		}
 	}
 
-	// Display info
-	name, _ := info["name"].(string)
-	desc, _ := info["desc"].(string)
+	name, formulaVersion, desc := brewSummary(info, cask)
 
-	var formulaVersion string
-	if versions, ok := info["versions"].(map[string]interface{}); ok {
-		formulaVersion, _ = versions["stable"].(string)
+	installArgs := []string{"install", formula}
+	if cask {
+		installArgs = []string{"install", "--cask", formula}
 	}
 
 	// Auto-install if -i flag and not installed
 	if !installed && autoInstall {
 		fmt.Printf("Installing %s...\n", formula)
-		installCmd := exec.Command("brew", "install", formula)
+		installCmd := command("brew", installArgs...)
 		installCmd.Stdout = os.Stdout
 		installCmd.Stderr = os.Stderr
 		if err := installCmd.Run(); err != nil {
@@ -2176,32 +8851,190 @@ func handleBrew() {
 		statusIcon = "not installed"
 	}
 
-	fmt.Printf("\n%s@%s (%s)\n", name, formulaVersion, statusIcon)
+	kind := ""
+	if cask {
+		kind = ", cask"
+	}
+	fmt.Printf("\n%s@%s (%s%s)\n", name, formulaVersion, statusIcon, kind)
 	if desc != "" {
 		fmt.Printf("   %s\n", desc)
 	}
 
 	if !installed && !autoInstall {
-		fmt.Printf("\n   Install: brew install %s\n", formula)
-		fmt.Println("   Or use: gg brew -i", formula)
+		fmt.Printf("\n   Install: brew %s\n", strings.Join(installArgs, " "))
+		if cask {
+			fmt.Println("   Or use: gg brew --cask -i", formula)
+		} else {
+			fmt.Println("   Or use: gg brew -i", formula)
+		}
+	}
+
+	if cask {
+		fmt.Printf("\nMCP Endpoint: cask:%s\n", formula)
+	} else {
+		fmt.Printf("\nMCP Endpoint: brew:%s\n", formula)
+	}
+	fmt.Printf("Token cost: ~%d\n", metadataTokens(name, formulaVersion, desc))
+}
+
+// brewSummary extracts the name, version and description from formula or
+// cask metadata (casks use token/name[]/version instead of name/versions)
+func brewSummary(info map[string]interface{}, cask bool) (name, version, desc string) {
+	name, _ = info["name"].(string)
+	desc, _ = info["desc"].(string)
+	if cask {
+		name, _ = info["token"].(string)
+		version, _ = info["version"].(string)
+		if names, ok := info["name"].([]interface{}); ok && len(names) > 0 && desc == "" {
+			desc, _ = names[0].(string)
+		}
+	} else if versions, ok := info["versions"].(map[string]interface{}); ok {
+		version, _ = versions["stable"].(string)
+	}
+	return name, version, desc
+}
+
+// handleBrewUninstall removes a formula (or cask) and its gg cache entry
+func handleBrewUninstall(args []string) {
+	cask := false
+	cleanup := false
+	yes := false
+	name := ""
+	for _, arg := range args {
+		switch arg {
+		case "--cask":
+			cask = true
+		case "--cleanup":
+			cleanup = true
+		case "--yes", "-y":
+			yes = true
+		default:
+			name = arg
+		}
+	}
+	if name == "" {
+		fmt.Println("Usage: gg brew uninstall [--cask] [--cleanup] [--yes] <formula|cask>")
+		return
+	}
+
+	if _, err := exec.LookPath("brew"); err != nil {
+		fatalError("Homebrew not found", err)
+	}
+
+	kindFlag, cacheKind := "--formula", "brew"
+	if cask {
+		kindFlag, cacheKind = "--cask", "brew-cask"
+	}
+
+	if !yes {
+		fmt.Printf("Uninstall %s", name)
+		if cleanup {
+			fmt.Print(" and clean up old versions")
+		}
+		fmt.Print("? [y/N]: ")
+		reader := bufio.NewReader(os.Stdin)
+		answer, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Cancelled")
+			return
+		}
+	}
+
+	cmd := command("brew", "uninstall", kindFlag, name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fatalError(fmt.Sprintf("Failed to uninstall %s", name), err)
+	}
+
+	if cleanup {
+		cleanupCmd := command("brew", "cleanup", name)
+		cleanupCmd.Stdout = os.Stdout
+		cleanupCmd.Stderr = os.Stderr
+		if err := cleanupCmd.Run(); err != nil {
+			fmt.Printf("Warning: brew cleanup failed: %v\n", err)
+		}
+	}
+
+	// Drop the cached metadata (and any pin) along with the install
+	cacheDir := filepath.Join(getCacheDir(), cacheKind)
+	if os.Remove(filepath.Join(cacheDir, name+".json")) == nil {
+		os.Remove(pinMarkerPath(cacheDir, name))
+		os.Remove(filepath.Join(getCacheDir(), ".size"))
+		fmt.Println("Removed cache entry")
+	}
+
+	fmt.Printf("Uninstalled %s\n", name)
+}
+
+var errBrewNotFound = fmt.Errorf("not found")
+
+// fetchBrewInfo returns formula (or cask) metadata from the cache or the
+// formulae.brew.sh API. Casks are cached separately under cache/brew-cask.
+func fetchBrewInfo(name string, cask bool) (map[string]interface{}, error) {
+	return fetchBrewInfoTo(os.Stdout, name, cask)
+}
+
+// fetchBrewInfoTo is fetchBrewInfo reporting cache hits and fetches to out
+func fetchBrewInfoTo(out io.Writer, name string, cask bool) (map[string]interface{}, error) {
+	kind, cacheKind := "formula", "brew"
+	if cask {
+		kind, cacheKind = "cask", "brew-cask"
+	}
+	cachePath := filepath.Join(getCacheDir(), cacheKind, name+".json")
+
+	var info map[string]interface{}
+	if data, err := readCacheFile(cachePath); err == nil {
+		if json.Unmarshal(data, &info) == nil {
+			fmt.Fprintf(out, "%s (cached)\n", name)
+			return info, nil
+		}
+	}
+
+	fmt.Fprintf(out, "Fetching %s from Homebrew...\n", name)
+	url := fmt.Sprintf("https://formulae.brew.sh/api/%s/%s.json", kind, name)
+	resp, err := newHTTPClient(httpTimeout).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, errBrewNotFound
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Homebrew API error: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
 	}
 
-	fmt.Printf("\nMCP Endpoint: brew:%s\n", formula)
-	fmt.Printf("Token cost: ~%d\n", TokenCostBrew)
+	// Cache it
+	data, _ := json.Marshal(info)
+	writeCacheFile(cachePath, data)
+	return info, nil
 }
 
 // handleChain chains multiple MCP tools together
 func handleChain() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: gg chain <tool:pkg> [tool:pkg...]")
-		fmt.Println("       gg chain --save <name> <tool:pkg> [tool:pkg...]")
-		fmt.Println("       gg chain run <name>")
+		fmt.Println("       gg chain --save [--force] <name> <tool:pkg> [tool:pkg...]")
+		fmt.Println("       gg chain --delete <name>")
+		fmt.Println("       gg chain --rename [--force] <old> <new>")
+		fmt.Println("       gg chain run <name> [--install] [--concurrency n] [--continue-on-error] [--env KEY=VAL]... [--env-file <path>]")
+		fmt.Println("       gg chain run <name> --serve [--install] [--env KEY=VAL]...   Serve the chain's tools over MCP (stdio)")
 		fmt.Println("       gg chain <saved-name>")
+		fmt.Println("       gg chain graph <name> [--format dot|mermaid] [--out <file>]")
 		fmt.Println()
 		fmt.Println("Examples:")
-		fmt.Println("  gg chain npm:prettier npm:eslint brew:jq")
-		fmt.Println("  gg chain --save webformat npm:prettier npm:eslint")
+		fmt.Println("  gg chain npm:prettier npm:eslint brew:jq cask:visual-studio-code")
+		fmt.Println("  gg chain --save webformat npm:prettier@3.3.3 npm:eslint")
 		fmt.Println("  gg chain run webformat")
+		fmt.Println("  gg chain run webformat --install --env HTTPS_PROXY=http://proxy:8080")
+		fmt.Println()
+		fmt.Println("chain run exits 0 when every tool is ready, 1 when some failed, 2 when all failed")
 		return
 	}
 
@@ -2209,22 +9042,118 @@ func handleChain() {
 
 	// Check for run subcommand
 	if args[0] == "run" {
-		if len(args) < 2 {
-			fmt.Println("Usage: gg chain run <name>")
+		var name string
+		var env []string
+		install := false
+		serve := false
+		concurrency := defaultChainConcurrency
+		for i := 1; i < len(args); i++ {
+			switch args[i] {
+			case "--install":
+				install = true
+			case "--serve":
+				serve = true
+			case "--concurrency", "-j":
+				if i+1 >= len(args) {
+					fmt.Println("--concurrency requires a number")
+					return
+				}
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 1 {
+					fmt.Println("--concurrency must be a positive integer")
+					return
+				}
+				concurrency = n
+				i++
+			case "--continue-on-error":
+				// The default; accepted so scripts can state it
+			case "--env":
+				if i+1 >= len(args) || !strings.Contains(args[i+1], "=") {
+					fmt.Println("--env requires KEY=VAL")
+					return
+				}
+				env = append(env, args[i+1])
+				i++
+			case "--env-file":
+				if i+1 >= len(args) {
+					fmt.Println("--env-file requires a path")
+					return
+				}
+				fileEnv, err := loadEnvFile(args[i+1])
+				if err != nil {
+					fmt.Printf("Failed to read env file: %v\n", err)
+					return
+				}
+				env = append(env, fileEnv...)
+				i++
+			default:
+				name = args[i]
+			}
+		}
+		if name == "" {
+			fmt.Println("Usage: gg chain run <name> [--install] [--serve] [--concurrency n] [--env KEY=VAL]... [--env-file <path>]")
+			return
+		}
+		if serve {
+			// Keep stdout for the protocol while installing and resolving tools
+			stdout := os.Stdout
+			os.Stdout = os.Stderr
+			if install {
+				runChain(name, env, true, concurrency)
+			}
+			srv, err := chainMCPServer(name, env)
+			if err != nil {
+				fatalError("Cannot serve chain", err)
+			}
+			fmt.Fprintf(os.Stderr, "gg MCP server for chain '%s': %d tools (stdio)\n", name, len(srv.Tools))
+			os.Stdout = stdout
+			serveMCP(srv)
+			return
+		}
+		os.Exit(runChain(name, env, install, concurrency))
+	}
+
+	if args[0] == "graph" {
+		if len(args) < 2 || strings.HasPrefix(args[1], "--") {
+			fmt.Println("Usage: gg chain graph <name> [--format dot|mermaid] [--out <file>]")
+			return
+		}
+		tools := loadChain(args[1])
+		if tools == nil {
+			fmt.Printf("Chain not found: %s\n", args[1])
+			fmt.Println("Run 'gg chain --list' to see saved chains")
 			return
 		}
-		runChain(args[1])
+		writeToolGraph(args[1], tools, args[2:])
 		return
 	}
 
 	// Check for --save flag
 	if args[0] == "--save" {
-		if len(args) < 3 {
-			fmt.Println("Usage: gg chain --save <name> <tool:pkg>...")
+		force := false
+		var rest []string
+		for _, arg := range args[1:] {
+			if arg == "--force" {
+				force = true
+			} else {
+				rest = append(rest, arg)
+			}
+		}
+		if len(rest) < 2 {
+			fmt.Println("Usage: gg chain --save [--force] <name> <tool:pkg>...")
+			return
+		}
+		chainName := rest[0]
+		tools := rest[1:]
+		if existing := loadChain(chainName); existing != nil && !force {
+			fmt.Printf("Chain '%s' already exists:\n", chainName)
+			for _, tool := range existing {
+				fmt.Printf("   - %s\n", tool)
+			}
+			fmt.Println()
+			fmt.Println("Use --force to overwrite it")
 			return
 		}
-		chainName := args[1]
-		tools := args[2:]
 		saveChain(chainName, tools)
 		fmt.Printf("Saved chain '%s' with %d tools\n", chainName, len(tools))
 		return
@@ -2236,6 +9165,52 @@ func handleChain() {
 		return
 	}
 
+	if args[0] == "--delete" {
+		if len(args) != 2 || filepath.Base(args[1]) != args[1] {
+			fmt.Println("Usage: gg chain --delete <name>")
+			return
+		}
+		if err := os.Remove(getChainPath(args[1])); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Printf("Chain not found: %s\n", args[1])
+				os.Exit(1)
+			}
+			fatalError("Failed to delete chain", err)
+		}
+		fmt.Printf("Deleted chain '%s'\n", args[1])
+		return
+	}
+
+	if args[0] == "--rename" {
+		force := false
+		var rest []string
+		for _, arg := range args[1:] {
+			if arg == "--force" {
+				force = true
+			} else {
+				rest = append(rest, arg)
+			}
+		}
+		if len(rest) != 2 || filepath.Base(rest[0]) != rest[0] || filepath.Base(rest[1]) != rest[1] {
+			fmt.Println("Usage: gg chain --rename [--force] <old> <new>")
+			return
+		}
+		oldName, newName := rest[0], rest[1]
+		if loadChain(oldName) == nil {
+			fmt.Printf("Chain not found: %s\n", oldName)
+			os.Exit(1)
+		}
+		if loadChain(newName) != nil && !force {
+			fmt.Printf("Chain '%s' already exists. Use --force to overwrite it\n", newName)
+			os.Exit(1)
+		}
+		if err := os.Rename(getChainPath(oldName), getChainPath(newName)); err != nil {
+			fatalError("Failed to rename chain", err)
+		}
+		fmt.Printf("Renamed chain '%s' to '%s'\n", oldName, newName)
+		return
+	}
+
 	// Check if first arg is a saved chain name
 	if !strings.Contains(args[0], ":") {
 		tools := loadChain(args[0])
@@ -2249,8 +9224,9 @@ func handleChain() {
 		}
 	}
 
+	estimates := estimateToolTokens(args)
 	fmt.Printf("Chained %d MCPs:\n", len(args))
-	totalCost := 0
+	var totalCost int64
 
 	for i, tool := range args {
 		parts := strings.SplitN(tool, ":", 2)
@@ -2262,38 +9238,82 @@ func handleChain() {
 		toolType := parts[0]
 		toolName := parts[1]
 
-		cost := getTokenCost(toolType)
-		fmt.Printf("   %d. %s:%s (~%d tokens)\n", i+1, toolType, toolName, cost)
-		totalCost += cost
+		fmt.Printf("   %d. %s:%s (%s)\n", i+1, toolType, toolName, estimates[i])
+		totalCost += estimates[i].Tokens
 	}
 
 	fmt.Printf("\nCombined token cost: ~%d\n", totalCost)
 }
 
-func getTokenCost(toolType string) int {
-	switch toolType {
-	case "npm":
-		return TokenCostNPM
-	case "brew":
-		return TokenCostBrew
-	case "git":
-		return TokenCostGit
-	default:
-		return TokenCostBase
+// metadataTokens estimates what a package's MCP summary costs a model:
+// its name, version and description at ~4 chars/token
+func metadataTokens(name, version, desc string) int64 {
+	return estimateTokens(name + "@" + version + "\n" + desc)
+}
+
+// toolEstimate is the estimated token cost of one chain or toolbelt entry.
+// Known is false when there was no metadata and only the name was counted.
+type toolEstimate struct {
+	Tokens int64
+	Known  bool
+}
+
+func (e toolEstimate) String() string {
+	if !e.Known {
+		return fmt.Sprintf("~%d tokens, no metadata", e.Tokens)
+	}
+	return fmt.Sprintf("~%d tokens", e.Tokens)
+}
+
+// estimateToolTokens estimates each type:name entry from its npm or
+// Homebrew metadata (cached or fetched, defaultChainConcurrency at a time)
+func estimateToolTokens(tools []string) []toolEstimate {
+	estimates := make([]toolEstimate, len(tools))
+	sem := make(chan struct{}, defaultChainConcurrency)
+	var wg sync.WaitGroup
+	for i, tool := range tools {
+		wg.Add(1)
+		go func(i int, tool string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			kind, name, _ := strings.Cut(tool, ":")
+			switch kind {
+			case "npm":
+				pkg, pinned := splitNPMSpec(name)
+				if info, _, err := fetchNPMPackage(pkg, pinned); err == nil {
+					version, _ := info["version"].(string)
+					desc, _ := info["description"].(string)
+					estimates[i] = toolEstimate{metadataTokens(pkg, version, desc), true}
+					return
+				}
+			case "brew", "cask":
+				if info, err := fetchBrewInfoTo(io.Discard, name, kind == "cask"); err == nil {
+					estimates[i] = toolEstimate{metadataTokens(brewSummary(info, kind == "cask")), true}
+					return
+				}
+			}
+			estimates[i] = toolEstimate{metadataTokens(name, "", ""), false}
+		}(i, tool)
 	}
+	wg.Wait()
+	return estimates
+}
+
+func getChainPath(name string) string {
+	return filepath.Join(getGGDir(), "chains", name+".json")
 }
 
 func saveChain(name string, tools []string) {
-	chainDir := filepath.Join(getGGDir(), "chains")
-	os.MkdirAll(chainDir, 0755)
+	chainPath := getChainPath(name)
+	os.MkdirAll(filepath.Dir(chainPath), 0755)
 
 	data, _ := json.Marshal(tools)
-	os.WriteFile(filepath.Join(chainDir, name+".json"), data, 0644)
+	os.WriteFile(chainPath, data, 0644)
 }
 
 func loadChain(name string) []string {
-	chainPath := filepath.Join(getGGDir(), "chains", name+".json")
-	data, err := os.ReadFile(chainPath)
+	data, err := os.ReadFile(getChainPath(name))
 	if err != nil {
 		return nil
 	}
@@ -2353,141 +9373,519 @@ var toolbelts = map[string][]string{
 	},
 }
 
+func getToolbeltsPath() string {
+	return filepath.Join(getGGDir(), "toolbelts.toml")
+}
+
+// loadCustomToolbelts reads ~/.gg/toolbelts.toml, a table of
+// name = ["tool:pkg", ...]
+func loadCustomToolbelts() (map[string][]string, error) {
+	belts := map[string][]string{}
+	if _, err := toml.DecodeFile(getToolbeltsPath(), &belts); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return belts, nil
+}
+
+func saveCustomToolbelts(belts map[string][]string) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Custom toolbelts for gg cool; entries override built-in belts of the same name\n")
+	if err := toml.NewEncoder(&buf).Encode(belts); err != nil {
+		return err
+	}
+	os.MkdirAll(getGGDir(), 0700)
+	return os.WriteFile(getToolbeltsPath(), buf.Bytes(), 0644)
+}
+
+// loadToolbelts merges custom toolbelts over the built-in ones, also
+// returning which names are custom
+func loadToolbelts() (map[string][]string, map[string]bool) {
+	merged := make(map[string][]string, len(toolbelts))
+	for name, tools := range toolbelts {
+		merged[name] = tools
+	}
+	custom := map[string]bool{}
+	belts, err := loadCustomToolbelts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %s: %v\n", getToolbeltsPath(), err)
+	}
+	for name, tools := range belts {
+		var valid []string
+		for _, tool := range tools {
+			if strings.Contains(tool, ":") {
+				valid = append(valid, tool)
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: toolbelt %s: ignoring %q (expected type:name)\n", name, tool)
+			}
+		}
+		merged[name] = valid
+		custom[name] = true
+	}
+	return merged, custom
+}
+
+// saveToolbelt handles gg cool --save [--force] <name> <tool:pkg>...
+func saveToolbelt(args []string) {
+	force := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "--force" {
+			force = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) < 2 {
+		fmt.Println("Usage: gg cool --save [--force] <name> <tool:pkg>...")
+		return
+	}
+	name, tools := rest[0], rest[1:]
+	for _, tool := range tools {
+		if parts := strings.SplitN(tool, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			fmt.Printf("Invalid tool: %s (expected type:name, e.g. npm:eslint)\n", tool)
+			return
+		}
+	}
+
+	belts, err := loadCustomToolbelts()
+	if err != nil {
+		fatalError("Failed to read "+getToolbeltsPath(), err)
+	}
+	if _, exists := belts[name]; exists && !force {
+		fmt.Printf("Toolbelt '%s' already exists. Use --force to overwrite it\n", name)
+		return
+	}
+	belts[name] = tools
+	if err := saveCustomToolbelts(belts); err != nil {
+		fatalError("Failed to save toolbelt", err)
+	}
+	fmt.Printf("Saved toolbelt '%s' with %d tools\n", name, len(tools))
+	if _, builtin := toolbelts[name]; builtin {
+		fmt.Printf("It replaces the built-in '%s' toolbelt\n", name)
+	}
+}
+
+// deleteToolbelt removes a custom toolbelt; built-in ones can't be deleted
+func deleteToolbelt(name string) {
+	belts, err := loadCustomToolbelts()
+	if err != nil {
+		fatalError("Failed to read "+getToolbeltsPath(), err)
+	}
+	if _, ok := belts[name]; !ok {
+		if _, builtin := toolbelts[name]; builtin {
+			fmt.Printf("'%s' is a built-in toolbelt and can't be deleted\n", name)
+		} else {
+			fmt.Printf("Toolbelt not found: %s\n", name)
+		}
+		os.Exit(1)
+	}
+	delete(belts, name)
+	if err := saveCustomToolbelts(belts); err != nil {
+		fatalError("Failed to save toolbelts", err)
+	}
+	fmt.Printf("Deleted toolbelt '%s'\n", name)
+	if _, builtin := toolbelts[name]; builtin {
+		fmt.Printf("The built-in '%s' toolbelt applies again\n", name)
+	}
+}
+
 // handleCool displays curated toolbelts
 func handleCool() {
 	if len(os.Args) < 3 {
 		fmt.Println("Usage: gg cool <toolbelt>")
 		fmt.Println("       gg cool --list")
+		fmt.Println("       gg cool --save [--force] <name> <tool:pkg>...")
+		fmt.Println("       gg cool --delete <name>")
+		fmt.Println("       gg cool graph <toolbelt> [--format dot|mermaid] [--out <file>]")
 		fmt.Println()
 		fmt.Println("Available toolbelts: webdev, media, sec, data, devops")
+		fmt.Println("Custom toolbelts live in ~/.gg/toolbelts.toml")
 		return
 	}
 
 	arg := os.Args[2]
+	belts, custom := loadToolbelts()
 
 	if arg == "--list" {
+		names := make([]string, 0, len(belts))
+		for name := range belts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
 		fmt.Println("Available toolbelts:")
 		fmt.Println()
-		for name, tools := range toolbelts {
-			fmt.Printf("   %s (%d tools)\n", name, len(tools))
+		for _, name := range names {
+			tools := belts[name]
+			kind := "built-in"
+			if custom[name] {
+				kind = "custom"
+			}
+			fmt.Printf("   %s (%d tools, %s)\n", name, len(tools), kind)
 			for _, tool := range tools {
 				parts := strings.SplitN(tool, ":", 2)
 				fmt.Printf("      - %s (%s)\n", parts[1], parts[0])
 			}
-			fmt.Println()
+			fmt.Println()
+		}
+		return
+	}
+
+	if arg == "--save" {
+		saveToolbelt(os.Args[3:])
+		return
+	}
+
+	if arg == "--delete" {
+		if len(os.Args) != 4 {
+			fmt.Println("Usage: gg cool --delete <name>")
+			return
+		}
+		deleteToolbelt(os.Args[3])
+		return
+	}
+
+	if arg == "graph" {
+		if len(os.Args) < 4 {
+			fmt.Println("Usage: gg cool graph <toolbelt> [--format dot|mermaid] [--out <file>]")
+			return
+		}
+		tools, ok := belts[os.Args[3]]
+		if !ok {
+			fmt.Printf("Unknown toolbelt: %s\n", os.Args[3])
+			fmt.Println("Run 'gg cool --list' to see available toolbelts")
+			return
+		}
+		writeToolGraph(os.Args[3], tools, os.Args[4:])
+		return
+	}
+
+	tools, ok := belts[arg]
+	if !ok {
+		fmt.Printf("Unknown toolbelt: %s\n", arg)
+		fmt.Println("Run 'gg cool --list' to see available toolbelts")
+		return
+	}
+
+	estimates := estimateToolTokens(tools)
+	fmt.Printf("Toolbelt: %s\n\n", arg)
+	var totalCost int64
+
+	for i, tool := range tools {
+		parts := strings.SplitN(tool, ":", 2)
+		toolType := parts[0]
+		toolName := parts[1]
+
+		fmt.Printf("   - %s (%s, %s)\n", toolName, toolType, estimates[i])
+		totalCost += estimates[i].Tokens
+	}
+
+	fmt.Printf("\nCombined token cost: ~%d\n", totalCost)
+	fmt.Printf("\nChain all: gg chain %s\n", strings.Join(tools, " "))
+}
+
+// writeToolGraph renders a chain or toolbelt as a graph of name -> tools ->
+// package sources, to stdout or --out
+func writeToolGraph(name string, tools []string, args []string) {
+	format := "dot"
+	outPath := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
+		case "--mermaid":
+			format = "mermaid"
+		case "--out":
+			if i+1 < len(args) {
+				outPath = args[i+1]
+				i++
+			}
+		default:
+			fmt.Printf("Unknown graph flag: %s\n", args[i])
+			return
 		}
+	}
+
+	var graph string
+	switch format {
+	case "dot":
+		graph = toolGraphDOT(name, tools)
+	case "mermaid":
+		graph = toolGraphMermaid(name, tools)
+	default:
+		fmt.Printf("Unknown graph format: %s (use dot or mermaid)\n", format)
 		return
 	}
 
-	tools, ok := toolbelts[arg]
-	if !ok {
-		fmt.Printf("Unknown toolbelt: %s\n", arg)
-		fmt.Println("Run 'gg cool --list' to see available toolbelts")
+	if outPath == "" {
+		fmt.Print(graph)
 		return
 	}
+	if err := os.WriteFile(outPath, []byte(graph), 0644); err != nil {
+		fatalError("Failed to write graph", err)
+	}
+	fmt.Printf("Wrote %s graph of '%s' to %s\n", format, name, outPath)
+}
 
-	fmt.Printf("Toolbelt: %s\n\n", arg)
-	totalCost := 0
+func toolGraphDOT(name string, tools []string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "digraph %s {\n", strconv.Quote(name))
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=box];\n")
+	fmt.Fprintf(&sb, "  %s [shape=ellipse, style=bold];\n", strconv.Quote(name))
 
+	sources := map[string]bool{}
 	for _, tool := range tools {
-		parts := strings.SplitN(tool, ":", 2)
-		toolType := parts[0]
-		toolName := parts[1]
+		toolType, toolName, _ := strings.Cut(tool, ":")
+		fmt.Fprintf(&sb, "  %s [label=%s];\n", strconv.Quote(tool), strconv.Quote(toolName))
+		fmt.Fprintf(&sb, "  %s -> %s;\n", strconv.Quote(name), strconv.Quote(tool))
+		fmt.Fprintf(&sb, "  %s -> %s;\n", strconv.Quote(tool), strconv.Quote("source:"+toolType))
+		sources[toolType] = true
+	}
+	for _, src := range sortedKeys(sources) {
+		fmt.Fprintf(&sb, "  %s [label=%s, shape=cylinder];\n", strconv.Quote("source:"+src), strconv.Quote(src))
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func toolGraphMermaid(name string, tools []string) string {
+	// Mermaid ids must be plain; labels carry the real names
+	label := func(s string) string { return strings.ReplaceAll(s, `"`, "#quot;") }
+
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+	fmt.Fprintf(&sb, "  root([\"%s\"])\n", label(name))
 
-		cost := getTokenCost(toolType)
-		fmt.Printf("   - %s (%s)\n", toolName, toolType)
-		totalCost += cost
+	sources := map[string]bool{}
+	for i, tool := range tools {
+		toolType, toolName, _ := strings.Cut(tool, ":")
+		fmt.Fprintf(&sb, "  t%d[\"%s\"]\n", i, label(toolName))
+		fmt.Fprintf(&sb, "  root --> t%d\n", i)
+		fmt.Fprintf(&sb, "  t%d --> src_%s\n", i, mermaidID(toolType))
+		sources[toolType] = true
+	}
+	for _, src := range sortedKeys(sources) {
+		fmt.Fprintf(&sb, "  src_%s[(\"%s\")]\n", mermaidID(src), label(src))
 	}
+	return sb.String()
+}
 
-	fmt.Printf("\nCombined token cost: ~%d\n", totalCost)
-	fmt.Printf("\nChain all: gg chain %s\n", strings.Join(tools, " "))
+var mermaidIDRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// mermaidID reduces s to characters valid in a Mermaid node id
+func mermaidID(s string) string {
+	return mermaidIDRe.ReplaceAllString(s, "_")
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-// runChain executes all tools in a saved chain
-func runChain(name string) {
+// Exit codes for gg chain run
+const (
+	chainExitPartial   = 1 // some tools failed
+	chainExitAllFailed = 2 // every tool failed (or the chain is missing)
+)
+
+// defaultChainConcurrency is how many chain tools are checked at once
+const defaultChainConcurrency = 4
+
+// runChain checks (and with install, installs) every tool in the chain,
+// continuing past failures. env holds extra KEY=VAL entries passed to every
+// subprocess. It returns the process exit code.
+func runChain(name string, env []string, install bool, concurrency int) int {
 	tools := loadChain(name)
 	if tools == nil {
 		fmt.Printf("Chain not found: %s\n", name)
 		fmt.Println("Run 'gg chain --list' to see saved chains")
-		return
+		return chainExitAllFailed
 	}
 
 	fmt.Printf("Executing chain '%s'...\n\n", name)
+	if len(env) > 0 {
+		fmt.Printf("Extra env: %d variable(s)\n\n", len(env))
+	}
 
-	success := 0
+	// Check tools on a bounded pool; each buffers its output so results
+	// print in chain order as soon as they (and those before them) finish
+	type toolResult struct {
+		ok   bool
+		out  bytes.Buffer
+		done chan struct{}
+	}
+	results := make([]*toolResult, len(tools))
+	for i := range results {
+		results[i] = &toolResult{done: make(chan struct{})}
+	}
+	sem := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
 	for i, tool := range tools {
-		parts := strings.SplitN(tool, ":", 2)
-		if len(parts) != 2 {
-			fmt.Printf("[%d/%d] Invalid: %s\n", i+1, len(tools), tool)
-			continue
-		}
-
-		toolType := parts[0]
-		toolName := parts[1]
-
-		fmt.Printf("[%d/%d] %s:%s\n", i+1, len(tools), toolType, toolName)
+		wg.Add(1)
+		go func(i int, tool string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r := results[i]
+			defer close(r.done)
+
+			parts := strings.SplitN(tool, ":", 2)
+			if len(parts) != 2 {
+				fmt.Fprintf(&r.out, "[%d/%d] Invalid: %s\n", i+1, len(tools), tool)
+				return
+			}
+			toolType := parts[0]
+			toolName := parts[1]
+
+			fmt.Fprintf(&r.out, "[%d/%d] %s:%s\n", i+1, len(tools), toolType, toolName)
+			switch toolType {
+			case "npm":
+				r.ok = runNPMCheck(&r.out, toolName, env, install)
+			case "brew", "cask":
+				r.ok = runBrewCheck(&r.out, toolName, env, install, toolType == "cask")
+			default:
+				fmt.Fprintf(&r.out, "   Unknown type: %s\n", toolType)
+			}
+			r.out.WriteString("\n")
+		}(i, tool)
+	}
 
-		switch toolType {
-		case "npm":
-			runNPMCheck(toolName)
-		case "brew":
-			runBrewCheck(toolName)
-		default:
-			fmt.Printf("   Unknown type: %s\n", toolType)
+	success := 0
+	var failed []string
+	for i, r := range results {
+		<-r.done
+		os.Stdout.Write(r.out.Bytes())
+		if r.ok {
+			success++
+		} else {
+			failed = append(failed, tools[i])
 		}
-
-		success++
-		fmt.Println()
 	}
+	wg.Wait()
 
 	fmt.Printf("Chain complete: %d/%d tools ready\n", success, len(tools))
+	if len(failed) == 0 {
+		return 0
+	}
+	fmt.Println("Failed:")
+	for _, tool := range failed {
+		fmt.Printf("   - %s\n", tool)
+	}
+	if success == 0 {
+		return chainExitAllFailed
+	}
+	return chainExitPartial
 }
 
-func runNPMCheck(pkg string) {
-	cacheDir := filepath.Join(getGGDir(), "cache", "npm")
-	cachePath := filepath.Join(cacheDir, pkg+".json")
+// chainInstallMu serializes installs during a parallel chain run; npm -g
+// and brew both lock their prefixes
+var chainInstallMu sync.Mutex
 
-	if _, err := os.ReadFile(cachePath); err == nil {
-		fmt.Printf("   %s (cached)\n", pkg)
-		return
+// runNPMCheck resolves (and with install, installs) an npm package,
+// reporting whether it is ready
+func runNPMCheck(out io.Writer, pkg string, env []string, install bool) bool {
+	name, pinned := splitNPMSpec(pkg)
+	info, cached, err := fetchNPMPackage(name, pinned)
+	if err != nil {
+		fmt.Fprintf(out, "   %s (error)\n", pkg)
+		return false
 	}
-
-	url := fmt.Sprintf("https://registry.npmjs.org/%s/latest", pkg)
-	resp, err := http.Get(url)
-	if err != nil || resp.StatusCode != 200 {
-		fmt.Printf("   %s (error)\n", pkg)
-		return
+	if cached {
+		fmt.Fprintf(out, "   %s (cached)\n", pkg)
+	} else {
+		pkgVersion, _ := info["version"].(string)
+		fmt.Fprintf(out, "   %s@%s\n", name, pkgVersion)
+	}
+
+	if install {
+		chainInstallMu.Lock()
+		defer chainInstallMu.Unlock()
+		// pkg keeps any @version pin
+		installCmd := command("npm", "install", "-g", pkg)
+		installCmd.Env = append(os.Environ(), env...)
+		if output, err := installCmd.CombinedOutput(); err != nil {
+			fmt.Fprintf(out, "   install failed: %s\n", truncate(strings.TrimSpace(string(output)), 200))
+			return false
+		}
+		fmt.Fprintf(out, "   %s installed\n", pkg)
 	}
-	defer resp.Body.Close()
+	return true
+}
 
-	var info map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&info)
+// runBrewCheck checks (and with install, installs) a Homebrew formula or
+// cask, reporting whether it is ready
+func runBrewCheck(out io.Writer, formula string, env []string, install, cask bool) bool {
+	kindFlag := "--formula"
+	if cask {
+		kindFlag = "--cask"
+	}
+	cmd := command("brew", "list", kindFlag, "--versions", formula)
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Run(); err == nil {
+		fmt.Fprintf(out, "   %s (installed)\n", formula)
+		return true
+	}
 
-	os.MkdirAll(cacheDir, 0755)
-	data, _ := json.Marshal(info)
-	os.WriteFile(cachePath, data, 0644)
+	if !install {
+		fmt.Fprintf(out, "   %s (not installed)\n", formula)
+		return false
+	}
 
-	pkgVersion, _ := info["version"].(string)
-	fmt.Printf("   %s@%s\n", pkg, pkgVersion)
+	chainInstallMu.Lock()
+	defer chainInstallMu.Unlock()
+	installCmd := command("brew", "install", kindFlag, formula)
+	installCmd.Env = append(os.Environ(), env...)
+	if output, err := installCmd.CombinedOutput(); err != nil {
+		fmt.Fprintf(out, "   install failed: %s\n", truncate(strings.TrimSpace(string(output)), 200))
+		return false
+	}
+	fmt.Fprintf(out, "   %s installed\n", formula)
+	return true
 }
 
-func runBrewCheck(formula string) {
-	cmd := exec.Command("brew", "info", formula, "--json=v2")
-	if err := cmd.Run(); err == nil {
-		fmt.Printf("   %s (installed)\n", formula)
-	} else {
-		fmt.Printf("   %s (not installed)\n", formula)
+// loadEnvFile reads KEY=VAL lines from path, skipping blanks and # comments
+func loadEnvFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		if !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VAL", path, i+1)
+		}
+		env = append(env, line)
 	}
+	return env, nil
 }
 
 // handleCache manages the gg cache
 func handleCache() {
 	if len(os.Args) < 3 {
-		fmt.Println("Usage: gg cache <status|clean>")
+		fmt.Println("Usage: gg cache <status|clean|lock|unlock|migrate>")
 		fmt.Println()
 		fmt.Println("Commands:")
-		fmt.Println("  status  Show cache size and contents")
-		fmt.Println("  clean   Remove old cache entries")
+		fmt.Println("  status               Show cache size and contents")
+		fmt.Println("  clean [type] [--max-age 14d|--all] [--dry-run]")
+		fmt.Println("                       Remove entries older than [cache] ttl_days (default 7),")
+		fmt.Println("                       optionally only one type (npm, pip, brew, cask, responses)")
+		fmt.Println("  migrate              Upgrade entries written by older gg versions (runs automatically)")
+		fmt.Println("  lock <type> <name>   Pin an entry so clean/eviction keep it (npm, pip, brew, cask)")
+		fmt.Println("  unlock <type> <name> Release a pinned entry")
 		return
 	}
 
@@ -2497,7 +9895,50 @@ func handleCache() {
 	case "status":
 		showCacheStatus(cacheDir)
 	case "clean":
-		cleanCache(cacheDir)
+		maxAge := time.Duration(defaultCacheTTLDays) * 24 * time.Hour
+		if days := loadPlainConfig().Cache.TTLDays; days > 0 {
+			maxAge = time.Duration(days) * 24 * time.Hour
+		}
+		dryRun := false
+		cacheType := ""
+		args := os.Args[3:]
+		for i := 0; i < len(args); i++ {
+			switch args[i] {
+			case "--dry-run", "-n":
+				dryRun = true
+			case "--all":
+				maxAge = 0
+			case "--max-age":
+				if i+1 >= len(args) {
+					fmt.Println("--max-age requires a value (e.g. 14d, 12h)")
+					return
+				}
+				d, err := parseMaxAge(args[i+1])
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+				maxAge = d
+				i++
+			default:
+				_, known := cacheTypeDirs[args[i]]
+				if strings.HasPrefix(args[i], "-") || cacheType != "" || (!known && args[i] != "responses") {
+					fmt.Printf("Unknown argument: %s\n", args[i])
+					fmt.Println("Usage: gg cache clean [npm|pip|brew|cask|responses] [--max-age 14d|--all] [--dry-run]")
+					return
+				}
+				cacheType = args[i]
+			}
+		}
+		cleanCache(cacheDir, cacheType, maxAge, dryRun)
+	case "migrate":
+		migrateCache(true)
+	case "lock", "unlock":
+		if len(os.Args) < 5 {
+			fmt.Printf("Usage: gg cache %s <npm|pip|brew|cask> <name>\n", os.Args[2])
+			return
+		}
+		setCachePinned(os.Args[3], os.Args[4], os.Args[2] == "lock")
 	default:
 		fmt.Printf("Unknown cache command: %s\n", os.Args[2])
 	}
@@ -2508,19 +9949,157 @@ func showCacheStatus(cacheDir string) {
 	npmSize := getCacheSize(filepath.Join(cacheDir, "npm"))
 	brewSize := getCacheSize(filepath.Join(cacheDir, "brew"))
 
+	caskSize := getCacheSize(filepath.Join(cacheDir, "brew-cask"))
+
 	npmCount := countFiles(filepath.Join(cacheDir, "npm"))
 	brewCount := countFiles(filepath.Join(cacheDir, "brew"))
+	caskCount := countFiles(filepath.Join(cacheDir, "brew-cask"))
+	respSize := getCacheSize(filepath.Join(cacheDir, "responses"))
+	respCount := countFiles(filepath.Join(cacheDir, "responses"))
 
 	fmt.Println("Cache Status")
 	fmt.Println()
 	fmt.Printf("   Total: %s\n", formatSize(total))
 	fmt.Printf("   npm:   %s (%d packages)\n", formatSize(npmSize), npmCount)
 	fmt.Printf("   brew:  %s (%d formulas)\n", formatSize(brewSize), brewCount)
+	fmt.Printf("   cask:  %s (%d casks)\n", formatSize(caskSize), caskCount)
+	if respCount > 0 {
+		fmt.Printf("   ask:   %s (%d responses)\n", formatSize(respSize), respCount)
+	}
+	if pinned := listPinnedEntries(cacheDir); len(pinned) > 0 {
+		fmt.Println()
+		fmt.Printf("   Pinned (%d):\n", len(pinned))
+		for _, p := range pinned {
+			fmt.Printf("      - %s\n", p)
+		}
+	}
 	fmt.Println()
 	fmt.Printf("   Location: %s\n", cacheDir)
 }
 
-func cleanCache(cacheDir string) {
+// cacheTypeDirs maps cache lock/unlock types to their cache subdirectory
+var cacheTypeDirs = map[string]string{
+	"npm":  "npm",
+	"pip":  "pip",
+	"brew": "brew",
+	"cask": "brew-cask",
+}
+
+// pinMarkerPath returns the sidecar marker that pins a cache entry; the
+// dotfile is ignored by size accounting, clean and eviction
+func pinMarkerPath(dir, name string) string {
+	return filepath.Join(dir, filepath.Dir(name), "."+filepath.Base(name)+".pinned")
+}
+
+func setCachePinned(cacheType, name string, pin bool) {
+	sub, ok := cacheTypeDirs[cacheType]
+	if !ok {
+		fmt.Printf("Unknown cache type: %s (use npm, pip, brew or cask)\n", cacheType)
+		return
+	}
+	dir := filepath.Join(getCacheDir(), sub)
+	marker := pinMarkerPath(dir, name)
+
+	if !pin {
+		if err := os.Remove(marker); err != nil {
+			fmt.Printf("%s:%s is not pinned\n", cacheType, name)
+			return
+		}
+		fmt.Printf("Unpinned %s:%s\n", cacheType, name)
+		return
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, name+".json")); err != nil {
+		fmt.Printf("%s:%s is not cached. Fetch it first: gg %s %s\n", cacheType, name, cacheType, name)
+		return
+	}
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		fatalError("Failed to pin cache entry", err)
+	}
+	fmt.Printf("Pinned %s:%s\n", cacheType, name)
+}
+
+// isPinnedCacheFile reports whether path belongs to a pinned entry. An
+// entry's files share a stem: <name>.json, <name>.readme.md. npm entries
+// also keep versioned files (<name>@<version>.json, .audit.json), which a
+// pin on <name> covers too.
+func isPinnedCacheFile(path string) bool {
+	dir := filepath.Dir(path)
+	stem := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".json"), ".readme.md")
+	stem = strings.TrimSuffix(stem, ".audit")
+	if _, err := os.Stat(filepath.Join(dir, "."+stem+".pinned")); err == nil {
+		return true
+	}
+	rel, err := filepath.Rel(filepath.Join(getCacheDir(), "npm"), path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	name, version := splitNPMSpec(stem)
+	if version == "" {
+		return false
+	}
+	_, err = os.Stat(filepath.Join(dir, "."+name+".pinned"))
+	return err == nil
+}
+
+// listPinnedEntries returns pinned entries as type:name
+func listPinnedEntries(cacheDir string) []string {
+	var pinned []string
+	for cacheType, sub := range cacheTypeDirs {
+		dir := filepath.Join(cacheDir, sub)
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), ".pinned") {
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, filepath.Dir(path))
+			name := strings.TrimSuffix(strings.TrimPrefix(info.Name(), "."), ".pinned")
+			if rel != "." {
+				name = filepath.ToSlash(filepath.Join(rel, name))
+			}
+			pinned = append(pinned, cacheType+":"+name)
+			return nil
+		})
+	}
+	sort.Strings(pinned)
+	return pinned
+}
+
+// defaultCacheTTLDays is the gg cache clean cutoff when [cache] ttl_days
+// is unset
+const defaultCacheTTLDays = 7
+
+// parseMaxAge parses an age like 14d, 12h or 90m; a bare number is days
+func parseMaxAge(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid --max-age %q (e.g. 14d, 12h)", s)
+}
+
+// formatAge renders d in whole days, or hours/minutes below a day
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
+
+// cleanCache removes unpinned entries older than maxAge (all of them when
+// maxAge is 0), only under cacheType's directory when given. dryRun only
+// lists them.
+func cleanCache(cacheDir, cacheType string, maxAge time.Duration, dryRun bool) {
 	type entry struct {
 		path  string
 		mtime time.Time
@@ -2528,36 +10107,278 @@ func cleanCache(cacheDir string) {
 	}
 	var entries []entry
 
-	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			entries = append(entries, entry{path, info.ModTime(), info.Size()})
+	root := cacheDir
+	if cacheType != "" {
+		sub, ok := cacheTypeDirs[cacheType]
+		if !ok {
+			sub = cacheType
 		}
+		root = filepath.Join(cacheDir, sub)
+	}
+
+	var pinned int
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		if isPinnedCacheFile(path) {
+			pinned++
+			return nil
+		}
+		entries = append(entries, entry{path, info.ModTime(), info.Size()})
 		return nil
 	})
 
-	if len(entries) == 0 {
-		fmt.Println("Cache is empty")
+	if len(entries) == 0 && pinned == 0 {
+		if cacheType != "" {
+			fmt.Printf("No %s cache entries\n", cacheType)
+		} else {
+			fmt.Println("Cache is empty")
+		}
 		return
 	}
 
-	// Remove entries older than 7 days
-	cutoff := time.Now().AddDate(0, 0, -7)
+	cutoff := time.Now().Add(-maxAge)
+	ageDesc := "older than " + formatAge(maxAge)
+	if maxAge == 0 {
+		ageDesc = "of any age"
+	}
 	var freed int64
 	var removed int
 
 	for _, e := range entries {
 		if e.mtime.Before(cutoff) {
-			os.Remove(e.path)
+			if dryRun {
+				rel, _ := filepath.Rel(cacheDir, e.path)
+				fmt.Printf("   would remove %s (%s, %s old)\n", rel, formatSize(e.size), formatAge(time.Since(e.mtime)))
+			} else {
+				os.Remove(e.path)
+			}
 			freed += e.size
 			removed++
 		}
 	}
 
+	if dryRun {
+		if removed == 0 {
+			fmt.Printf("No cache entries %s\n", ageDesc)
+		} else {
+			fmt.Printf("Would free %s (%d entries %s)\n", formatSize(freed), removed, ageDesc)
+		}
+		return
+	}
+
+	// Force the running size total to be recomputed
+	os.Remove(filepath.Join(cacheDir, ".size"))
+
 	if removed == 0 {
-		fmt.Println("No old cache entries to clean")
+		fmt.Printf("No cache entries %s\n", ageDesc)
 	} else {
 		fmt.Printf("Cleaned cache: %s freed (%d entries removed)\n", formatSize(freed), removed)
 	}
+	if pinned > 0 {
+		fmt.Printf("Kept %d pinned file(s)\n", pinned)
+	}
+}
+
+// Default cache bound when [cache] max_size_mb is unset; eviction trims
+// down to cacheLowWaterPct of the limit.
+const (
+	defaultCacheMaxMB = 200
+	cacheLowWaterPct  = 80
+)
+
+func getCacheDir() string {
+	return filepath.Join(getGGDir(), "cache")
+}
+
+// cacheMigrations upgrade the cache layout one version at a time; entry i
+// moves a cache from layout version i to i+1. The current version is kept
+// in cache/.layout.
+var cacheMigrations = []func(cacheDir string) int{
+	migrateNPMResolvedVersions,
+}
+
+// migrateCache brings the cache up to the current layout. verbose reports
+// what was done even when nothing needed to change.
+func migrateCache(verbose bool) {
+	cacheDir := getCacheDir()
+	if _, err := os.Stat(cacheDir); err != nil {
+		if verbose {
+			fmt.Println("Cache is empty; nothing to migrate")
+		}
+		return
+	}
+
+	layoutPath := filepath.Join(cacheDir, ".layout")
+	current := 0
+	if data, err := os.ReadFile(layoutPath); err == nil {
+		current, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if current >= len(cacheMigrations) {
+		if verbose {
+			fmt.Printf("Cache layout is up to date (v%d)\n", current)
+		}
+		return
+	}
+
+	changed := 0
+	for v := current; v < len(cacheMigrations); v++ {
+		changed += cacheMigrations[v](cacheDir)
+	}
+	os.WriteFile(layoutPath, []byte(strconv.Itoa(len(cacheMigrations))+"\n"), 0644)
+	// Force the running size total to be recomputed
+	os.Remove(filepath.Join(cacheDir, ".size"))
+
+	if verbose || changed > 0 {
+		fmt.Fprintf(os.Stderr, "Migrated cache from layout v%d to v%d (%d entries updated)\n", current, len(cacheMigrations), changed)
+	}
+}
+
+// migrateNPMResolvedVersions records each cached npm latest document
+// (<pkg>.json) under its resolved version too (<pkg>@<version>.json), as
+// gg npm has done since versions could be pinned
+func migrateNPMResolvedVersions(cacheDir string) int {
+	npmDir := filepath.Join(cacheDir, "npm")
+	added := 0
+	filepath.Walk(npmDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		stem, ok := strings.CutSuffix(info.Name(), ".json")
+		if !ok || strings.Contains(stem, "@") || strings.HasSuffix(stem, ".audit") {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var doc struct {
+			Version string `json:"version"`
+		}
+		if json.Unmarshal(data, &doc) != nil || doc.Version == "" {
+			return nil
+		}
+		versioned := filepath.Join(filepath.Dir(path), stem+"@"+doc.Version+".json")
+		if _, err := os.Stat(versioned); os.IsNotExist(err) && os.WriteFile(versioned, data, 0644) == nil {
+			added++
+		}
+		return nil
+	})
+	return added
+}
+
+// cacheSizeMu guards the running size total in cache/.size
+var cacheSizeMu sync.Mutex
+
+// writeCacheFile stores a cache entry and keeps the cache within its size
+// bound. The entry is written atomically so concurrent writers never leave
+// a torn file.
+func writeCacheFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	cacheSizeMu.Lock()
+	defer cacheSizeMu.Unlock()
+	// Overwriting an entry only grows the cache by the difference
+	var previous int64
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	enforceCacheLimit(int64(len(data)) - previous)
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file beside path and renames it
+// into place, so readers see the old content or the new, never a partial
+// write. An existing file keeps its mode; a new one gets perm.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// enforceCacheLimit adds written bytes (negative when an entry shrank) to
+// the running total kept in cache/.size and evicts the oldest entries once
+// the limit is exceeded. The running total avoids walking the cache on
+// every write.
+func enforceCacheLimit(written int64) {
+	cacheDir := getCacheDir()
+	sizePath := filepath.Join(cacheDir, ".size")
+
+	var total int64
+	if data, err := os.ReadFile(sizePath); err == nil {
+		fmt.Sscanf(string(data), "%d", &total)
+		total += written
+	} else {
+		total = getCacheSize(cacheDir)
+	}
+
+	maxMB := loadPlainConfig().Cache.MaxSizeMB
+	if maxMB <= 0 {
+		maxMB = defaultCacheMaxMB
+	}
+	limit := int64(maxMB) * 1024 * 1024
+
+	if total > limit {
+		total = evictCache(cacheDir, limit*cacheLowWaterPct/100)
+	}
+	os.WriteFile(sizePath, []byte(fmt.Sprintf("%d", total)), 0644)
+}
+
+// evictCache removes the oldest entries until the cache is under target,
+// returning the resulting size
+func evictCache(cacheDir string, target int64) int64 {
+	type entry struct {
+		path  string
+		mtime time.Time
+		size  int64
+	}
+	var entries []entry
+	var total int64
+
+	filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			total += info.Size()
+			if !isPinnedCacheFile(path) {
+				entries = append(entries, entry{path, info.ModTime(), info.Size()})
+			}
+		}
+		return nil
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mtime.Before(entries[j].mtime) })
+	for _, e := range entries {
+		if total <= target {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+		}
+	}
+	return total
 }
 
 func getCacheSize(dir string) int64 {
@@ -2574,7 +10395,7 @@ func getCacheSize(dir string) int64 {
 func countFiles(dir string) int {
 	count := 0
 	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
+		if err == nil && !info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
 			count++
 		}
 		return nil
@@ -2651,7 +10472,7 @@ func handleChat() {
 Available gg commands:
 - gg chat "..." - This conversation
 - gg ask "..." - Generate code and create PR (Pro tier)
-- gg pip/npm/brew <pkg> - Package lookup (~18 tokens)
+- gg pip/npm/brew <pkg> - Compact package lookup
 - gg a2a ask/plan/code - Agent-to-agent structured output
 - gg . - Current repo MCP endpoint
 - gg help - Full command list
@@ -2943,21 +10764,33 @@ func handleA2ACode(args []string) {
 
 // callAPIWithSystem - simplified API call with custom system prompt
 func callAPIWithSystem(provider, endpoint, apiKey, systemPrompt, userPrompt string) (string, error) {
+	return callAPIWithModel(provider, endpoint, apiKey, "", systemPrompt, userPrompt)
+}
+
+// callAPIWithModel is callAPIWithSystem with an explicit model; "" uses the
+// provider default
+func callAPIWithModel(provider, endpoint, apiKey, model, systemPrompt, userPrompt string) (string, error) {
+	if err := reserveModelCall(); err != nil {
+		return "", err
+	}
 	switch provider {
 	case ProviderAnthropic:
-		return callAnthropicWithSystem(apiKey, systemPrompt, userPrompt)
+		return callAnthropicWithSystem(apiKey, model, systemPrompt, userPrompt)
 	case ProviderOllama:
-		return callOllamaWithSystem(endpoint, "", systemPrompt, userPrompt)
+		return callOllamaWithSystem(endpoint, model, systemPrompt, userPrompt)
 	case ProviderOpenAI:
-		return callOpenAIWithSystem(apiKey, systemPrompt, userPrompt)
+		return callOpenAIWithSystem(endpoint, apiKey, model, systemPrompt, userPrompt)
 	default:
 		return "", fmt.Errorf("unsupported provider: %s", provider)
 	}
 }
 
-func callAnthropicWithSystem(apiKey, systemPrompt, userPrompt string) (string, error) {
+func callAnthropicWithSystem(apiKey, model, systemPrompt, userPrompt string) (string, error) {
+	if model == "" {
+		model = "claude-sonnet-4-20250514"
+	}
 	reqBody := map[string]interface{}{
-		"model":      "claude-sonnet-4-20250514",
+		"model":      model,
 		"max_tokens": 500,
 		"system":     systemPrompt,
 		"messages": []map[string]string{
@@ -2966,12 +10799,14 @@ func callAnthropicWithSystem(apiKey, systemPrompt, userPrompt string) (string, e
 	}
 
 	jsonBody, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonBody))
-	req.Header.Set("Content-Type", "application/json")
+	req, err := newModelRequest("https://api.anthropic.com/v1/messages", jsonBody)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Set("x-api-key", apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newHTTPClient(30 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -3017,7 +10852,11 @@ func callOllamaWithSystem(endpoint, model, systemPrompt, userPrompt string) (str
 	}
 
 	jsonBody, _ := json.Marshal(reqBody)
-	resp, err := http.Post(endpoint+"/api/generate", "application/json", bytes.NewBuffer(jsonBody))
+	req, err := newModelRequest(endpoint+"/api/generate", jsonBody)
+	if err != nil {
+		return "", err
+	}
+	resp, err := newHTTPClient(0).Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -3039,9 +10878,12 @@ func callOllamaWithSystem(endpoint, model, systemPrompt, userPrompt string) (str
 	return result.Response, nil
 }
 
-func callOpenAIWithSystem(apiKey, systemPrompt, userPrompt string) (string, error) {
+func callOpenAIWithSystem(baseURL, apiKey, model, systemPrompt, userPrompt string) (string, error) {
+	if model == "" {
+		model = "gpt-4o"
+	}
 	reqBody := map[string]interface{}{
-		"model": "gpt-4o",
+		"model": model,
 		"messages": []map[string]string{
 			{"role": "system", "content": systemPrompt},
 			{"role": "user", "content": userPrompt},
@@ -3050,11 +10892,13 @@ func callOpenAIWithSystem(apiKey, systemPrompt, userPrompt string) (string, erro
 	}
 
 	jsonBody, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonBody))
-	req.Header.Set("Content-Type", "application/json")
+	req, err := newModelRequest(openAIChatURL(baseURL), jsonBody)
+	if err != nil {
+		return "", err
+	}
 	req.Header.Set("Authorization", "Bearer "+apiKey)
 
-	client := &http.Client{Timeout: 30 * time.Second}
+	client := newHTTPClient(30 * time.Second)
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killGroupOnCancel keeps exec's default of killing only the process;
+// process groups and signals are unavailable on this platform
+func killGroupOnCancel(cmd *exec.Cmd, sig string, grace time.Duration) {}
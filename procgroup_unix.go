@@ -0,0 +1,34 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var timeoutSignals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"KILL": syscall.SIGKILL,
+	"HUP":  syscall.SIGHUP,
+}
+
+// killGroupOnCancel runs cmd in its own process group and makes context
+// cancellation signal the whole group, so children of sh -c stop too. If
+// the group outlives grace after sig, it is sent SIGKILL.
+func killGroupOnCancel(cmd *exec.Cmd, sig string, grace time.Duration) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		signal, ok := timeoutSignals[sig]
+		if !ok || signal == syscall.SIGKILL {
+			return syscall.Kill(pgid, syscall.SIGKILL)
+		}
+		time.AfterFunc(grace, func() {
+			syscall.Kill(pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(pgid, signal)
+	}
+}
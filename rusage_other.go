@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// maxRSSKB is unavailable on this platform
+func maxRSSKB(ps *os.ProcessState) int64 {
+	return 0
+}
+
+// exitSignal is unavailable on this platform
+func exitSignal(ps *os.ProcessState) string {
+	return ""
+}